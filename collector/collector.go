@@ -5,9 +5,13 @@
 package collector
 
 import (
+	"net"
 	"os"
 	"runtime"
 	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/cirocosta/ingress_ipvs_exporter/mapper"
 	"github.com/mqliang/libipvs"
@@ -17,26 +21,171 @@ import (
 	"github.com/vishvananda/netns"
 )
 
+var (
+	// serviceLabels are the labels that identify a virtual
+	// server.
+	//
+	// All services carry the address `family` (inet or inet6)
+	// given that the same fwmark might be used by both IPv4 and
+	// IPv6 services.
+	//
+	// Services that are based on firewall marks (like those
+	// created by docker swarm in the ingress network) are
+	// identified by `fwmark` and the `port` that iptables
+	// marks, while the rest are identified by their
+	// `protocol`, `address` and `port`.
+	serviceLabels = []string{"family", "fwmark", "protocol", "address", "port"}
+
+	// destinationLabels are the labels that identify a real
+	// server of a virtual server.
+	//
+	// Given that `address` refers to the real server address,
+	// the virtual server address goes in `virtual_address`.
+	//
+	// Labels from a ServiceEnricher (if any) follow both
+	// serviceLabels and destinationLabels, while those from a
+	// DestinationEnricher (if any) come last in destinationLabels.
+	destinationLabels = []string{"family", "fwmark", "protocol", "virtual_address", "port", "address"}
+)
+
+// Stages of a scrape that might fail, as reported in the
+// `stage` label of the `ipvs_scrape_errors_total` metric.
+const (
+	scrapeStageServices     = "services"
+	scrapeStageDestinations = "destinations"
+	scrapeStageMappings     = "mappings"
+	scrapeStageConnections  = "connections"
+)
+
+// labelsWith creates a new list of labels that contains
+// all of the labels in `labels` followed by `extra`.
+func labelsWith(labels []string, extra ...string) (res []string) {
+	res = make([]string, 0, len(labels)+len(extra))
+	res = append(res, labels...)
+	res = append(res, extra...)
+	return
+}
+
 // Collector implements the Prometheus Collector interface
 // to provide metrics regarding IPVS in a specified network
 // namespace.
 type Collector struct {
 	logger   zerolog.Logger
-	ipvs     libipvs.IPVSHandle
+	ipvs     Source
 	nsHandle *netns.NsHandle
 
+	// namespacePath, nsInode and newSource allow the handles
+	// to be reopened when the namespace gets recreated or the
+	// source starts failing (see reopen).
+	namespacePath string
+	nsInode       nsInode
+	newSource     func() (Source, error)
+	handlesMutex  *sync.Mutex
+	reopens       *prometheus.CounterVec
+
+	// closed indicates that the handles got released by
+	// Close and must not be used anymore (guarded by
+	// `handlesMutex`).
+	closed bool
+
+	upDesc             *prometheus.Desc
+	scrapeDurationDesc *prometheus.Desc
+	scrapeErrors       *prometheus.CounterVec
+
+	// connTable indicates whether the connection table
+	// should be inspected as well.
+	connTable bool
+
+	connectionsByStateDesc     *prometheus.Desc
+	destConnectionsByStateDesc *prometheus.Desc
+	connectionExpiryDesc       *prometheus.Desc
+
+	// skipMappings indicates whether iptables should not be
+	// inspected for the ports that fwmarks are set for.
+	skipMappings bool
+
+	// getMappings retrieves the ports that fwmarks are set
+	// for (mapper.GetMappings).
+	getMappings func() (map[mapper.Family]map[uint32][]mapper.Mapping, error)
+
+	// include and exclude select the services and
+	// destinations that are reported.
+	include Filter
+	exclude Filter
+
+	// filtered reports the number of services and
+	// destinations left out by the filters (only when
+	// filters are configured).
+	filteredDesc *prometheus.Desc
+
+	// maxServices and maxDestinationsPerService bound the
+	// number of services and destinations per service that
+	// are reported (zero means no limit).
+	maxServices               int
+	maxDestinationsPerService int
+
+	// seriesDropped counts the series left out by the limits
+	// (only when limits are configured), once per gathering.
+	seriesDropped prometheus.Counter
+
+	// enricher provides additional labels to the metrics
+	// of the services and destinations (if set).
+	enricher ServiceEnricher
+
+	// destinationEnricher provides additional labels to the
+	// metrics of the destinations (if set).
+	destinationEnricher DestinationEnricher
+
+	// counters keeps 32-bit counters monotonic across
+	// scrapes in kernels without 64-bit stats.
+	counters *counters
+
+	// refreshInterval indicates how often a background
+	// loop refreshes the snapshot that Collect serves from
+	// (see Poll). When zero, each scrape gathers its own.
+	refreshInterval time.Duration
+	snapshots       *snapshotCache
+
+	lastRefreshDesc *prometheus.Desc
+	dataAgeDesc     *prometheus.Desc
+
 	servicesTotalDesc *prometheus.Desc
 
+	serviceInfoDesc               *prometheus.Desc
+	servicePersistenceTimeoutDesc *prometheus.Desc
+
 	connectionsTotalDesc *prometheus.Desc
 	bytesInTotalDesc     *prometheus.Desc
 	bytesOutTotalDesc    *prometheus.Desc
+	packetsInTotalDesc   *prometheus.Desc
+	packetsOutTotalDesc  *prometheus.Desc
+
+	connectionsRateDesc *prometheus.Desc
+	packetsInRateDesc   *prometheus.Desc
+	packetsOutRateDesc  *prometheus.Desc
+	bytesInRateDesc     *prometheus.Desc
+	bytesOutRateDesc    *prometheus.Desc
 
 	destActiveConsDesc       *prometheus.Desc
 	destInactConnsDest       *prometheus.Desc
 	destBytesInDesc          *prometheus.Desc
 	destBytesOutDesc         *prometheus.Desc
+	destPacketsInDesc        *prometheus.Desc
+	destPacketsOutDesc       *prometheus.Desc
 	destConnectionsTotalDesc *prometheus.Desc
 	destTotalDesc            *prometheus.Desc
+
+	destInfoDesc           *prometheus.Desc
+	destWeightDesc         *prometheus.Desc
+	destPersistConnsDesc   *prometheus.Desc
+	destUpperThresholdDesc *prometheus.Desc
+	destLowerThresholdDesc *prometheus.Desc
+
+	destConnectionsRateDesc *prometheus.Desc
+	destPacketsInRateDesc   *prometheus.Desc
+	destPacketsOutRateDesc  *prometheus.Desc
+	destBytesInRateDesc     *prometheus.Desc
+	destBytesOutRateDesc    *prometheus.Desc
 }
 
 // CollectorConfig provides the necessary configuration for
@@ -54,6 +203,76 @@ type CollectorConfig struct {
 	// - "/var/run/docker/netns/ingress_sbox"
 	// - "" (nothing - use the current ns)
 	NamespacePath string
+
+	// ConnectionTable indicates whether the ipvs connection
+	// table (/proc/net/ip_vs_conn) should be inspected to
+	// report the number of connections by state as well as
+	// the time left until they expire.
+	//
+	// As the table might be big, this is disabled by default.
+	ConnectionTable bool
+
+	// SkipMappings makes fwmark-based services be reported
+	// without inspecting iptables for the port that they mark
+	// (their `port` is left as zero).
+	//
+	// This is meant for environments without the docker swarm
+	// mangle rules, like kube-proxy in IPVS mode.
+	SkipMappings bool
+
+	// Include, when set, restricts the services and
+	// destinations reported to those that match all of its
+	// criteria.
+	Include Filter
+
+	// Exclude, when set, leaves out the services and
+	// destinations that match any of its criteria.
+	//
+	// Services that are left out (either way) are never
+	// asked for their destinations.
+	Exclude Filter
+
+	// MaxServices, when set, limits the number of services
+	// reported per scrape; those beyond it (in the order of
+	// their labels) are left out.
+	MaxServices int
+
+	// MaxDestinationsPerService, when set, limits the number
+	// of destinations reported per service; those beyond it
+	// (in the order of their addresses) are rolled up into a
+	// single destination with the `__overflow__` address.
+	MaxDestinationsPerService int
+
+	// Source indicates where ipvs information comes from
+	// (SourceNetlink or SourceProcfs).
+	//
+	// Defaults to SourceNetlink.
+	Source string
+
+	// ServiceEnricher, when set, provides additional labels
+	// to the metrics of the services and destinations.
+	ServiceEnricher ServiceEnricher
+
+	// DestinationEnricher, when set, provides additional
+	// labels to the metrics of the destinations.
+	DestinationEnricher DestinationEnricher
+
+	// RefreshInterval, when set, makes the collector serve
+	// scrapes from a snapshot that is refreshed in the
+	// background at this interval (see Poll) instead of
+	// gathering ipvs information on every scrape.
+	RefreshInterval time.Duration
+
+	// MetricSchema indicates how metrics are named
+	// (MetricSchemaLegacy or MetricSchemaV2).
+	//
+	// Defaults to MetricSchemaLegacy.
+	MetricSchema string
+
+	// MetricPrefix is the prefix of the names of all metrics.
+	//
+	// Defaults to DefaultMetricPrefix.
+	MetricPrefix string
 }
 
 // NewCollector initializes the collector making use of the configuration
@@ -63,39 +282,28 @@ type CollectorConfig struct {
 // descriptions are not registered in the global instance here (see
 // NewExporter).
 func NewCollector(cfg CollectorConfig) (c Collector, err error) {
-	var nsHandle netns.NsHandle
-
-	if cfg.NamespacePath != "" {
-		nsHandle, err = netns.GetFromPath(cfg.NamespacePath)
-		if err != nil {
-			err = errors.Wrapf(err,
-				"failed to retrieve ns from path %s",
-				cfg.NamespacePath)
-			return
+	switch cfg.Source {
+	case "", SourceNetlink:
+		c.newSource = newNetlinkSource
+	case SourceProcfs:
+		c.newSource = func() (Source, error) {
+			return newProcfsSource(ipvsTablePath), nil
 		}
-
-		c.nsHandle = &nsHandle
+	default:
+		err = errors.Errorf("unknown source %s", cfg.Source)
+		return
 	}
 
-	getIpvsHandle := func() (err error) {
-		c.ipvs, err = libipvs.New()
-		if err != nil {
-			err = errors.Wrapf(err,
-				"failed to create ipvs handle for namespace path")
-			return
-		}
+	c.namespacePath = cfg.NamespacePath
 
+	err = c.initDescriptors(cfg)
+	if err != nil {
 		return
 	}
 
-	if c.nsHandle != nil {
-		err = c.RunInNetns(getIpvsHandle)
-	} else {
-		err = getIpvsHandle()
-	}
+	c.nsHandle, c.nsInode, c.ipvs, err = c.openHandles()
 	if err != nil {
-		err = errors.Wrapf(err,
-			"failed to retrieve ipvs handle")
+		return
 	}
 
 	c.logger = zerolog.New(os.Stdout).
@@ -103,83 +311,449 @@ func NewCollector(cfg CollectorConfig) (c Collector, err error) {
 		Str("from", "collector").
 		Logger()
 
+	return
+}
+
+// initDescriptors creates the descriptions of all the metrics
+// that the collector reports as well as the metrics that the
+// collector itself keeps track of across scrapes.
+func (c *Collector) initDescriptors(cfg CollectorConfig) (err error) {
+	namer, err := newMetricNamer(cfg.MetricSchema, cfg.MetricPrefix)
+	if err != nil {
+		return
+	}
+
+	c.skipMappings = cfg.SkipMappings
+	c.getMappings = mapper.GetMappings
+	c.include, c.exclude = cfg.Include, cfg.Exclude
+	c.enricher = cfg.ServiceEnricher
+
+	var (
+		serviceLabels     = serviceLabels
+		destinationLabels = destinationLabels
+	)
+
+	if c.enricher != nil {
+		serviceLabels = labelsWith(serviceLabels, c.enricher.Labels()...)
+		destinationLabels = labelsWith(destinationLabels, c.enricher.Labels()...)
+	}
+
+	c.destinationEnricher = cfg.DestinationEnricher
+	if c.destinationEnricher != nil {
+		destinationLabels = labelsWith(destinationLabels, c.destinationEnricher.Labels()...)
+	}
+
 	c.servicesTotalDesc = prometheus.NewDesc(
-		"ipvs_services_total",
+		namer.name("services_total"),
 		"The total number of services registered in ipvs",
 		nil,
 		prometheus.Labels{"namespace": cfg.NamespacePath},
 	)
 
+	c.serviceInfoDesc = prometheus.NewDesc(
+		namer.name("service_info"),
+		"Configuration of a virtual server (scheduler, flags, timeout, netmask and persistence engine)",
+		labelsWith(serviceLabels, "scheduler", "flags", "timeout", "netmask", "pe"),
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.servicePersistenceTimeoutDesc = prometheus.NewDesc(
+		namer.name("service_persistence_timeout_seconds"),
+		"The timeout of persistent connections to a virtual server (zero if not persistent)",
+		serviceLabels,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
 	c.connectionsTotalDesc = prometheus.NewDesc(
-		"ipvs_connections_total",
+		namer.name("connections_total"),
 		"The total number of connections made to a virtual server",
-		[]string{"fwmark", "port"},
+		serviceLabels,
 		prometheus.Labels{"namespace": cfg.NamespacePath},
 	)
 
 	c.bytesInTotalDesc = prometheus.NewDesc(
-		"ipvs_bytes_in_total",
+		namer.name("bytes_in_total"),
 		"The total number of incoming bytes a virtual server",
-		[]string{"fwmark", "port"},
+		serviceLabels,
 		prometheus.Labels{"namespace": cfg.NamespacePath},
 	)
 
 	c.bytesOutTotalDesc = prometheus.NewDesc(
-		"ipvs_bytes_out_total",
+		namer.name("bytes_out_total"),
 		"The total number of outgoing bytes from a virtual server",
-		[]string{"fwmark", "port"},
+		serviceLabels,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.packetsInTotalDesc = prometheus.NewDesc(
+		namer.name("packets_in_total"),
+		"The total number of incoming packets to a virtual server",
+		serviceLabels,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.packetsOutTotalDesc = prometheus.NewDesc(
+		namer.name("packets_out_total"),
+		"The total number of outgoing packets from a virtual server",
+		serviceLabels,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.connectionsRateDesc = prometheus.NewDesc(
+		namer.name("connections_per_second"),
+		"The rate of connections made to a virtual server as estimated by the kernel",
+		serviceLabels,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.packetsInRateDesc = prometheus.NewDesc(
+		namer.name("packets_in_per_second"),
+		"The rate of incoming packets to a virtual server as estimated by the kernel",
+		serviceLabels,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.packetsOutRateDesc = prometheus.NewDesc(
+		namer.name("packets_out_per_second"),
+		"The rate of outgoing packets from a virtual server as estimated by the kernel",
+		serviceLabels,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.bytesInRateDesc = prometheus.NewDesc(
+		namer.name("bytes_in_per_second"),
+		"The rate of incoming bytes to a virtual server as estimated by the kernel",
+		serviceLabels,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.bytesOutRateDesc = prometheus.NewDesc(
+		namer.name("bytes_out_per_second"),
+		"The rate of outgoing bytes from a virtual server as estimated by the kernel",
+		serviceLabels,
 		prometheus.Labels{"namespace": cfg.NamespacePath},
 	)
 
 	c.destTotalDesc = prometheus.NewDesc(
-		"ipvs_destination_total",
+		namer.name("destination_total"),
 		"The total number of real servers that are destinations to the service",
-		[]string{"fwmark", "port"},
+		serviceLabels,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.destInfoDesc = prometheus.NewDesc(
+		namer.name("destination_info"),
+		"Configuration of a real server (forwarding method)",
+		labelsWith(destinationLabels, "forwarding_method"),
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.destWeightDesc = prometheus.NewDesc(
+		namer.name("destination_weight"),
+		"The weight of a real server (zero if drained)",
+		destinationLabels,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.destPersistConnsDesc = prometheus.NewDesc(
+		namer.name("destination_persistent_connections"),
+		"The number of persistent connections (templates) to a real server",
+		destinationLabels,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.destUpperThresholdDesc = prometheus.NewDesc(
+		namer.name("destination_upper_threshold_connections"),
+		"The upper connection threshold of a real server (zero if unlimited)",
+		destinationLabels,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.destLowerThresholdDesc = prometheus.NewDesc(
+		namer.name("destination_lower_threshold_connections"),
+		"The lower connection threshold of a real server",
+		destinationLabels,
 		prometheus.Labels{"namespace": cfg.NamespacePath},
 	)
 
 	c.destActiveConsDesc = prometheus.NewDesc(
-		"ipvs_destination_active_connections_total",
+		namer.name("destination_active_connections_total"),
 		"The total number of connections established to a destination server",
-		[]string{"fwmark", "port", "address"},
+		destinationLabels,
 		prometheus.Labels{"namespace": cfg.NamespacePath},
 	)
 
 	c.destInactConnsDest = prometheus.NewDesc(
-		"ipvs_destination_inactive_connections_total",
+		namer.name("destination_inactive_connections_total"),
 		"The total number of connections inactive but established to a destination server",
-		[]string{"fwmark", "port", "address"},
+		destinationLabels,
 		prometheus.Labels{"namespace": cfg.NamespacePath},
 	)
 
 	c.destBytesInDesc = prometheus.NewDesc(
-		"ipvs_destination_bytes_in_total",
+		namer.name("destination_bytes_in_total"),
 		"The total number of incoming bytes to a real server",
-		[]string{"fwmark", "port", "address"},
+		destinationLabels,
 		prometheus.Labels{"namespace": cfg.NamespacePath},
 	)
 
 	c.destBytesOutDesc = prometheus.NewDesc(
-		"ipvs_destination_bytes_out_total",
+		namer.name("destination_bytes_out_total"),
 		"The total number of outgoing bytes to a real server",
-		[]string{"fwmark", "port", "address"},
+		destinationLabels,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.destPacketsInDesc = prometheus.NewDesc(
+		namer.name("destination_packets_in_total"),
+		"The total number of incoming packets to a real server",
+		destinationLabels,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.destPacketsOutDesc = prometheus.NewDesc(
+		namer.name("destination_packets_out_total"),
+		"The total number of outgoing packets from a real server",
+		destinationLabels,
 		prometheus.Labels{"namespace": cfg.NamespacePath},
 	)
 
 	c.destConnectionsTotalDesc = prometheus.NewDesc(
-		"ipvs_destination_connections_total",
+		namer.name("destination_connections_total"),
 		"The total number connections ever established to a destination",
-		[]string{"fwmark", "port", "address"},
+		destinationLabels,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.destConnectionsRateDesc = prometheus.NewDesc(
+		namer.name("destination_connections_per_second"),
+		"The rate of connections established to a real server as estimated by the kernel",
+		destinationLabels,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.destPacketsInRateDesc = prometheus.NewDesc(
+		namer.name("destination_packets_in_per_second"),
+		"The rate of incoming packets to a real server as estimated by the kernel",
+		destinationLabels,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.destPacketsOutRateDesc = prometheus.NewDesc(
+		namer.name("destination_packets_out_per_second"),
+		"The rate of outgoing packets from a real server as estimated by the kernel",
+		destinationLabels,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.destBytesInRateDesc = prometheus.NewDesc(
+		namer.name("destination_bytes_in_per_second"),
+		"The rate of incoming bytes to a real server as estimated by the kernel",
+		destinationLabels,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.destBytesOutRateDesc = prometheus.NewDesc(
+		namer.name("destination_bytes_out_per_second"),
+		"The rate of outgoing bytes from a real server as estimated by the kernel",
+		destinationLabels,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.upDesc = prometheus.NewDesc(
+		namer.name("up"),
+		"Whether the last scrape of ipvs metrics was able to list the services",
+		nil,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.scrapeDurationDesc = prometheus.NewDesc(
+		namer.name("scrape_duration_seconds"),
+		"The time it took to gather ipvs metrics",
+		nil,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.scrapeErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        namer.name("scrape_errors_total"),
+			Help:        "The total number of errors found while gathering ipvs metrics",
+			ConstLabels: prometheus.Labels{"namespace": cfg.NamespacePath},
+		},
+		[]string{"stage"},
+	)
+
+	for _, stage := range []string{
+		scrapeStageServices,
+		scrapeStageDestinations,
+		scrapeStageMappings,
+	} {
+		c.scrapeErrors.WithLabelValues(stage)
+	}
+
+	c.counters = newCounters()
+
+	c.handlesMutex = &sync.Mutex{}
+	c.reopens = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        namer.name("reopens_total"),
+			Help:        "The total number of times that the namespace and ipvs handles got reopened",
+			ConstLabels: prometheus.Labels{"namespace": cfg.NamespacePath},
+		},
+		[]string{"reason"},
+	)
+
+	for _, reason := range []string{
+		reopenReasonNamespaceChanged,
+		reopenReasonError,
+	} {
+		c.reopens.WithLabelValues(reason)
+	}
+
+	c.refreshInterval = cfg.RefreshInterval
+	c.snapshots = &snapshotCache{}
+
+	c.lastRefreshDesc = prometheus.NewDesc(
+		namer.name("last_refresh_timestamp_seconds"),
+		"The unix time of the last successful refresh of ipvs information",
+		nil,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.dataAgeDesc = prometheus.NewDesc(
+		namer.name("data_age_seconds"),
+		"The time since the last successful refresh of ipvs information",
+		nil,
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	if !c.include.isEmpty() || !c.exclude.isEmpty() {
+		c.filteredDesc = prometheus.NewDesc(
+			namer.name("filtered_objects"),
+			"The number of objects (services or destinations) left out by filters in the last gathering",
+			[]string{"kind"},
+			prometheus.Labels{"namespace": cfg.NamespacePath},
+		)
+	}
+
+	if cfg.MaxServices < 0 || cfg.MaxDestinationsPerService < 0 {
+		err = errors.Errorf("limits must not be negative")
+		return
+	}
+
+	c.maxServices = cfg.MaxServices
+	c.maxDestinationsPerService = cfg.MaxDestinationsPerService
+
+	if c.maxServices > 0 || c.maxDestinationsPerService > 0 {
+		c.seriesDropped = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name:        namer.name("series_dropped_total"),
+				Help:        "The total number of series left out (or rolled up) by the cardinality limits",
+				ConstLabels: prometheus.Labels{"namespace": cfg.NamespacePath},
+			},
+		)
+	}
+
+	if !cfg.ConnectionTable {
+		return
+	}
+
+	c.connTable = true
+	c.scrapeErrors.WithLabelValues(scrapeStageConnections)
+
+	c.connectionsByStateDesc = prometheus.NewDesc(
+		namer.name("connections"),
+		"The number of entries in the connection table of a virtual server by state",
+		labelsWith(serviceLabels, "state"),
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.destConnectionsByStateDesc = prometheus.NewDesc(
+		namer.name("destination_connections"),
+		"The number of entries in the connection table of a real server by state",
+		labelsWith(destinationLabels, "state"),
+		prometheus.Labels{"namespace": cfg.NamespacePath},
+	)
+
+	c.connectionExpiryDesc = prometheus.NewDesc(
+		namer.name("connection_expiry_seconds"),
+		"The time left until the entries in the connection table of a virtual server expire",
+		serviceLabels,
 		prometheus.Labels{"namespace": cfg.NamespacePath},
 	)
 
 	return
 }
 
+// Close releases the ipvs source and the handle to the
+// network namespace of the collector, waiting for a gathering
+// in progress (see gather) to finish. The collector doesn't
+// gather anything afterwards.
+func (c *Collector) Close() {
+	c.handlesMutex.Lock()
+	defer c.handlesMutex.Unlock()
+
+	c.closed = true
+	c.closeHandles()
+}
+
+// closeHandles releases the ipvs source and the handle to the
+// network namespace.
+//
+// The caller must hold `handlesMutex`.
+func (c *Collector) closeHandles() {
+	if c.ipvs != nil {
+		c.ipvs.Close()
+	}
+
+	if c.nsHandle != nil {
+		c.nsHandle.Close()
+	}
+}
+
+// hasServices indicates whether there's any ipvs service in the
+// network namespace of the collector.
+func (c *Collector) hasServices() (res bool, err error) {
+	c.handlesMutex.Lock()
+	defer c.handlesMutex.Unlock()
+
+	if c.closed {
+		err = errors.New("collector closed")
+		return
+	}
+
+	f := func() (err error) {
+		services, err := c.ipvs.ListServices()
+		if err != nil {
+			err = errors.Wrapf(err,
+				"failed to list ipvs services")
+			return
+		}
+
+		res = len(services) > 0
+		return
+	}
+
+	if c.nsHandle != nil {
+		err = c.RunInNetns(f)
+	} else {
+		err = f()
+	}
+
+	return
+}
+
 // RunInNetns executes a given function `f` in the network
 // namespace as configured via `NamespacePath` in
 // `CollectorConfig`.
 func (c *Collector) RunInNetns(f func() (err error)) (err error) {
+	err = runInNetns(*c.nsHandle, f)
+	return
+}
+
+// runInNetns executes a given function `f` in the network
+// namespace referred by `nsHandle`.
+func runInNetns(nsHandle netns.NsHandle, f func() (err error)) (err error) {
 	currentNs, err := netns.Get()
 	if err != nil {
 		err = errors.Wrapf(err,
@@ -197,7 +771,7 @@ func (c *Collector) RunInNetns(f func() (err error)) (err error) {
 		runtime.UnlockOSThread()
 	}()
 
-	err = netns.Set(*c.nsHandle)
+	err = netns.Set(nsHandle)
 	if err != nil {
 		err = errors.Wrapf(err,
 			"failed to set network namespace")
@@ -211,70 +785,233 @@ func (c *Collector) RunInNetns(f func() (err error)) (err error) {
 // Describe sends to the provided channel the set of all configured
 // metric descriptions at the moment of collector registration.
 func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.upDesc
+	ch <- c.scrapeDurationDesc
+	c.scrapeErrors.Describe(ch)
+	c.reopens.Describe(ch)
+
+	if c.refreshInterval > 0 {
+		ch <- c.lastRefreshDesc
+		ch <- c.dataAgeDesc
+	}
+
+	if c.filteredDesc != nil {
+		ch <- c.filteredDesc
+	}
+
+	if c.seriesDropped != nil {
+		c.seriesDropped.Describe(ch)
+	}
+
+	if c.connTable {
+		ch <- c.connectionsByStateDesc
+		ch <- c.destConnectionsByStateDesc
+		ch <- c.connectionExpiryDesc
+	}
+
 	ch <- c.servicesTotalDesc
 
+	ch <- c.serviceInfoDesc
+	ch <- c.servicePersistenceTimeoutDesc
+
 	ch <- c.connectionsTotalDesc
 	ch <- c.bytesInTotalDesc
 	ch <- c.bytesOutTotalDesc
+	ch <- c.packetsInTotalDesc
+	ch <- c.packetsOutTotalDesc
+
+	ch <- c.connectionsRateDesc
+	ch <- c.packetsInRateDesc
+	ch <- c.packetsOutRateDesc
+	ch <- c.bytesInRateDesc
+	ch <- c.bytesOutRateDesc
 
 	ch <- c.destActiveConsDesc
 	ch <- c.destInactConnsDest
 	ch <- c.destBytesInDesc
 	ch <- c.destBytesOutDesc
+	ch <- c.destPacketsInDesc
+	ch <- c.destPacketsOutDesc
 	ch <- c.destConnectionsTotalDesc
 	ch <- c.destTotalDesc
+
+	ch <- c.destInfoDesc
+	ch <- c.destWeightDesc
+	ch <- c.destPersistConnsDesc
+	ch <- c.destUpperThresholdDesc
+	ch <- c.destLowerThresholdDesc
+
+	ch <- c.destConnectionsRateDesc
+	ch <- c.destPacketsInRateDesc
+	ch <- c.destPacketsOutRateDesc
+	ch <- c.destBytesInRateDesc
+	ch <- c.destBytesOutRateDesc
 }
 
 // GetServicesInfos retrieves a list of services and then, for
 // each service, enhances it with extra information that is gathered
 // from subsequent calls via netlink and by inspecting iptables.
 //
+// iptables is only inspected if there are fwmark-based services.
+//
 // This results in list of ServiceInfo objects that have all the necessary
 // information regarding an IPVS service and how it links itself to real
 // servers.
+//
+// Only failing to list the services makes the whole retrieval fail:
+// services whose destinations or fwmark mappings can't be retrieved
+// are skipped, with the failure accounted in `ipvs_scrape_errors_total`.
+//
+// Services and destinations that don't pass the filters (see
+// CollectorConfig) are left out.
 func (c *Collector) GetServicesInfos() (infos []*ServiceInfo, err error) {
+	infos, _, err = c.getServicesInfos()
+	return
+}
+
+// getServicesInfos implements GetServicesInfos, also counting
+// the services and destinations that were filtered out.
+func (c *Collector) getServicesInfos() (infos []*ServiceInfo, filtered filterCounts, err error) {
 	var (
 		destinations []*libipvs.Destination
 		services     []*libipvs.Service
-		mappings     map[uint32]uint16
+		mappings     map[mapper.Family]map[uint32][]mapper.Mapping
+		mappingsErr  error
 	)
 
 	services, err = c.ipvs.ListServices()
 	if err != nil {
+		c.scrapeErrors.WithLabelValues(scrapeStageServices).Inc()
 		err = errors.Wrapf(err,
 			"failed to retrieve ipvs services")
 		return
 	}
 
-	mappings, err = mapper.GetMappings()
-	if err != nil {
-		err = errors.Wrapf(err,
-			"failed to retrieve iptables fwmark mappings")
-		return
+	for _, service := range services {
+		if service.FWMark == 0 || c.skipMappings ||
+			!mayKeepService(&c.include, &c.exclude, service) {
+			continue
+		}
+
+		mappings, mappingsErr = c.getMappings()
+		if mappingsErr != nil {
+			mappingsErr = errors.Wrapf(mappingsErr,
+				"failed to retrieve fwmark mappings")
+		}
+
+		break
 	}
 
-	infos = make([]*ServiceInfo, len(services))
-	for ndx, service := range services {
-		destPort, ok := mappings[service.FWMark]
-		if !ok {
-			err = errors.Errorf(
-				"couldn't find destination port for fwmark %d",
-				service.FWMark)
-			return
+	infos = make([]*ServiceInfo, 0, len(services))
+	for _, service := range services {
+		var (
+			destPort        uint16
+			destAddress     net.IP
+			serviceMappings []mapper.Mapping
+			svcErr          error
+		)
+
+		// the address family of fwmark-based services isn't
+		// always known (see procfsSource), in which case it's
+		// that of the mappings of their fwmarks (inet if they
+		// can't tell).
+		if service.AddressFamily == syscall.AF_UNSPEC {
+			service.AddressFamily = syscall.AF_INET
+			if _, ok := mappings[mapper.IPv4][service.FWMark]; !ok {
+				if _, ok := mappings[mapper.IPv6][service.FWMark]; ok {
+					service.AddressFamily = syscall.AF_INET6
+				}
+			}
 		}
 
-		destinations, err = c.ipvs.ListDestinations(service)
-		if err != nil {
-			err = errors.Wrapf(err,
+		// services that the filters leave out regardless of
+		// their mappings are never looked up in them
+		if !mayKeepService(&c.include, &c.exclude, service) {
+			filtered.services++
+			continue
+		}
+
+		if service.FWMark != 0 && !c.skipMappings {
+			var ok bool
+
+			serviceMappings, ok = mappings[mapper.Family(service.AddressFamily)][service.FWMark]
+			if !ok {
+				svcErr = mappingsErr
+				if svcErr == nil {
+					svcErr = errors.Errorf(
+						"couldn't find destination port for fwmark %d (%s)",
+						service.FWMark, service.AddressFamily)
+				}
+
+				c.scrapeErrors.WithLabelValues(scrapeStageMappings).Inc()
+				c.logger.Error().
+					Err(svcErr).
+					Uint32("fwmark", service.FWMark).
+					Msg("skipping service")
+				continue
+			}
+
+			for _, mapping := range serviceMappings {
+				if destPort = mapping.Port(); destPort != 0 {
+					break
+				}
+			}
+
+			for _, mapping := range serviceMappings {
+				if destAddress = mapping.Destination; destAddress != nil {
+					break
+				}
+			}
+		}
+
+		if !keepService(&c.include, &c.exclude, service, serviceMappings) {
+			filtered.services++
+			continue
+		}
+
+		destinations, svcErr = c.ipvs.ListDestinations(service)
+		if svcErr != nil {
+			svcErr = errors.Wrapf(svcErr,
 				"failed to retrieve destinations from service")
-			return
+
+			c.scrapeErrors.WithLabelValues(scrapeStageDestinations).Inc()
+			c.logger.Error().
+				Err(svcErr).
+				Interface("service", service).
+				Msg("skipping service")
+			continue
+		}
+
+		kept := make([]*libipvs.Destination, 0, len(destinations))
+		for _, destination := range destinations {
+			if !keepDestination(&c.include, &c.exclude, destination) {
+				filtered.destinations++
+				continue
+			}
+
+			kept = append(kept, destination)
 		}
+		destinations = kept
 
-		infos[ndx] = &ServiceInfo{
+		info := &ServiceInfo{
 			Service:            service,
 			destinationPort:    destPort,
+			mappings:           serviceMappings,
 			destinationServers: destinations,
 		}
+
+		if c.enricher != nil {
+			info.enrichment = c.enricher.LabelValues(service, destPort, destAddress)
+		}
+
+		if c.destinationEnricher != nil {
+			info.destinationEnrichment = make(map[*libipvs.Destination][]string, len(destinations))
+			for _, destination := range destinations {
+				info.destinationEnrichment[destination] = c.destinationEnricher.LabelValues(destination)
+			}
+		}
+
+		infos = append(infos, info)
 	}
 
 	return
@@ -284,33 +1021,81 @@ func (c *Collector) GetServicesInfos() (infos []*ServiceInfo, err error) {
 // It's meant to list all of the services registered in IPVS in a
 // given namespace and the corresponding metrics to the supplied
 // channel.
+//
+// Regardless of the outcome, the health of the scrape is reported
+// via `ipvs_up`, `ipvs_scrape_errors_total` and
+// `ipvs_scrape_duration_seconds`.
+//
+// When a RefreshInterval is configured, metrics are served from the
+// last snapshot refreshed by Poll instead.
 func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 	var (
-		err   error
-		infos []*ServiceInfo
+		snap  *snapshot
+		start = time.Now()
 	)
 
-	f := func() (err error) {
-		infos, err = c.GetServicesInfos()
-		return
-	}
+	defer func() {
+		c.scrapeErrors.Collect(ch)
+		c.reopens.Collect(ch)
 
-	if c.nsHandle != nil {
-		err = c.RunInNetns(f)
+		ch <- prometheus.MustNewConstMetric(
+			c.scrapeDurationDesc,
+			prometheus.GaugeValue,
+			time.Since(start).Seconds(),
+		)
+	}()
+
+	if c.refreshInterval > 0 {
+		snap = c.snapshots.get()
+		c.collectRefresh(ch)
 	} else {
-		err = f()
+		snap = c.gather()
 	}
-	if err != nil {
-		c.logger.Error().
-			Err(err).
-			Msg("failed to retrieve ipvs info")
+
+	if snap == nil || snap.err != nil {
+		ch <- prometheus.MustNewConstMetric(
+			c.upDesc,
+			prometheus.GaugeValue,
+			0,
+		)
 		return
 	}
 
+	ch <- prometheus.MustNewConstMetric(
+		c.upDesc,
+		prometheus.GaugeValue,
+		1,
+	)
+
+	infos := snap.infos
+
+	if c.filteredDesc != nil {
+		ch <- prometheus.MustNewConstMetric(
+			c.filteredDesc,
+			prometheus.GaugeValue,
+			float64(snap.filtered.services),
+			"service",
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.filteredDesc,
+			prometheus.GaugeValue,
+			float64(snap.filtered.destinations),
+			"destination",
+		)
+	}
+
+	if c.seriesDropped != nil {
+		c.seriesDropped.Collect(ch)
+	}
+
+	if c.connTable && snap.connsErr == nil {
+		c.collectConnTable(ch, infos, snap.conns)
+	}
+
 	ch <- prometheus.MustNewConstMetric(
 		c.servicesTotalDesc,
 		prometheus.GaugeValue,
-		float64(len(infos)),
+		float64(snap.servicesTotal),
 	)
 
 	if len(infos) == 0 {
@@ -322,86 +1107,270 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 			Interface("info", info).
 			Msg("reporting service")
 
-		ch <- prometheus.MustNewConstMetric(
-			c.connectionsTotalDesc,
-			prometheus.CounterValue,
-			float64(info.Stats.Connections),
-			strconv.Itoa(int(info.FWMark)),
-			strconv.Itoa(int(info.destinationPort)),
-		)
+		c.collectService(ch, info, snap.detailed)
+	}
 
-		ch <- prometheus.MustNewConstMetric(
-			c.bytesInTotalDesc,
-			prometheus.CounterValue,
-			float64(info.Stats.BytesIn),
-			strconv.Itoa(int(info.FWMark)),
-			strconv.Itoa(int(info.destinationPort)),
-		)
+	return
+}
 
-		ch <- prometheus.MustNewConstMetric(
-			c.bytesOutTotalDesc,
-			prometheus.CounterValue,
-			float64(info.Stats.BytesOut),
-			strconv.Itoa(int(info.FWMark)),
-			strconv.Itoa(int(info.destinationPort)),
-		)
+// collectService sends the metrics of a service and of its
+// destinations to the supplied channel, `detailed` indicating
+// whether these came from a detailed source.
+func (c *Collector) collectService(ch chan<- prometheus.Metric, info *ServiceInfo, detailed bool) {
+	// sources that are not detailed don't know the
+	// persistence timeout
+	var timeout string
+	if detailed {
+		timeout = strconv.Itoa(int(info.Timeout))
+	}
 
+	ch <- prometheus.MustNewConstMetric(
+		c.serviceInfoDesc,
+		prometheus.GaugeValue,
+		1,
+		info.labelValues(
+			info.SchedName,
+			formatServiceFlags(info.Flags.Flags),
+			timeout,
+			formatNetmask(info.AddressFamily, info.Netmask),
+			info.PEName)...,
+	)
+
+	if detailed {
 		ch <- prometheus.MustNewConstMetric(
-			c.destTotalDesc,
+			c.servicePersistenceTimeoutDesc,
 			prometheus.GaugeValue,
-			float64(len(info.destinationServers)),
-			strconv.Itoa(int(info.FWMark)),
-			strconv.Itoa(int(info.destinationPort)),
+			float64(info.Timeout),
+			info.labelValues()...,
 		)
 
-		for _, destination := range info.destinationServers {
-
-			ch <- prometheus.MustNewConstMetric(
-				c.destActiveConsDesc,
-				prometheus.GaugeValue,
-				float64(destination.ActiveConns),
-				strconv.Itoa(int(info.FWMark)),
-				strconv.Itoa(int(info.destinationPort)),
-				destination.Address.String(),
-			)
-
-			ch <- prometheus.MustNewConstMetric(
-				c.destInactConnsDest,
-				prometheus.GaugeValue,
-				float64(destination.InactConns),
-				strconv.Itoa(int(info.FWMark)),
-				strconv.Itoa(int(info.destinationPort)),
-				destination.Address.String(),
-			)
-
-			ch <- prometheus.MustNewConstMetric(
-				c.destBytesInDesc,
-				prometheus.CounterValue,
-				float64(destination.Stats.BytesIn),
-				strconv.Itoa(int(info.FWMark)),
-				strconv.Itoa(int(info.destinationPort)),
-				destination.Address.String(),
-			)
-
-			ch <- prometheus.MustNewConstMetric(
-				c.destBytesOutDesc,
-				prometheus.CounterValue,
-				float64(destination.Stats.BytesOut),
-				strconv.Itoa(int(info.FWMark)),
-				strconv.Itoa(int(info.destinationPort)),
-				destination.Address.String(),
-			)
-
-			ch <- prometheus.MustNewConstMetric(
-				c.destConnectionsTotalDesc,
-				prometheus.CounterValue,
-				float64(destination.Stats.Connections),
-				strconv.Itoa(int(info.FWMark)),
-				strconv.Itoa(int(info.destinationPort)),
-				destination.Address.String(),
-			)
-		}
+		c.collectServiceStats(ch, info)
 	}
 
-	return
+	ch <- prometheus.MustNewConstMetric(
+		c.destTotalDesc,
+		prometheus.GaugeValue,
+		float64(info.destinationsTotal()),
+		info.labelValues()...,
+	)
+
+	for _, destination := range info.destinationServers {
+		c.collectDestination(ch, info, destination, detailed)
+	}
+}
+
+// collectDestination sends the metrics of a destination of a
+// service to the supplied channel, `detailed` indicating whether
+// it came from a detailed source.
+func (c *Collector) collectDestination(
+	ch chan<- prometheus.Metric, info *ServiceInfo, destination *libipvs.Destination, detailed bool,
+) {
+	ch <- prometheus.MustNewConstMetric(
+		c.destInfoDesc,
+		prometheus.GaugeValue,
+		1,
+		info.destinationLabelValues(destination,
+			destination.FwdMethod.String())...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.destWeightDesc,
+		prometheus.GaugeValue,
+		float64(destination.Weight),
+		info.destinationLabelValues(destination)...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.destActiveConsDesc,
+		prometheus.GaugeValue,
+		float64(destination.ActiveConns),
+		info.destinationLabelValues(destination)...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.destInactConnsDest,
+		prometheus.GaugeValue,
+		float64(destination.InactConns),
+		info.destinationLabelValues(destination)...,
+	)
+
+	if detailed {
+		c.collectDestinationDetails(ch, info, destination)
+	}
+}
+
+// collectServiceStats sends the stats (counters and rates) of
+// a service to the supplied channel.
+//
+// These are only available when the source is detailed.
+func (c *Collector) collectServiceStats(ch chan<- prometheus.Metric, info *ServiceInfo) {
+	ch <- prometheus.MustNewConstMetric(
+		c.connectionsTotalDesc,
+		prometheus.CounterValue,
+		float64(info.Stats.Connections),
+		info.labelValues()...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.bytesInTotalDesc,
+		prometheus.CounterValue,
+		float64(info.Stats.BytesIn),
+		info.labelValues()...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.bytesOutTotalDesc,
+		prometheus.CounterValue,
+		float64(info.Stats.BytesOut),
+		info.labelValues()...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.packetsInTotalDesc,
+		prometheus.CounterValue,
+		float64(info.Stats.PacketsIn),
+		info.labelValues()...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.packetsOutTotalDesc,
+		prometheus.CounterValue,
+		float64(info.Stats.PacketsOut),
+		info.labelValues()...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.connectionsRateDesc,
+		prometheus.GaugeValue,
+		float64(info.Stats.CPS),
+		info.labelValues()...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.packetsInRateDesc,
+		prometheus.GaugeValue,
+		float64(info.Stats.PPSIn),
+		info.labelValues()...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.packetsOutRateDesc,
+		prometheus.GaugeValue,
+		float64(info.Stats.PPSOut),
+		info.labelValues()...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.bytesInRateDesc,
+		prometheus.GaugeValue,
+		float64(info.Stats.BPSIn),
+		info.labelValues()...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.bytesOutRateDesc,
+		prometheus.GaugeValue,
+		float64(info.Stats.BPSOut),
+		info.labelValues()...,
+	)
+}
+
+// collectDestinationDetails sends the stats (counters and rates),
+// thresholds and persistent connections of a destination to the
+// supplied channel.
+//
+// These are only available when the source is detailed.
+func (c *Collector) collectDestinationDetails(
+	ch chan<- prometheus.Metric, info *ServiceInfo, destination *libipvs.Destination,
+) {
+	ch <- prometheus.MustNewConstMetric(
+		c.destPersistConnsDesc,
+		prometheus.GaugeValue,
+		float64(destination.PersistConns),
+		info.destinationLabelValues(destination)...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.destUpperThresholdDesc,
+		prometheus.GaugeValue,
+		float64(destination.UThresh),
+		info.destinationLabelValues(destination)...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.destLowerThresholdDesc,
+		prometheus.GaugeValue,
+		float64(destination.LThresh),
+		info.destinationLabelValues(destination)...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.destBytesInDesc,
+		prometheus.CounterValue,
+		float64(destination.Stats.BytesIn),
+		info.destinationLabelValues(destination)...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.destBytesOutDesc,
+		prometheus.CounterValue,
+		float64(destination.Stats.BytesOut),
+		info.destinationLabelValues(destination)...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.destPacketsInDesc,
+		prometheus.CounterValue,
+		float64(destination.Stats.PacketsIn),
+		info.destinationLabelValues(destination)...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.destPacketsOutDesc,
+		prometheus.CounterValue,
+		float64(destination.Stats.PacketsOut),
+		info.destinationLabelValues(destination)...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.destConnectionsTotalDesc,
+		prometheus.CounterValue,
+		float64(destination.Stats.Connections),
+		info.destinationLabelValues(destination)...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.destConnectionsRateDesc,
+		prometheus.GaugeValue,
+		float64(destination.Stats.CPS),
+		info.destinationLabelValues(destination)...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.destPacketsInRateDesc,
+		prometheus.GaugeValue,
+		float64(destination.Stats.PPSIn),
+		info.destinationLabelValues(destination)...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.destPacketsOutRateDesc,
+		prometheus.GaugeValue,
+		float64(destination.Stats.PPSOut),
+		info.destinationLabelValues(destination)...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.destBytesInRateDesc,
+		prometheus.GaugeValue,
+		float64(destination.Stats.BPSIn),
+		info.destinationLabelValues(destination)...,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.destBytesOutRateDesc,
+		prometheus.GaugeValue,
+		float64(destination.Stats.BPSOut),
+		info.destinationLabelValues(destination)...,
+	)
 }
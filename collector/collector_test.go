@@ -1,19 +1,34 @@
 package collector
 
 import (
+	"io"
+	"net"
 	"os/exec"
+	"regexp"
+	"runtime"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/cirocosta/ingress_ipvs_exporter/mapper"
+	"github.com/mqliang/libipvs"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netns"
+
+	dto "github.com/prometheus/client_model/go"
 )
 
 const (
-	emptyNamespace = "empty-ns"
-	ipvsNamespace  = "ipvs-ns"
+	emptyNamespace   = "empty-ns"
+	ipvsNamespace    = "ipvs-ns"
+	trafficNamespace = "traffic-ns"
 )
 
+var fqNameRegex = regexp.MustCompile(`fqName: "([^"]+)"`)
+
 func createNamespace(namespace string) (err error) {
 	var (
 		createNetworkNamespaceCommand = exec.Command(
@@ -65,6 +80,159 @@ func setupIPVSInNamespace(namespace string) (err error) {
 	return
 }
 
+// setupFWMarkIPVSInNamespace creates a fwmark-based virtual
+// server in the namespace that mimics what docker swarm does
+// for the ingress network: packets destined to the port are
+// marked in the mangle table and ipvs balances the mark to a
+// real server that listens in the namespace itself.
+//
+// The OUTPUT rule is what actually marks the packets sent
+// from within the namespace while the PREROUTING one is the
+// one inspected by `mapper`.
+func setupFWMarkIPVSInNamespace(namespace, fwmark, port string) (err error) {
+	var commands = [][]string{
+		{"iptables", "-t", "mangle", "-A", "PREROUTING",
+			"-p", "tcp", "--dport", port,
+			"-j", "MARK", "--set-mark", fwmark},
+		{"iptables", "-t", "mangle", "-A", "OUTPUT",
+			"-p", "tcp", "--dport", port,
+			"-j", "MARK", "--set-mark", fwmark},
+		{"ipvsadm", "-A", "-f", fwmark, "-s", "rr"},
+		{"ipvsadm", "-a", "-f", fwmark, "-r", "127.0.0.1:" + port, "-m"},
+	}
+
+	for _, command := range commands {
+		err = exec.Command("ip", append(
+			[]string{"netns", "exec", namespace}, command...)...).Run()
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// setupFWMark6IPVSInNamespace is the IPv6 counterpart of
+// setupFWMarkIPVSInNamespace.
+func setupFWMark6IPVSInNamespace(namespace, fwmark, port string) (err error) {
+	var commands = [][]string{
+		{"ip6tables", "-t", "mangle", "-A", "PREROUTING",
+			"-p", "tcp", "--dport", port,
+			"-j", "MARK", "--set-mark", fwmark},
+		{"ip6tables", "-t", "mangle", "-A", "OUTPUT",
+			"-p", "tcp", "--dport", port,
+			"-j", "MARK", "--set-mark", fwmark},
+		{"ipvsadm", "-A", "-f", fwmark, "-6", "-s", "rr"},
+		{"ipvsadm", "-a", "-f", fwmark, "-6", "-r", "[::1]:" + port, "-m"},
+	}
+
+	for _, command := range commands {
+		err = exec.Command("ip", append(
+			[]string{"netns", "exec", namespace}, command...)...).Run()
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// sendTrafficInNamespace starts an echo server at `address` in
+// the given namespace and then sends `payload` to it, waiting
+// for the echo to come back so that both directions are
+// accounted by ipvs.
+func sendTrafficInNamespace(namespace, address string, payload []byte) (err error) {
+	var (
+		originalNs netns.NsHandle
+		targetNs   netns.NsHandle
+		listener   net.Listener
+		conn       net.Conn
+	)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	originalNs, err = netns.Get()
+	if err != nil {
+		return
+	}
+	defer originalNs.Close()
+
+	targetNs, err = netns.GetFromName(namespace)
+	if err != nil {
+		return
+	}
+	defer targetNs.Close()
+
+	err = netns.Set(targetNs)
+	if err != nil {
+		return
+	}
+	defer netns.Set(originalNs)
+
+	listener, err = net.Listen("tcp", address)
+	if err != nil {
+		return
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		io.Copy(conn, conn)
+	}()
+
+	conn, err = net.Dial("tcp", address)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(payload)
+	if err != nil {
+		return
+	}
+
+	_, err = io.ReadFull(conn, make([]byte, len(payload)))
+	return
+}
+
+// collectMetrics gathers all the metrics that a collector
+// reports, indexing them by their fully-qualified name.
+func collectMetrics(t *testing.T, collector *Collector) (metrics map[string][]*dto.Metric) {
+	var metricsChan = make(chan prometheus.Metric, 1024)
+
+	collector.Collect(metricsChan)
+	close(metricsChan)
+
+	metrics = map[string][]*dto.Metric{}
+	for metric := range metricsChan {
+		matches := fqNameRegex.FindStringSubmatch(metric.Desc().String())
+		require.Len(t, matches, 2)
+
+		m := &dto.Metric{}
+		require.NoError(t, metric.Write(m))
+
+		metrics[matches[1]] = append(metrics[matches[1]], m)
+	}
+
+	return
+}
+
+// metricLabels indexes the labels of a metric by their names.
+func metricLabels(metric *dto.Metric) (labels map[string]string) {
+	labels = map[string]string{}
+	for _, label := range metric.GetLabel() {
+		labels[label.GetName()] = label.GetValue()
+	}
+
+	return
+}
+
 func TestCollectorNew(t *testing.T) {
 	var (
 		testCases = []struct {
@@ -116,22 +284,22 @@ func TestCollectorNew(t *testing.T) {
 func TestCollectorGetStats(t *testing.T) {
 	var (
 		testCases = []struct {
-			desc            string
-			namespace       string
-			numberOfMetrics int
+			desc             string
+			namespace        string
+			numberOfServices int
 		}{
 			{
-				desc:            "empty stats in brand new ns",
-				namespace:       "/var/run/netns/" + emptyNamespace,
-				numberOfMetrics: 0,
+				desc:             "empty stats in brand new ns",
+				namespace:        "/var/run/netns/" + emptyNamespace,
+				numberOfServices: 0,
 			},
 			{
-				desc:            "zero-ed single stat if single service created",
-				namespace:       "/var/run/netns/" + ipvsNamespace,
-				numberOfMetrics: 1,
+				desc:             "zero-ed single stat if single service created",
+				namespace:        "/var/run/netns/" + ipvsNamespace,
+				numberOfServices: 1,
 			},
 		}
-		metricsChan chan prometheus.Metric
+		metrics map[string][]*dto.Metric
 	)
 
 	createNamespace(emptyNamespace)
@@ -150,9 +318,415 @@ func TestCollectorGetStats(t *testing.T) {
 			require.NoError(t, err)
 			require.NotNil(t, collector)
 
-			metricsChan = make(chan prometheus.Metric, tc.numberOfMetrics+1)
-			collector.Collect(metricsChan)
-			assert.Len(t, metricsChan, tc.numberOfMetrics)
+			metrics = collectMetrics(t, &collector)
+			require.Len(t, metrics["ipvs_services_total"], 1)
+			assert.Equal(t, float64(tc.numberOfServices),
+				metrics["ipvs_services_total"][0].GetGauge().GetValue())
+			assert.Len(t, metrics["ipvs_connections_total"], tc.numberOfServices)
+		})
+	}
+}
+
+func TestCollectorNonFWMarkServices(t *testing.T) {
+	var metrics map[string][]*dto.Metric
+
+	createNamespace(ipvsNamespace)
+	setupIPVSInNamespace(ipvsNamespace)
+	defer func() {
+		deleteNamespace(ipvsNamespace)
+	}()
+
+	collector, err := NewCollector(CollectorConfig{
+		NamespacePath: "/var/run/netns/" + ipvsNamespace,
+	})
+	require.NoError(t, err)
+
+	metrics = collectMetrics(t, &collector)
+
+	require.Len(t, metrics["ipvs_connections_total"], 1)
+	labels := metricLabels(metrics["ipvs_connections_total"][0])
+	assert.Equal(t, "", labels["fwmark"])
+	assert.Equal(t, "tcp", labels["protocol"])
+	assert.Equal(t, "127.0.0.1", labels["address"])
+	assert.Equal(t, "80", labels["port"])
+
+	require.Len(t, metrics["ipvs_destination_connections_total"], 1)
+	labels = metricLabels(metrics["ipvs_destination_connections_total"][0])
+	assert.Equal(t, "127.0.0.1", labels["virtual_address"])
+	assert.Equal(t, "127.0.0.2", labels["address"])
+}
+
+func TestCollectorPacketCounters(t *testing.T) {
+	var (
+		payload = make([]byte, 4096)
+		metrics map[string][]*dto.Metric
+	)
+
+	createNamespace(trafficNamespace)
+	defer func() {
+		deleteNamespace(trafficNamespace)
+	}()
+
+	require.NoError(t, setupFWMarkIPVSInNamespace(trafficNamespace, "260", "80"))
+
+	collector, err := NewCollector(CollectorConfig{
+		NamespacePath: "/var/run/netns/" + trafficNamespace,
+	})
+	require.NoError(t, err)
+
+	metrics = collectMetrics(t, &collector)
+	for _, name := range []string{
+		"ipvs_packets_in_total",
+		"ipvs_packets_out_total",
+		"ipvs_destination_packets_in_total",
+		"ipvs_destination_packets_out_total",
+	} {
+		require.Len(t, metrics[name], 1, name)
+		assert.Zero(t, metrics[name][0].GetCounter().GetValue(), name)
+	}
+
+	require.NoError(t, sendTrafficInNamespace(
+		trafficNamespace, "127.0.0.1:80", payload))
+
+	metrics = collectMetrics(t, &collector)
+	for _, name := range []string{
+		"ipvs_packets_in_total",
+		"ipvs_packets_out_total",
+		"ipvs_destination_packets_in_total",
+		"ipvs_destination_packets_out_total",
+	} {
+		require.Len(t, metrics[name], 1, name)
+		assert.NotZero(t, metrics[name][0].GetCounter().GetValue(), name)
+	}
+
+	assert.Equal(t,
+		metrics["ipvs_packets_in_total"][0].GetCounter().GetValue(),
+		metrics["ipvs_destination_packets_in_total"][0].GetCounter().GetValue())
+}
+
+func TestCollectorRateEstimators(t *testing.T) {
+	var (
+		payload = make([]byte, 64*1024)
+		metrics map[string][]*dto.Metric
+	)
+
+	createNamespace(trafficNamespace)
+	defer func() {
+		deleteNamespace(trafficNamespace)
+	}()
+
+	require.NoError(t, setupFWMarkIPVSInNamespace(trafficNamespace, "260", "80"))
+
+	collector, err := NewCollector(CollectorConfig{
+		NamespacePath: "/var/run/netns/" + trafficNamespace,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, sendTrafficInNamespace(
+		trafficNamespace, "127.0.0.1:80", payload))
+
+	// the kernel estimator runs every two seconds
+	time.Sleep(3 * time.Second)
+
+	metrics = collectMetrics(t, &collector)
+	for _, name := range []string{
+		"ipvs_connections_per_second",
+		"ipvs_packets_in_per_second",
+		"ipvs_packets_out_per_second",
+		"ipvs_bytes_in_per_second",
+		"ipvs_bytes_out_per_second",
+		"ipvs_destination_connections_per_second",
+		"ipvs_destination_packets_in_per_second",
+		"ipvs_destination_packets_out_per_second",
+		"ipvs_destination_bytes_in_per_second",
+		"ipvs_destination_bytes_out_per_second",
+	} {
+		require.Len(t, metrics[name], 1, name)
+		require.NotNil(t, metrics[name][0].GetGauge(), name)
+	}
+
+	assert.NotZero(t, metrics["ipvs_bytes_in_per_second"][0].GetGauge().GetValue())
+	assert.NotZero(t, metrics["ipvs_destination_bytes_in_per_second"][0].GetGauge().GetValue())
+}
+
+func TestCollectorServiceInfo(t *testing.T) {
+	var metrics map[string][]*dto.Metric
+
+	createNamespace(trafficNamespace)
+	defer func() {
+		deleteNamespace(trafficNamespace)
+	}()
+
+	require.NoError(t, setupFWMarkIPVSInNamespace(trafficNamespace, "260", "80"))
+	require.NoError(t, exec.Command(
+		"ip", "netns", "exec", trafficNamespace,
+		"ipvsadm", "-E", "-f", "260",
+		"-s", "wlc",
+		"-p", "300",
+		"-M", "255.255.255.0").Run())
+
+	collector, err := NewCollector(CollectorConfig{
+		NamespacePath: "/var/run/netns/" + trafficNamespace,
+	})
+	require.NoError(t, err)
+
+	metrics = collectMetrics(t, &collector)
+
+	require.Len(t, metrics["ipvs_service_info"], 1)
+	labels := metricLabels(metrics["ipvs_service_info"][0])
+	assert.Equal(t, "260", labels["fwmark"])
+	assert.Equal(t, "tcp", labels["protocol"])
+	assert.Equal(t, "80", labels["port"])
+	assert.Equal(t, "wlc", labels["scheduler"])
+	assert.Contains(t, labels["flags"], "persistent")
+	assert.Equal(t, "300", labels["timeout"])
+	assert.Equal(t, "255.255.255.0", labels["netmask"])
+
+	require.Len(t, metrics["ipvs_service_persistence_timeout_seconds"], 1)
+	assert.Equal(t, float64(300),
+		metrics["ipvs_service_persistence_timeout_seconds"][0].GetGauge().GetValue())
+}
+
+func TestCollectorDestinationConfiguration(t *testing.T) {
+	var metrics map[string][]*dto.Metric
+
+	createNamespace(trafficNamespace)
+	defer func() {
+		deleteNamespace(trafficNamespace)
+	}()
+
+	require.NoError(t, setupFWMarkIPVSInNamespace(trafficNamespace, "260", "80"))
+	require.NoError(t, exec.Command(
+		"ip", "netns", "exec", trafficNamespace,
+		"ipvsadm", "-e", "-f", "260",
+		"-r", "127.0.0.1:80", "-m",
+		"-w", "0",
+		"-x", "100",
+		"-y", "10").Run())
+
+	collector, err := NewCollector(CollectorConfig{
+		NamespacePath: "/var/run/netns/" + trafficNamespace,
+	})
+	require.NoError(t, err)
+
+	metrics = collectMetrics(t, &collector)
+
+	require.Len(t, metrics["ipvs_destination_info"], 1)
+	labels := metricLabels(metrics["ipvs_destination_info"][0])
+	assert.Equal(t, "127.0.0.1", labels["address"])
+	assert.Equal(t, "masq", labels["forwarding_method"])
+
+	for name, expected := range map[string]float64{
+		"ipvs_destination_weight":                      0,
+		"ipvs_destination_persistent_connections":      0,
+		"ipvs_destination_upper_threshold_connections": 100,
+		"ipvs_destination_lower_threshold_connections": 10,
+	} {
+		require.Len(t, metrics[name], 1, name)
+		assert.Equal(t, expected, metrics[name][0].GetGauge().GetValue(), name)
+	}
+}
+
+func TestCollectorPartialFailures(t *testing.T) {
+	var (
+		healthy = &libipvs.Service{
+			Protocol: syscall.IPPROTO_TCP,
+			Address:  net.ParseIP("10.0.0.1"),
+			Port:     80,
+		}
+		broken = &libipvs.Service{
+			Protocol: syscall.IPPROTO_TCP,
+			Address:  net.ParseIP("10.0.0.2"),
+			Port:     80,
+		}
+		marked = &libipvs.Service{
+			AddressFamily: syscall.AF_INET,
+			FWMark:        260,
+		}
+		testCases = []struct {
+			desc             string
+			handle           *fakeIPVSHandle
+			mappingsErr      error
+			up               float64
+			numberOfServices int
+			errors           map[string]float64
+		}{
+			{
+				desc:             "no services",
+				handle:           &fakeIPVSHandle{},
+				up:               1,
+				numberOfServices: 0,
+				errors:           map[string]float64{},
+			},
+			{
+				desc: "failing to list services",
+				handle: &fakeIPVSHandle{
+					servicesErr: errors.New("netlink failure"),
+				},
+				up:               0,
+				numberOfServices: -1,
+				errors:           map[string]float64{"services": 1},
+			},
+			{
+				desc: "failing to list destinations of a single service",
+				handle: &fakeIPVSHandle{
+					services: []*libipvs.Service{healthy, broken},
+					destinations: map[*libipvs.Service][]*libipvs.Destination{
+						healthy: {{Address: net.ParseIP("10.255.0.5")}},
+					},
+					destinationsErr: map[*libipvs.Service]error{
+						broken: errors.New("netlink failure"),
+					},
+				},
+				up:               1,
+				numberOfServices: 1,
+				errors:           map[string]float64{"destinations": 1},
+			},
+			{
+				desc: "failing to retrieve the fwmark mappings",
+				handle: &fakeIPVSHandle{
+					services: []*libipvs.Service{healthy, marked},
+					destinations: map[*libipvs.Service][]*libipvs.Destination{
+						healthy: {{Address: net.ParseIP("10.255.0.5")}},
+						marked:  {{Address: net.ParseIP("10.255.0.6")}},
+					},
+				},
+				mappingsErr:      mapper.ErrChainNotFound,
+				up:               1,
+				numberOfServices: 1,
+				errors:           map[string]float64{"mappings": 1},
+			},
+		}
+	)
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			collector := newFakeCollector(tc.handle, CollectorConfig{})
+			collector.getMappings = func() (map[mapper.Family]map[uint32][]mapper.Mapping, error) {
+				return nil, tc.mappingsErr
+			}
+
+			metrics := collectMetrics(t, &collector)
+
+			require.Len(t, metrics["ipvs_up"], 1)
+			assert.Equal(t, tc.up, metrics["ipvs_up"][0].GetGauge().GetValue())
+			assert.Len(t, metrics["ipvs_scrape_duration_seconds"], 1)
+
+			require.Len(t, metrics["ipvs_scrape_errors_total"], 3)
+			for _, metric := range metrics["ipvs_scrape_errors_total"] {
+				stage := metricLabels(metric)["stage"]
+				assert.Equal(t, tc.errors[stage],
+					metric.GetCounter().GetValue(), stage)
+			}
+
+			if tc.numberOfServices < 0 {
+				assert.Empty(t, metrics["ipvs_services_total"])
+				return
+			}
+
+			require.Len(t, metrics["ipvs_services_total"], 1)
+			assert.Equal(t, float64(tc.numberOfServices),
+				metrics["ipvs_services_total"][0].GetGauge().GetValue())
+			assert.Len(t, metrics["ipvs_destination_connections_total"], tc.numberOfServices)
+		})
+	}
+}
+
+func TestCollectorSkipMappings(t *testing.T) {
+	var (
+		service = &libipvs.Service{
+			AddressFamily: syscall.AF_INET,
+			FWMark:        260,
+		}
+		handle = &fakeIPVSHandle{
+			services: []*libipvs.Service{service},
+			destinations: map[*libipvs.Service][]*libipvs.Destination{
+				service: {{Address: net.ParseIP("10.244.0.5")}},
+			},
+		}
+		collector = newFakeCollector(handle, CollectorConfig{
+			SkipMappings: true,
 		})
+	)
+
+	metrics := collectMetrics(t, &collector)
+
+	require.Len(t, metrics["ipvs_services_total"], 1)
+	assert.Equal(t, float64(1), metrics["ipvs_services_total"][0].GetGauge().GetValue())
+
+	require.Len(t, metrics["ipvs_destination_weight"], 1)
+	labels := metricLabels(metrics["ipvs_destination_weight"][0])
+	assert.Equal(t, "260", labels["fwmark"])
+	assert.Equal(t, "0", labels["port"])
+
+	for _, metric := range metrics["ipvs_scrape_errors_total"] {
+		assert.Equal(t, float64(0), metric.GetCounter().GetValue())
+	}
+}
+
+func TestCollectorUndetailedSource(t *testing.T) {
+	var (
+		service = &libipvs.Service{
+			AddressFamily: syscall.AF_INET,
+			Protocol:      syscall.IPPROTO_TCP,
+			Address:       net.ParseIP("10.0.0.10"),
+			Port:          80,
+			SchedName:     "rr",
+			Flags:         libipvs.Flags{Flags: libipvs.IP_VS_SVC_F_PERSISTENT},
+		}
+		handle = &fakeIPVSHandle{
+			services:   []*libipvs.Service{service},
+			undetailed: true,
+		}
+		collector = newFakeCollector(handle, CollectorConfig{})
+	)
+
+	metrics := collectMetrics(t, &collector)
+
+	require.Len(t, metrics["ipvs_service_info"], 1)
+	labels := metricLabels(metrics["ipvs_service_info"][0])
+	assert.Contains(t, labels["flags"], "persistent")
+	assert.Equal(t, "", labels["timeout"])
+
+	assert.Empty(t, metrics["ipvs_service_persistence_timeout_seconds"])
+	assert.Empty(t, metrics["ipvs_bytes_in_total"])
+}
+
+func TestCollectorIPv6FWMarkServices(t *testing.T) {
+	var metrics map[string][]*dto.Metric
+
+	createNamespace(trafficNamespace)
+	defer func() {
+		deleteNamespace(trafficNamespace)
+	}()
+
+	require.NoError(t, setupFWMarkIPVSInNamespace(trafficNamespace, "260", "80"))
+	require.NoError(t, setupFWMark6IPVSInNamespace(trafficNamespace, "260", "8080"))
+
+	collector, err := NewCollector(CollectorConfig{
+		NamespacePath: "/var/run/netns/" + trafficNamespace,
+	})
+	require.NoError(t, err)
+
+	metrics = collectMetrics(t, &collector)
+
+	require.Len(t, metrics["ipvs_connections_total"], 2)
+	ports := map[string]string{}
+	for _, metric := range metrics["ipvs_connections_total"] {
+		labels := metricLabels(metric)
+		assert.Equal(t, "260", labels["fwmark"])
+		ports[labels["family"]] = labels["port"]
+	}
+	assert.Equal(t, map[string]string{
+		"inet":  "80",
+		"inet6": "8080",
+	}, ports)
+
+	require.Len(t, metrics["ipvs_destination_connections_total"], 2)
+	for _, metric := range metrics["ipvs_destination_connections_total"] {
+		labels := metricLabels(metric)
+		if labels["family"] == "inet6" {
+			assert.Equal(t, "::1", labels["address"])
+		}
 	}
 }
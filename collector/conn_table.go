@@ -0,0 +1,330 @@
+package collector
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mqliang/libipvs"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// connTablePath is the path to the ipvs connection table
+// of the network namespace of the calling thread.
+//
+// `/proc/net` can't be used given that it refers to the
+// network namespace of the main thread (see RunInNetns).
+const connTablePath = "/proc/thread-self/net/ip_vs_conn"
+
+// connExpiryBuckets are the buckets of the histogram of
+// the time left until connection entries expire.
+//
+// The largest one matches the default timeout of
+// established TCP connections (15m).
+var connExpiryBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 900}
+
+// Connection represents an entry of the ipvs connection
+// table (`/proc/net/ip_vs_conn`).
+type Connection struct {
+	// Family is the address family of the connection
+	// (syscall.AF_INET or syscall.AF_INET6).
+	Family uint16
+
+	// Protocol is the protocol of the connection as
+	// reported by the kernel (e.g., TCP, UDP, SCTP or IP
+	// for persistence templates).
+	Protocol string
+
+	ClientAddress      net.IP
+	ClientPort         uint16
+	VirtualAddress     net.IP
+	VirtualPort        uint16
+	DestinationAddress net.IP
+	DestinationPort    uint16
+
+	// State is the state of the connection as reported by
+	// the kernel (e.g., ESTABLISHED, SYN_RECV, TIME_WAIT).
+	State string
+
+	// Expires is the number of seconds left until the
+	// connection entry expires.
+	Expires uint64
+}
+
+// ReadConnTable reads the ipvs connection table of the network
+// namespace that the calling thread is in.
+func ReadConnTable() (conns []*Connection, err error) {
+	file, err := os.Open(connTablePath)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"failed to open connection table %s",
+			connTablePath)
+		return
+	}
+	defer file.Close()
+
+	conns, err = parseConnTable(file)
+	return
+}
+
+// parseConnTable parses the contents of `/proc/net/ip_vs_conn`.
+//
+// Each line (after the header) looks like the following:
+//
+//	Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Expires PEName PEData
+//	TCP 0A000001 8A2E 0A00000A 7530 0AFF0005 0050 ESTABLISHED     899
+//
+// where IPv4 addresses are in hexadecimal and IPv6 addresses
+// are in their full (non-compressed) form.
+func parseConnTable(r io.Reader) (conns []*Connection, err error) {
+	var (
+		scanner = bufio.NewScanner(r)
+		line    int
+	)
+
+	for scanner.Scan() {
+		line++
+		if line == 1 {
+			continue
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		var conn *Connection
+		conn, err = parseConnection(fields)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"malformed connection table entry at line %d",
+				line)
+			return
+		}
+
+		conns = append(conns, conn)
+	}
+
+	err = scanner.Err()
+	return
+}
+
+// parseConnection parses the fields of a connection table entry.
+func parseConnection(fields []string) (conn *Connection, err error) {
+	if len(fields) < 9 {
+		err = errors.Errorf("expected at least 9 fields, got %d",
+			len(fields))
+		return
+	}
+
+	conn = &Connection{
+		Protocol: fields[0],
+		State:    fields[7],
+	}
+
+	addresses := []*net.IP{
+		&conn.ClientAddress, &conn.VirtualAddress, &conn.DestinationAddress,
+	}
+	ports := []*uint16{
+		&conn.ClientPort, &conn.VirtualPort, &conn.DestinationPort,
+	}
+
+	for i := 0; i < 3; i++ {
+		*addresses[i], err = parseConnAddress(fields[1+2*i])
+		if err != nil {
+			return
+		}
+
+		var port uint64
+		port, err = strconv.ParseUint(fields[2+2*i], 16, 16)
+		if err != nil {
+			err = errors.Wrapf(err, "invalid port %s", fields[2+2*i])
+			return
+		}
+
+		*ports[i] = uint16(port)
+	}
+
+	conn.Family = syscall.AF_INET
+	if conn.ClientAddress.To4() == nil {
+		conn.Family = syscall.AF_INET6
+	}
+
+	conn.Expires, err = strconv.ParseUint(fields[8], 10, 64)
+	if err != nil {
+		err = errors.Wrapf(err, "invalid expiration %s", fields[8])
+		return
+	}
+
+	return
+}
+
+// parseConnAddress parses either a hex-encoded IPv4 address
+// or a full IPv6 address.
+func parseConnAddress(field string) (ip net.IP, err error) {
+	if strings.Contains(field, ":") {
+		ip = net.ParseIP(field)
+		if ip == nil {
+			err = errors.Errorf("invalid ipv6 address %s", field)
+		}
+		return
+	}
+
+	b, err := hex.DecodeString(field)
+	if err != nil || len(b) != net.IPv4len {
+		err = errors.Errorf("invalid ipv4 address %s", field)
+		return
+	}
+
+	ip = net.IP(b)
+	return
+}
+
+// connTableStats aggregates the connection table entries
+// that belong to a given service.
+type connTableStats struct {
+	// states counts the connections to the service
+	// by their state.
+	states map[string]uint64
+
+	// destinations counts the connections to each
+	// destination of the service by their state.
+	destinations map[*libipvs.Destination]map[string]uint64
+
+	// expiries holds the time left (in seconds) for each
+	// connection to the service to expire.
+	expiries []uint64
+}
+
+// aggregateConnTable assigns each connection to the service
+// (and destination) that it belongs to.
+//
+// Connections to fwmark-based services are matched by the
+// protocol, virtual address and virtual port that iptables
+// marks (see marksConnection) while the rest are matched by
+// protocol, virtual address and virtual port.
+//
+// Entries that can't be matched (e.g., persistence templates
+// of fwmark-based services) are not accounted.
+func aggregateConnTable(infos []*ServiceInfo, conns []*Connection) (res map[*ServiceInfo]*connTableStats) {
+	var (
+		services     = map[string]*ServiceInfo{}
+		fwmarks      []*ServiceInfo
+		destinations = map[*ServiceInfo]map[string]*libipvs.Destination{}
+	)
+
+	for _, info := range infos {
+		if info.FWMark != 0 {
+			fwmarks = append(fwmarks, info)
+		} else {
+			services[fmt.Sprintf("%d|%s|%s|%d",
+				info.AddressFamily, info.Protocol,
+				info.Address, info.Port)] = info
+		}
+
+		destinations[info] = map[string]*libipvs.Destination{}
+		for _, destination := range info.destinationServers {
+			destinations[info][destination.Address.String()] = destination
+		}
+		for _, destination := range info.overflow {
+			destinations[info][destination.Address.String()] = info.overflowDestination
+		}
+	}
+
+	res = map[*ServiceInfo]*connTableStats{}
+	for _, conn := range conns {
+		protocol := strings.ToLower(conn.Protocol)
+
+		info, ok := services[fmt.Sprintf("%d|%s|%s|%d",
+			conn.Family, protocol, conn.VirtualAddress, conn.VirtualPort)]
+		for i := 0; !ok && i < len(fwmarks); i++ {
+			info = fwmarks[i]
+			ok = uint16(info.AddressFamily) == conn.Family &&
+				info.marksConnection(protocol, conn.VirtualAddress, conn.VirtualPort)
+		}
+		if !ok {
+			continue
+		}
+
+		stats, ok := res[info]
+		if !ok {
+			stats = &connTableStats{
+				states:       map[string]uint64{},
+				destinations: map[*libipvs.Destination]map[string]uint64{},
+			}
+			res[info] = stats
+		}
+
+		stats.states[conn.State]++
+		stats.expiries = append(stats.expiries, conn.Expires)
+
+		destination, ok := destinations[info][conn.DestinationAddress.String()]
+		if !ok {
+			continue
+		}
+
+		if stats.destinations[destination] == nil {
+			stats.destinations[destination] = map[string]uint64{}
+		}
+		stats.destinations[destination][conn.State]++
+	}
+
+	return
+}
+
+// collectConnTable sends the connection table metrics of each
+// service to the supplied channel.
+func (c *Collector) collectConnTable(
+	ch chan<- prometheus.Metric, infos []*ServiceInfo, conns []*Connection,
+) {
+	for info, stats := range aggregateConnTable(infos, conns) {
+		for state, count := range stats.states {
+			ch <- prometheus.MustNewConstMetric(
+				c.connectionsByStateDesc,
+				prometheus.GaugeValue,
+				float64(count),
+				info.labelValues(state)...,
+			)
+		}
+
+		for destination, states := range stats.destinations {
+			for state, count := range states {
+				ch <- prometheus.MustNewConstMetric(
+					c.destConnectionsByStateDesc,
+					prometheus.GaugeValue,
+					float64(count),
+					info.destinationLabelValues(destination, state)...,
+				)
+			}
+		}
+
+		var (
+			sum     float64
+			buckets = make(map[float64]uint64, len(connExpiryBuckets))
+		)
+
+		for _, expires := range stats.expiries {
+			sum += float64(expires)
+			for _, bucket := range connExpiryBuckets {
+				if float64(expires) <= bucket {
+					buckets[bucket]++
+				}
+			}
+		}
+
+		ch <- prometheus.MustNewConstHistogram(
+			c.connectionExpiryDesc,
+			uint64(len(stats.expiries)),
+			sum,
+			buckets,
+			info.labelValues()...,
+		)
+	}
+}
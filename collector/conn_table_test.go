@@ -0,0 +1,170 @@
+package collector
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/cirocosta/ingress_ipvs_exporter/mapper"
+	"github.com/mqliang/libipvs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const connTable = `Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Expires PEName PEData
+TCP 0A000001 8A2E 0A00000A 7530 0AFF0005 0050 ESTABLISHED     899
+TCP 0A000002 8A30 0A00000A 7530 0AFF0006 0050 TIME_WAIT         2
+TCP 0A000003 8A32 0A00000A 7530 0AFF0005 0050 ESTABLISHED     300
+UDP 0A000004 D431 0A000014 0035 0AFF0007 0035 UDP             250
+IP  0A000005 0000 00000104 0000 0AFF0005 0000 NONE            100
+TCP fd00:0000:0000:0000:0000:0000:0000:0001 8A2E fd00:0000:0000:0000:0000:0000:0000:000a 7530 fd00:0000:0000:0000:0000:0000:0000:0005 0050 SYN_RECV         30
+`
+
+func TestParseConnTable(t *testing.T) {
+	conns, err := parseConnTable(strings.NewReader(connTable))
+	require.NoError(t, err)
+	require.Len(t, conns, 6)
+
+	assert.Equal(t, &Connection{
+		Family:             syscall.AF_INET,
+		Protocol:           "TCP",
+		ClientAddress:      net.IPv4(10, 0, 0, 1).To4(),
+		ClientPort:         0x8A2E,
+		VirtualAddress:     net.IPv4(10, 0, 0, 10).To4(),
+		VirtualPort:        30000,
+		DestinationAddress: net.IPv4(10, 255, 0, 5).To4(),
+		DestinationPort:    80,
+		State:              "ESTABLISHED",
+		Expires:            899,
+	}, conns[0])
+
+	assert.Equal(t, "IP", conns[4].Protocol)
+	assert.Equal(t, "NONE", conns[4].State)
+
+	assert.Equal(t, uint16(syscall.AF_INET6), conns[5].Family)
+	assert.Equal(t, "fd00::a", conns[5].VirtualAddress.String())
+	assert.Equal(t, "SYN_RECV", conns[5].State)
+}
+
+func TestParseConnTableMalformed(t *testing.T) {
+	var testCases = []struct {
+		desc  string
+		entry string
+	}{
+		{
+			desc:  "missing fields",
+			entry: "TCP 0A000001 8A2E 0A00000A 7530",
+		},
+		{
+			desc:  "invalid address",
+			entry: "TCP 0A0000 8A2E 0A00000A 7530 0AFF0005 0050 ESTABLISHED 899",
+		},
+		{
+			desc:  "invalid port",
+			entry: "TCP 0A000001 XXXX 0A00000A 7530 0AFF0005 0050 ESTABLISHED 899",
+		},
+		{
+			desc:  "invalid expiration",
+			entry: "TCP 0A000001 8A2E 0A00000A 7530 0AFF0005 0050 ESTABLISHED -1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := parseConnTable(strings.NewReader(
+				"Pro FromIP FPrt ToIP TPrt DestIP DPrt State Expires\n" +
+					tc.entry + "\n"))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestAggregateConnTable(t *testing.T) {
+	var (
+		dest5 = &libipvs.Destination{Address: net.IPv4(10, 255, 0, 5).To4()}
+		dest6 = &libipvs.Destination{Address: net.IPv4(10, 255, 0, 6).To4()}
+		dest7 = &libipvs.Destination{Address: net.IPv4(10, 255, 0, 7).To4()}
+
+		ingress = &ServiceInfo{
+			Service: &libipvs.Service{
+				AddressFamily: syscall.AF_INET,
+				FWMark:        260,
+			},
+			destinationPort:    30000,
+			destinationServers: []*libipvs.Destination{dest5, dest6},
+		}
+		dns = &ServiceInfo{
+			Service: &libipvs.Service{
+				AddressFamily: syscall.AF_INET,
+				Protocol:      syscall.IPPROTO_UDP,
+				Address:       net.IPv4(10, 0, 0, 20).To4(),
+				Port:          53,
+			},
+			destinationServers: []*libipvs.Destination{dest7},
+		}
+	)
+
+	conns, err := parseConnTable(strings.NewReader(connTable))
+	require.NoError(t, err)
+
+	res := aggregateConnTable([]*ServiceInfo{ingress, dns}, conns)
+	require.Len(t, res, 2)
+
+	assert.Equal(t, map[string]uint64{
+		"ESTABLISHED": 2,
+		"TIME_WAIT":   1,
+	}, res[ingress].states)
+	assert.Equal(t, map[*libipvs.Destination]map[string]uint64{
+		dest5: {"ESTABLISHED": 2},
+		dest6: {"TIME_WAIT": 1},
+	}, res[ingress].destinations)
+	assert.ElementsMatch(t, []uint64{899, 2, 300}, res[ingress].expiries)
+
+	assert.Equal(t, map[string]uint64{"UDP": 1}, res[dns].states)
+	assert.Equal(t, map[*libipvs.Destination]map[string]uint64{
+		dest7: {"UDP": 1},
+	}, res[dns].destinations)
+}
+
+func TestAggregateConnTableWithoutPorts(t *testing.T) {
+	var (
+		dest5 = &libipvs.Destination{Address: net.IPv4(10, 255, 0, 5).To4()}
+		dest6 = &libipvs.Destination{Address: net.IPv4(10, 255, 0, 6).To4()}
+
+		// marked by the virtual IP alone, as in the `lb_*`
+		// namespaces of docker swarm
+		vip = &ServiceInfo{
+			Service: &libipvs.Service{
+				AddressFamily: syscall.AF_INET,
+				FWMark:        260,
+			},
+			mappings: []mapper.Mapping{
+				{Destination: net.IPv4(10, 0, 0, 10).To4()},
+			},
+			destinationServers: []*libipvs.Destination{dest5, dest6},
+		}
+		skipped = &ServiceInfo{
+			Service: &libipvs.Service{
+				AddressFamily: syscall.AF_INET,
+				FWMark:        261,
+			},
+		}
+	)
+
+	conns, err := parseConnTable(strings.NewReader(connTable))
+	require.NoError(t, err)
+
+	// neither the connections to other addresses nor the
+	// persistence template are accounted
+	res := aggregateConnTable([]*ServiceInfo{vip}, conns)
+	require.Len(t, res, 1)
+	assert.Equal(t, map[string]uint64{
+		"ESTABLISHED": 2,
+		"TIME_WAIT":   1,
+	}, res[vip].states)
+
+	// without mappings (nor destination port), not even the
+	// persistence templates are
+	assert.Empty(t, aggregateConnTable([]*ServiceInfo{skipped}, conns))
+}
@@ -0,0 +1,111 @@
+package collector
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/mqliang/libipvs"
+)
+
+// wrapCounter accumulates the values of a 32-bit counter
+// that might wrap between scrapes, making it monotonic.
+type wrapCounter struct {
+	last  uint32
+	total uint64
+}
+
+// update feeds the counter with the most recent raw value
+// read from the kernel, returning the accumulated total.
+//
+// Going backwards from the upper half of the 32-bit range is
+// considered a wrap. Anything else going backwards is a real
+// reset (e.g., the service got recreated), in which case
+// accumulation starts over.
+func (w *wrapCounter) update(raw uint32) uint64 {
+	switch {
+	case raw >= w.last:
+		w.total += uint64(raw - w.last)
+	case w.last >= 1<<31:
+		w.total += uint64(raw - w.last)
+	default:
+		w.total = uint64(raw)
+	}
+
+	w.last = raw
+	return w.total
+}
+
+// statsCounters holds the wrap-aware counters of the
+// stats of a single service or destination.
+type statsCounters struct {
+	connections wrapCounter
+	packetsIn   wrapCounter
+	packetsOut  wrapCounter
+}
+
+// update replaces the 32-bit counters in `stats` by their
+// accumulated values.
+func (s *statsCounters) update(stats *libipvs.Stats) {
+	stats.Connections = s.connections.update(uint32(stats.Connections))
+	stats.PacketsIn = s.packetsIn.update(uint32(stats.PacketsIn))
+	stats.PacketsOut = s.packetsOut.update(uint32(stats.PacketsOut))
+}
+
+// counters keeps track of the 32-bit counters of all the
+// services and destinations across scrapes so that kernels
+// that don't provide 64-bit stats (linux < 4.1) still have
+// monotonic counters exported.
+//
+// Stats that come from the 64-bit attributes are left
+// untouched.
+type counters struct {
+	sync.Mutex
+	stats map[string]*statsCounters
+}
+
+// newCounters instantiates an empty set of counters.
+func newCounters() *counters {
+	return &counters{
+		stats: map[string]*statsCounters{},
+	}
+}
+
+// update replaces the 32-bit counters of the services and
+// destinations in `infos` by their accumulated values.
+//
+// Counters of services and destinations that are not in
+// `infos` are forgotten.
+func (c *counters) update(infos []*ServiceInfo) {
+	var seen = map[string]*statsCounters{}
+
+	c.Lock()
+	defer c.Unlock()
+
+	get := func(key string) (s *statsCounters) {
+		s, ok := c.stats[key]
+		if !ok {
+			s = &statsCounters{}
+		}
+
+		seen[key] = s
+		return
+	}
+
+	for _, info := range infos {
+		if !info.Stats.Stats64 {
+			get(strings.Join(info.labelValues(), "|")).
+				update(&info.Stats)
+		}
+
+		for _, destination := range info.destinationServers {
+			if destination.Stats.Stats64 {
+				continue
+			}
+
+			get(strings.Join(info.destinationLabelValues(destination), "|")).
+				update(&destination.Stats)
+		}
+	}
+
+	c.stats = seen
+}
@@ -0,0 +1,109 @@
+package collector
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/mqliang/libipvs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrapCounter(t *testing.T) {
+	var testCases = []struct {
+		desc     string
+		values   []uint32
+		expected uint64
+	}{
+		{
+			desc:     "first value",
+			values:   []uint32{10},
+			expected: 10,
+		},
+		{
+			desc:     "increasing values",
+			values:   []uint32{10, 20, 20, 35},
+			expected: 35,
+		},
+		{
+			desc:     "wrap",
+			values:   []uint32{10, 0xFFFFFFF0, 5},
+			expected: 0xFFFFFFF0 + 0x10 + 5,
+		},
+		{
+			desc:     "multiple wraps",
+			values:   []uint32{0xFFFFFFF0, 5, 0xFFFFFFF0, 5},
+			expected: 2*(1<<32) + 5,
+		},
+		{
+			desc:     "reset",
+			values:   []uint32{10, 1000, 3},
+			expected: 3,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var (
+				counter wrapCounter
+				total   uint64
+			)
+
+			for _, value := range tc.values {
+				total = counter.update(value)
+			}
+
+			assert.Equal(t, tc.expected, total)
+		})
+	}
+}
+
+func TestCountersUpdate(t *testing.T) {
+	var (
+		counters = newCounters()
+		newInfos = func(connections, packets uint64, stats64 bool) []*ServiceInfo {
+			return []*ServiceInfo{
+				{
+					Service: &libipvs.Service{
+						AddressFamily: syscall.AF_INET,
+						FWMark:        260,
+						Stats: libipvs.Stats{
+							Connections: connections,
+							PacketsIn:   packets,
+							Stats64:     stats64,
+						},
+					},
+					destinationPort: 30000,
+					destinationServers: []*libipvs.Destination{
+						{
+							Address: net.ParseIP("10.255.0.5"),
+							Stats: libipvs.Stats{
+								Connections: connections,
+								PacketsIn:   packets,
+								Stats64:     stats64,
+							},
+						},
+					},
+				},
+			}
+		}
+		infos []*ServiceInfo
+	)
+
+	infos = newInfos(10, 0xFFFFFFFE, false)
+	counters.update(infos)
+	assert.Equal(t, uint64(10), infos[0].Stats.Connections)
+	assert.Equal(t, uint64(0xFFFFFFFE), infos[0].Stats.PacketsIn)
+
+	infos = newInfos(20, 2, false)
+	counters.update(infos)
+	assert.Equal(t, uint64(20), infos[0].Stats.Connections)
+	assert.Equal(t, uint64(1<<32+2), infos[0].Stats.PacketsIn)
+	assert.Equal(t, uint64(1<<32+2), infos[0].destinationServers[0].Stats.PacketsIn)
+
+	infos = newInfos(1<<40, 1<<40, true)
+	counters.update(infos)
+	assert.Equal(t, uint64(1<<40), infos[0].Stats.Connections)
+	assert.Equal(t, uint64(1<<40), infos[0].Stats.PacketsIn)
+	assert.Empty(t, counters.stats)
+}
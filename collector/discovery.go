@@ -0,0 +1,314 @@
+package collector
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// DefaultDiscoveryDirectory is where docker keeps the network
+// namespaces of the ingress sandbox and of the load balancers
+// of overlay networks (`lb_<netid>`).
+const DefaultDiscoveryDirectory = "/var/run/docker/netns"
+
+// DiscoveryConfig provides the necessary configuration for
+// initializing a Discovery.
+type DiscoveryConfig struct {
+	// Directory is the directory that holds the network
+	// namespaces to discover (e.g., DefaultDiscoveryDirectory).
+	Directory string
+
+	// Collector is the configuration of the collectors created
+	// for each namespace. `NamespacePath` is set to the path of
+	// the namespace.
+	Collector CollectorConfig
+
+	// Registerer is where the collectors of the namespaces
+	// with ipvs services get registered.
+	Registerer prometheus.Registerer
+
+	// ResyncInterval indicates how often the directory is
+	// checked regardless of inotify events so that namespaces
+	// that were not ready yet (e.g., not mounted or without
+	// ipvs services) are checked again.
+	ResyncInterval time.Duration
+}
+
+// discoveredNamespace is a namespace that has a collector
+// registered.
+type discoveredNamespace struct {
+	collector *Collector
+	stop      chan struct{}
+
+	// done is closed once the Poll loop of the collector
+	// has returned.
+	done chan struct{}
+}
+
+// Discovery watches a directory of network namespaces (via
+// inotify), creating a collector for each namespace that
+// contains ipvs services and tearing it down when the namespace
+// goes away.
+type Discovery struct {
+	logger zerolog.Logger
+	cfg    DiscoveryConfig
+	watch  *os.File
+
+	// newCollector creates the collector of a namespace
+	// (NewCollector unless in tests).
+	newCollector func(cfg CollectorConfig) (*Collector, error)
+
+	namespaces map[string]*discoveredNamespace
+	sync.Mutex
+}
+
+// NewDiscovery initializes a Discovery, setting up the inotify
+// watch on the configured directory.
+//
+// Namespaces are only discovered once Run is called.
+func NewDiscovery(cfg DiscoveryConfig) (d *Discovery, err error) {
+	if cfg.Directory == "" {
+		err = errors.Errorf("Directory must be specified")
+		return
+	}
+
+	if cfg.Registerer == nil {
+		err = errors.Errorf("Registerer must be specified")
+		return
+	}
+
+	if cfg.ResyncInterval <= 0 {
+		err = errors.Errorf("ResyncInterval must be positive")
+		return
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"failed to initialize inotify")
+		return
+	}
+
+	_, err = syscall.InotifyAddWatch(fd, cfg.Directory,
+		syscall.IN_CREATE|syscall.IN_DELETE|
+			syscall.IN_MOVED_FROM|syscall.IN_MOVED_TO)
+	if err != nil {
+		syscall.Close(fd)
+		err = errors.Wrapf(err,
+			"failed to watch directory %s",
+			cfg.Directory)
+		return
+	}
+
+	d = &Discovery{
+		cfg:        cfg,
+		watch:      os.NewFile(uintptr(fd), "inotify"),
+		namespaces: map[string]*discoveredNamespace{},
+		newCollector: func(cfg CollectorConfig) (c *Collector, err error) {
+			collector, err := NewCollector(cfg)
+			if err != nil {
+				return
+			}
+
+			c = &collector
+			return
+		},
+		logger: zerolog.New(os.Stdout).
+			With().
+			Str("from", "discovery").
+			Logger(),
+	}
+
+	return
+}
+
+// Run synchronizes the collectors with the namespaces in the
+// directory whenever it changes (and every `ResyncInterval`)
+// until `stop` is closed, after which all of the collectors
+// are torn down.
+func (d *Discovery) Run(stop <-chan struct{}) {
+	var (
+		events = make(chan struct{}, 1)
+		ticker = time.NewTicker(d.cfg.ResyncInterval)
+	)
+
+	defer ticker.Stop()
+
+	go d.readEvents(events)
+
+	for {
+		d.sync()
+
+		select {
+		case <-stop:
+			d.watch.Close()
+			d.teardownAll()
+			return
+		case <-events:
+		case <-ticker.C:
+		}
+	}
+}
+
+// readEvents notifies `events` whenever inotify events arrive,
+// coalescing those that arrive while a sync is pending.
+//
+// The contents of the events are discarded given that the whole
+// directory is listed on each sync.
+func (d *Discovery) readEvents(events chan<- struct{}) {
+	var buf = make([]byte, 16*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+	for {
+		_, err := d.watch.Read(buf)
+		if err != nil {
+			return
+		}
+
+		select {
+		case events <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// sync lists the namespaces in the directory, creating the
+// collectors of new namespaces that have ipvs services and
+// tearing down those whose namespaces are gone or no longer have
+// any services (they are set up again once services show up).
+//
+// Namespaces whose services can't be listed are kept given that
+// their collectors report it (see `ipvs_up`).
+func (d *Discovery) sync() {
+	d.Lock()
+	defer d.Unlock()
+
+	files, err := ioutil.ReadDir(d.cfg.Directory)
+	if err != nil {
+		d.logger.Error().
+			Err(err).
+			Str("directory", d.cfg.Directory).
+			Msg("failed to list namespaces")
+		return
+	}
+
+	var present = map[string]bool{}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(d.cfg.Directory, file.Name())
+		present[path] = true
+
+		if namespace, ok := d.namespaces[path]; ok {
+			hasServices, err := namespace.collector.hasServices()
+			if err == nil && !hasServices {
+				d.logger.Info().
+					Str("namespace", path).
+					Msg("namespace without ipvs services")
+				d.teardown(path)
+			}
+
+			continue
+		}
+
+		d.setup(path)
+	}
+
+	for path := range d.namespaces {
+		if !present[path] {
+			d.logger.Info().
+				Str("namespace", path).
+				Msg("namespace gone")
+			d.teardown(path)
+		}
+	}
+}
+
+// setup creates and registers the collector of the namespace at
+// `path` in case it contains ipvs services.
+//
+// Namespaces that can't be inspected yet (e.g., not mounted yet)
+// or that have no services are checked again on the next sync.
+func (d *Discovery) setup(path string) {
+	cfg := d.cfg.Collector
+	cfg.NamespacePath = path
+
+	collector, err := d.newCollector(cfg)
+	if err != nil {
+		d.logger.Debug().
+			Err(err).
+			Str("namespace", path).
+			Msg("namespace not ready")
+		return
+	}
+
+	hasServices, err := collector.hasServices()
+	if err != nil || !hasServices {
+		d.logger.Debug().
+			Err(err).
+			Str("namespace", path).
+			Msg("namespace without ipvs services")
+		collector.Close()
+		return
+	}
+
+	err = d.cfg.Registerer.Register(collector)
+	if err != nil {
+		d.logger.Error().
+			Err(err).
+			Str("namespace", path).
+			Msg("failed to register collector")
+		collector.Close()
+		return
+	}
+
+	namespace := &discoveredNamespace{
+		collector: collector,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	go func() {
+		defer close(namespace.done)
+		collector.Poll(namespace.stop)
+	}()
+
+	d.namespaces[path] = namespace
+	d.logger.Info().
+		Str("namespace", path).
+		Msg("collecting namespace")
+}
+
+// teardown unregisters and releases the collector of the
+// namespace at `path`, once its Poll loop has returned.
+func (d *Discovery) teardown(path string) {
+	namespace := d.namespaces[path]
+
+	d.cfg.Registerer.Unregister(namespace.collector)
+	close(namespace.stop)
+	<-namespace.done
+	namespace.collector.Close()
+
+	delete(d.namespaces, path)
+	d.logger.Info().
+		Str("namespace", path).
+		Msg("stopped collecting namespace")
+}
+
+// teardownAll tears down the collectors of all the namespaces.
+func (d *Discovery) teardownAll() {
+	d.Lock()
+	defer d.Unlock()
+
+	for path := range d.namespaces {
+		d.teardown(path)
+	}
+}
@@ -0,0 +1,174 @@
+package collector
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mqliang/libipvs"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// registeredNamespaces retrieves the namespaces that have
+// collectors registered in a registry.
+func registeredNamespaces(t *testing.T, registry *prometheus.Registry) (namespaces []string) {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	for _, family := range families {
+		if family.GetName() != "ipvs_up" {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			namespaces = append(namespaces, metricLabels(metric)["namespace"])
+		}
+	}
+
+	return
+}
+
+// waitFor waits up to a second for `condition` to hold.
+func waitFor(t *testing.T, condition func() bool) {
+	for deadline := time.Now().Add(time.Second); !condition(); {
+		require.True(t, time.Now().Before(deadline), "condition never met")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipvs-exporter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var (
+		registry = prometheus.NewRegistry()
+		service  = func() []*libipvs.Service {
+			return []*libipvs.Service{{
+				Protocol: syscall.IPPROTO_TCP,
+				Address:  net.ParseIP("10.0.0.1"),
+				Port:     80,
+			}}
+		}
+		handles = map[string]*fakeIPVSHandle{
+			"ingress_sbox": {services: service()},
+			"lb_abc":       {services: service()},
+			"lb_empty":     {},
+		}
+		created = map[string]*fakeIPVSHandle{}
+		mutex   sync.Mutex
+	)
+
+	discovery, err := NewDiscovery(DiscoveryConfig{
+		Directory:      dir,
+		Registerer:     registry,
+		ResyncInterval: time.Hour,
+	})
+	require.NoError(t, err)
+
+	discovery.newCollector = func(cfg CollectorConfig) (c *Collector, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		name := filepath.Base(cfg.NamespacePath)
+		template, ok := handles[name]
+		if !ok {
+			err = errors.Errorf("not a namespace")
+			return
+		}
+
+		handle := *template
+		created[name] = &handle
+
+		collector := newFakeCollector(&handle, cfg)
+		c = &collector
+		return
+	}
+
+	// collectors get closed while the discovery is locked
+	closed := func(name string) bool {
+		discovery.Lock()
+		defer discovery.Unlock()
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		return created[name] != nil && created[name].closed
+	}
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ingress_sbox"), nil, 0644))
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		discovery.Run(stop)
+		close(done)
+	}()
+
+	waitFor(t, func() bool {
+		return len(registeredNamespaces(t, registry)) == 1
+	})
+	assert.Equal(t, []string{filepath.Join(dir, "ingress_sbox")},
+		registeredNamespaces(t, registry))
+
+	// namespaces without ipvs services are not collected
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "lb_empty"), nil, 0644))
+	waitFor(t, func() bool { return closed("lb_empty") })
+
+	// nor files that are not namespaces
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "garbage"), nil, 0644))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "lb_abc"), nil, 0644))
+	waitFor(t, func() bool {
+		return len(registeredNamespaces(t, registry)) == 2
+	})
+	assert.ElementsMatch(t, []string{
+		filepath.Join(dir, "ingress_sbox"),
+		filepath.Join(dir, "lb_abc"),
+	}, registeredNamespaces(t, registry))
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "lb_abc")))
+	waitFor(t, func() bool {
+		return len(registeredNamespaces(t, registry)) == 1
+	})
+	assert.True(t, closed("lb_abc"))
+	assert.False(t, closed("ingress_sbox"))
+
+	// namespaces that lose all of their services stop being
+	// collected (syncs only use the handles while the
+	// discovery is locked)
+	discovery.Lock()
+	mutex.Lock()
+	handles["ingress_sbox"].services = nil
+	created["ingress_sbox"].services = nil
+	mutex.Unlock()
+	discovery.Unlock()
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "resync"), nil, 0644))
+	waitFor(t, func() bool {
+		return len(registeredNamespaces(t, registry)) == 0
+	})
+	assert.True(t, closed("ingress_sbox"))
+
+	close(stop)
+	<-done
+
+	assert.Empty(t, registeredNamespaces(t, registry))
+	assert.True(t, closed("ingress_sbox"))
+}
+
+func TestNewDiscoveryInexistentDirectory(t *testing.T) {
+	_, err := NewDiscovery(DiscoveryConfig{
+		Directory:      "/inexistent",
+		Registerer:     prometheus.NewRegistry(),
+		ResyncInterval: time.Minute,
+	})
+	assert.Error(t, err)
+}
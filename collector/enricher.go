@@ -0,0 +1,46 @@
+package collector
+
+import (
+	"net"
+
+	"github.com/mqliang/libipvs"
+)
+
+// ServiceEnricher provides additional labels to the metrics of
+// the services (and their destinations), e.g., the name of the
+// docker swarm service that a virtual server belongs to.
+type ServiceEnricher interface {
+	// Labels retrieves the names of the labels that the
+	// enricher provides.
+	Labels() []string
+
+	// LabelValues retrieves the values of the labels (in the
+	// same order as Labels) for a given service.
+	//
+	// `destinationPort` is the port that iptables marks with
+	// the fwmark of fwmark-based services (the first one if
+	// it marks several, zero otherwise) and
+	// `destinationAddress` the single destination address
+	// that it restricts the marked packets to (the first one
+	// if it marks several, nil otherwise).
+	//
+	// Services that are not known must still have a value
+	// (e.g., empty) for each of the labels.
+	LabelValues(service *libipvs.Service, destinationPort uint16, destinationAddress net.IP) []string
+}
+
+// DestinationEnricher provides additional labels to the metrics
+// of the destinations (real servers), e.g., the docker swarm
+// task that a real server address belongs to.
+type DestinationEnricher interface {
+	// Labels retrieves the names of the labels that the
+	// enricher provides.
+	Labels() []string
+
+	// LabelValues retrieves the values of the labels (in the
+	// same order as Labels) for a given destination.
+	//
+	// Destinations that are not known must still have a value
+	// (e.g., empty) for each of the labels.
+	LabelValues(destination *libipvs.Destination) []string
+}
@@ -0,0 +1,151 @@
+package collector
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/cirocosta/ingress_ipvs_exporter/mapper"
+	"github.com/mqliang/libipvs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEnricher names services after their ports (or, for
+// fwmark services, the addresses that their rules mark).
+type fakeEnricher struct{}
+
+func (e *fakeEnricher) Labels() []string {
+	return []string{"service_name", "stack"}
+}
+
+func (e *fakeEnricher) LabelValues(service *libipvs.Service, destinationPort uint16, destinationAddress net.IP) []string {
+	if service.Port == 80 {
+		return []string{"web", "shop"}
+	}
+
+	if service.FWMark != 0 && destinationAddress.Equal(net.ParseIP("10.0.0.5")) {
+		return []string{"api", ""}
+	}
+
+	return []string{"", ""}
+}
+
+func TestCollectorServiceEnricher(t *testing.T) {
+	var (
+		known = &libipvs.Service{
+			AddressFamily: syscall.AF_INET,
+			Protocol:      syscall.IPPROTO_TCP,
+			Address:       net.ParseIP("10.0.0.1"),
+			Port:          80,
+		}
+		unknown = &libipvs.Service{
+			AddressFamily: syscall.AF_INET,
+			Protocol:      syscall.IPPROTO_TCP,
+			Address:       net.ParseIP("10.0.0.2"),
+			Port:          8080,
+		}
+		fwmark = &libipvs.Service{
+			AddressFamily: syscall.AF_INET,
+			FWMark:        261,
+		}
+		handle = &fakeIPVSHandle{
+			services: []*libipvs.Service{known, unknown, fwmark},
+			destinations: map[*libipvs.Service][]*libipvs.Destination{
+				known: {{Address: net.ParseIP("10.255.0.5")}},
+			},
+		}
+		collector = newFakeCollector(handle, CollectorConfig{
+			ServiceEnricher: &fakeEnricher{},
+		})
+	)
+
+	collector.getMappings = func() (map[mapper.Family]map[uint32][]mapper.Mapping, error) {
+		return map[mapper.Family]map[uint32][]mapper.Mapping{
+			mapper.IPv4: {261: {{Destination: net.ParseIP("10.0.0.5").To4()}}},
+		}, nil
+	}
+
+	metrics := collectMetrics(t, &collector)
+
+	require.Len(t, metrics["ipvs_service_info"], 3)
+	for _, metric := range metrics["ipvs_service_info"] {
+		labels := metricLabels(metric)
+		switch {
+		case labels["fwmark"] == "261":
+			assert.Equal(t, "api", labels["service_name"])
+			assert.Equal(t, "", labels["stack"])
+		case labels["port"] == "80":
+			assert.Equal(t, "web", labels["service_name"])
+			assert.Equal(t, "shop", labels["stack"])
+		case labels["port"] == "8080":
+			assert.Equal(t, "", labels["service_name"])
+			assert.Equal(t, "", labels["stack"])
+		}
+	}
+
+	require.Len(t, metrics["ipvs_destination_weight"], 1)
+	labels := metricLabels(metrics["ipvs_destination_weight"][0])
+	assert.Equal(t, "10.255.0.5", labels["address"])
+	assert.Equal(t, "10.0.0.1", labels["virtual_address"])
+	assert.Equal(t, "web", labels["service_name"])
+	assert.Equal(t, "shop", labels["stack"])
+}
+
+// fakeDestinationEnricher names the tasks after the real
+// server addresses.
+type fakeDestinationEnricher struct{}
+
+func (e *fakeDestinationEnricher) Labels() []string {
+	return []string{"task_id"}
+}
+
+func (e *fakeDestinationEnricher) LabelValues(destination *libipvs.Destination) []string {
+	if destination.Address.Equal(net.ParseIP("10.255.0.5")) {
+		return []string{"task-1"}
+	}
+
+	return []string{""}
+}
+
+func TestCollectorDestinationEnricher(t *testing.T) {
+	var (
+		service = &libipvs.Service{
+			AddressFamily: syscall.AF_INET,
+			Protocol:      syscall.IPPROTO_TCP,
+			Address:       net.ParseIP("10.0.0.1"),
+			Port:          80,
+		}
+		handle = &fakeIPVSHandle{
+			services: []*libipvs.Service{service},
+			destinations: map[*libipvs.Service][]*libipvs.Destination{
+				service: {
+					{Address: net.ParseIP("10.255.0.5")},
+					{Address: net.ParseIP("10.255.0.6")},
+				},
+			},
+		}
+		collector = newFakeCollector(handle, CollectorConfig{
+			ServiceEnricher:     &fakeEnricher{},
+			DestinationEnricher: &fakeDestinationEnricher{},
+		})
+	)
+
+	metrics := collectMetrics(t, &collector)
+
+	require.Len(t, metrics["ipvs_service_info"], 1)
+	assert.NotContains(t, metricLabels(metrics["ipvs_service_info"][0]), "task_id")
+
+	require.Len(t, metrics["ipvs_destination_weight"], 2)
+	for _, metric := range metrics["ipvs_destination_weight"] {
+		labels := metricLabels(metric)
+		assert.Equal(t, "web", labels["service_name"])
+
+		switch labels["address"] {
+		case "10.255.0.5":
+			assert.Equal(t, "task-1", labels["task_id"])
+		case "10.255.0.6":
+			assert.Equal(t, "", labels["task_id"])
+		}
+	}
+}
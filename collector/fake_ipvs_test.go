@@ -0,0 +1,61 @@
+package collector
+
+import (
+	"github.com/mqliang/libipvs"
+	"github.com/rs/zerolog"
+)
+
+// fakeIPVSHandle implements Source by serving services and
+// destinations from memory so that the collector can be
+// exercised without touching the kernel.
+type fakeIPVSHandle struct {
+	services        []*libipvs.Service
+	servicesErr     error
+	destinations    map[*libipvs.Service][]*libipvs.Destination
+	destinationsErr map[*libipvs.Service]error
+	closed          bool
+
+	// undetailed makes the source behave as procfs does
+	// (see Source.Detailed).
+	undetailed bool
+
+	// listed counts the calls to ListDestinations by
+	// service.
+	listed map[*libipvs.Service]int
+}
+
+func (h *fakeIPVSHandle) ListServices() (services []*libipvs.Service, err error) {
+	if h.closed {
+		panic("source used after being closed")
+	}
+
+	return h.services, h.servicesErr
+}
+
+func (h *fakeIPVSHandle) ListDestinations(s *libipvs.Service) (dsts []*libipvs.Destination, err error) {
+	if h.listed == nil {
+		h.listed = map[*libipvs.Service]int{}
+	}
+	h.listed[s]++
+
+	return h.destinations[s], h.destinationsErr[s]
+}
+
+func (h *fakeIPVSHandle) Detailed() bool { return !h.undetailed }
+
+func (h *fakeIPVSHandle) Close() { h.closed = true }
+
+// newFakeCollector creates a Collector that gathers its
+// information from the provided source in the current
+// network namespace.
+//
+// Reopening the collector keeps the same source.
+func newFakeCollector(source Source, cfg CollectorConfig) (c Collector) {
+	c.ipvs = source
+	c.newSource = func() (Source, error) { return source, nil }
+	c.logger = zerolog.Nop()
+	if err := c.initDescriptors(cfg); err != nil {
+		panic(err)
+	}
+	return
+}
@@ -0,0 +1,357 @@
+package collector
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/cirocosta/ingress_ipvs_exporter/mapper"
+	"github.com/mqliang/libipvs"
+	"github.com/pkg/errors"
+)
+
+// Filter selects services and destinations by their properties.
+//
+// As an include filter (see CollectorConfig), only what matches
+// all of the criteria that are set is kept. As an exclude filter,
+// what matches any of them is dropped.
+type Filter struct {
+	// FWMarks are the firewall marks of fwmark-based
+	// services.
+	FWMarks []uint32
+
+	// Ports are the ranges of the ports that services are
+	// published at: the ports that iptables marks for
+	// fwmark-based services (any of them) and the virtual
+	// server port for the rest.
+	Ports []mapper.PortRange
+
+	// Protocols are the protocols of the services: those
+	// that iptables marks for fwmark-based services (any of
+	// them - this criterion doesn't apply to those whose
+	// rules don't restrict the protocol).
+	Protocols []libipvs.Protocol
+
+	// Destinations are the networks of the real servers.
+	//
+	// Given that destinations are only known once they're
+	// listed, this criterion is applied to each of them
+	// rather than to the services.
+	Destinations []*net.IPNet
+}
+
+// filterCounts holds the number of services and destinations
+// that were filtered out while gathering ipvs information.
+type filterCounts struct {
+	services     int
+	destinations int
+}
+
+// ParseFilter parses a list of filter expressions, each in the
+// form `criterion=value`:
+//
+// - fwmark=260 (or fwmark=0x104)
+// - port=30000 (or port=30000-30100)
+// - protocol=tcp (tcp, udp or sctp)
+// - destination=10.255.0.0/16 (or a single address)
+func ParseFilter(exprs []string) (filter Filter, err error) {
+	for _, expr := range exprs {
+		ndx := strings.Index(expr, "=")
+		if ndx == -1 {
+			err = errors.Errorf("malformed filter %s - expected criterion=value", expr)
+			return
+		}
+
+		criterion, value := expr[:ndx], expr[ndx+1:]
+
+		switch criterion {
+		case "fwmark":
+			var fwmark uint64
+
+			fwmark, err = strconv.ParseUint(value, 0, 32)
+			if err != nil {
+				err = errors.Wrapf(err, "malformed fwmark in filter %s", expr)
+				return
+			}
+
+			filter.FWMarks = append(filter.FWMarks, uint32(fwmark))
+		case "port":
+			var portRange mapper.PortRange
+
+			portRange, err = parsePortRange(value)
+			if err != nil {
+				err = errors.Wrapf(err, "malformed port range in filter %s", expr)
+				return
+			}
+
+			filter.Ports = append(filter.Ports, portRange)
+		case "protocol":
+			var protocol libipvs.Protocol
+
+			switch value {
+			case "tcp":
+				protocol = syscall.IPPROTO_TCP
+			case "udp":
+				protocol = syscall.IPPROTO_UDP
+			case "sctp":
+				protocol = syscall.IPPROTO_SCTP
+			default:
+				err = errors.Errorf("unknown protocol in filter %s", expr)
+				return
+			}
+
+			filter.Protocols = append(filter.Protocols, protocol)
+		case "destination":
+			var network *net.IPNet
+
+			network, err = parseNetwork(value)
+			if err != nil {
+				err = errors.Wrapf(err, "malformed destination in filter %s", expr)
+				return
+			}
+
+			filter.Destinations = append(filter.Destinations, network)
+		default:
+			err = errors.Errorf("unknown criterion in filter %s", expr)
+			return
+		}
+	}
+
+	return
+}
+
+// parsePortRange parses either a single port (`80`) or an
+// inclusive range of ports (`30000-30100`).
+func parsePortRange(value string) (portRange mapper.PortRange, err error) {
+	from, to := value, value
+	if ndx := strings.Index(value, "-"); ndx != -1 {
+		from, to = value[:ndx], value[ndx+1:]
+	}
+
+	port, err := strconv.ParseUint(from, 10, 16)
+	if err != nil {
+		return
+	}
+	portRange.From = uint16(port)
+
+	port, err = strconv.ParseUint(to, 10, 16)
+	if err != nil {
+		return
+	}
+	portRange.To = uint16(port)
+
+	if portRange.From > portRange.To {
+		err = errors.Errorf("range starts after it ends")
+		return
+	}
+
+	return
+}
+
+// parseNetwork parses either a network in CIDR notation or a
+// single address.
+func parseNetwork(value string) (network *net.IPNet, err error) {
+	if strings.Contains(value, "/") {
+		_, network, err = net.ParseCIDR(value)
+		return
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		err = errors.Errorf("invalid address %s", value)
+		return
+	}
+
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+
+	network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	return
+}
+
+// isEmpty indicates whether no criteria are set.
+func (f *Filter) isEmpty() bool {
+	return len(f.FWMarks) == 0 &&
+		len(f.Ports) == 0 &&
+		len(f.Protocols) == 0 &&
+		len(f.Destinations) == 0
+}
+
+// matchesFWMark indicates whether the service has one of the
+// fwmarks (ok is false if the criterion doesn't apply).
+func (f *Filter) matchesFWMark(service *libipvs.Service) (matches, ok bool) {
+	if len(f.FWMarks) == 0 {
+		return
+	}
+
+	ok = true
+	for _, fwmark := range f.FWMarks {
+		if service.FWMark == fwmark {
+			matches = true
+			return
+		}
+	}
+
+	return
+}
+
+// matchesPort indicates whether the port that the service is
+// published at (any of them for fwmark-based services) is in one
+// of the ranges (ok is false if the criterion doesn't apply).
+func (f *Filter) matchesPort(service *libipvs.Service, mappings []mapper.Mapping) (matches, ok bool) {
+	if len(f.Ports) == 0 {
+		return
+	}
+
+	var ports []mapper.PortRange
+	if service.FWMark == 0 {
+		ports = append(ports, mapper.PortRange{From: service.Port, To: service.Port})
+	}
+
+	for _, mapping := range mappings {
+		ports = append(ports, mapping.Ports...)
+	}
+
+	// without mappings, fwmark-based services are published
+	// at port zero
+	if len(ports) == 0 {
+		ports = append(ports, mapper.PortRange{})
+	}
+
+	ok = true
+	for _, portRange := range f.Ports {
+		for _, port := range ports {
+			if port.From <= portRange.To && port.To >= portRange.From {
+				matches = true
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// matchesProtocol indicates whether the service (any of the
+// mappings for fwmark-based services) has one of the protocols
+// (ok is false if the criterion doesn't apply).
+func (f *Filter) matchesProtocol(service *libipvs.Service, mappings []mapper.Mapping) (matches, ok bool) {
+	if len(f.Protocols) == 0 {
+		return
+	}
+
+	protocols := []libipvs.Protocol{service.Protocol}
+	if service.FWMark != 0 {
+		protocols = nil
+		for _, mapping := range mappings {
+			if mapping.Protocol != 0 {
+				protocols = append(protocols, libipvs.Protocol(mapping.Protocol))
+			}
+		}
+
+		if len(protocols) == 0 {
+			return
+		}
+	}
+
+	ok = true
+	for _, protocol := range f.Protocols {
+		for _, serviceProtocol := range protocols {
+			if serviceProtocol == protocol {
+				matches = true
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// matchesDestination indicates whether the destination is in
+// one of the networks (ok is false if the criterion doesn't
+// apply).
+func (f *Filter) matchesDestination(destination *libipvs.Destination) (matches, ok bool) {
+	if len(f.Destinations) == 0 {
+		return
+	}
+
+	ok = true
+	for _, network := range f.Destinations {
+		if network.Contains(destination.Address) {
+			matches = true
+			return
+		}
+	}
+
+	return
+}
+
+// keepService indicates whether a service passes both the
+// include and exclude filters.
+//
+// `mappings` describes the protocols and ports that iptables
+// marks with the fwmark of fwmark-based services (none
+// otherwise).
+func keepService(include, exclude *Filter, service *libipvs.Service, mappings []mapper.Mapping) bool {
+	if matches, ok := include.matchesFWMark(service); ok && !matches {
+		return false
+	}
+
+	if matches, ok := include.matchesPort(service, mappings); ok && !matches {
+		return false
+	}
+
+	if matches, ok := include.matchesProtocol(service, mappings); ok && !matches {
+		return false
+	}
+
+	if matches, _ := exclude.matchesFWMark(service); matches {
+		return false
+	}
+
+	if matches, _ := exclude.matchesPort(service, mappings); matches {
+		return false
+	}
+
+	if matches, _ := exclude.matchesProtocol(service, mappings); matches {
+		return false
+	}
+
+	return true
+}
+
+// mayKeepService indicates whether a service passes the criteria
+// of both filters that don't depend on the mappings (all of them
+// for services that aren't fwmark-based), so that services that
+// don't are left out before looking their fwmarks up.
+func mayKeepService(include, exclude *Filter, service *libipvs.Service) bool {
+	if service.FWMark == 0 {
+		return keepService(include, exclude, service, nil)
+	}
+
+	if matches, ok := include.matchesFWMark(service); ok && !matches {
+		return false
+	}
+
+	if matches, _ := exclude.matchesFWMark(service); matches {
+		return false
+	}
+
+	return true
+}
+
+// keepDestination indicates whether a destination passes both
+// the include and exclude filters.
+func keepDestination(include, exclude *Filter, destination *libipvs.Destination) bool {
+	if matches, ok := include.matchesDestination(destination); ok && !matches {
+		return false
+	}
+
+	if matches, _ := exclude.matchesDestination(destination); matches {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,334 @@
+package collector
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/cirocosta/ingress_ipvs_exporter/mapper"
+	"github.com/mqliang/libipvs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFilter(t *testing.T) {
+	filter, err := ParseFilter([]string{
+		"fwmark=260",
+		"fwmark=0x105",
+		"port=80",
+		"port=30000-30100",
+		"protocol=udp",
+		"destination=10.255.0.0/16",
+		"destination=fd00::5",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []uint32{260, 261}, filter.FWMarks)
+	assert.Equal(t, []mapper.PortRange{{From: 80, To: 80}, {From: 30000, To: 30100}}, filter.Ports)
+	assert.Equal(t, []libipvs.Protocol{syscall.IPPROTO_UDP}, filter.Protocols)
+	require.Len(t, filter.Destinations, 2)
+	assert.Equal(t, "10.255.0.0/16", filter.Destinations[0].String())
+	assert.Equal(t, "fd00::5/128", filter.Destinations[1].String())
+
+	filter, err = ParseFilter(nil)
+	require.NoError(t, err)
+	assert.True(t, filter.isEmpty())
+
+	for _, expr := range []string{
+		"fwmark",
+		"fwmark=abc",
+		"port=30100-30000",
+		"port=70000",
+		"protocol=icmp",
+		"destination=10.0.0.0/33",
+		"address=10.0.0.1",
+	} {
+		_, err = ParseFilter([]string{expr})
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestCollectorFilters(t *testing.T) {
+	var (
+		web = &libipvs.Service{
+			AddressFamily: syscall.AF_INET,
+			Protocol:      syscall.IPPROTO_TCP,
+			Address:       net.ParseIP("10.0.0.1"),
+			Port:          80,
+		}
+		dns = &libipvs.Service{
+			AddressFamily: syscall.AF_INET,
+			Protocol:      syscall.IPPROTO_UDP,
+			Address:       net.ParseIP("10.0.0.2"),
+			Port:          53,
+		}
+		api = &libipvs.Service{
+			AddressFamily: syscall.AF_INET,
+			Protocol:      syscall.IPPROTO_TCP,
+			Address:       net.ParseIP("10.0.0.3"),
+			Port:          8080,
+		}
+		ingress = &libipvs.Service{
+			AddressFamily: syscall.AF_INET,
+			FWMark:        260,
+		}
+		destinations = map[*libipvs.Service][]*libipvs.Destination{
+			web: {
+				{Address: net.ParseIP("10.255.0.5")},
+				{Address: net.ParseIP("10.254.0.5")},
+			},
+			dns:     {{Address: net.ParseIP("10.255.0.6")}},
+			api:     {{Address: net.ParseIP("10.255.0.7")}},
+			ingress: {{Address: net.ParseIP("10.255.0.8")}},
+		}
+		testCases = []struct {
+			desc                 string
+			include              []string
+			exclude              []string
+			services             []*libipvs.Service
+			destinations         int
+			filteredServices     float64
+			filteredDestinations float64
+		}{
+			{
+				// without mappings, fwmark-based services
+				// are published at port zero
+				desc:                 "include by protocol and port",
+				include:              []string{"protocol=tcp", "port=1-1024"},
+				services:             []*libipvs.Service{web},
+				destinations:         2,
+				filteredServices:     3,
+				filteredDestinations: 0,
+			},
+			{
+				desc:                 "include by fwmark",
+				include:              []string{"fwmark=260"},
+				services:             []*libipvs.Service{ingress},
+				destinations:         1,
+				filteredServices:     3,
+				filteredDestinations: 0,
+			},
+			{
+				desc:                 "exclude by port or protocol",
+				exclude:              []string{"port=8080", "protocol=udp"},
+				services:             []*libipvs.Service{web, ingress},
+				destinations:         3,
+				filteredServices:     2,
+				filteredDestinations: 0,
+			},
+			{
+				desc:                 "exclude by fwmark",
+				exclude:              []string{"fwmark=260"},
+				services:             []*libipvs.Service{web, dns, api},
+				destinations:         4,
+				filteredServices:     1,
+				filteredDestinations: 0,
+			},
+			{
+				desc:                 "include destinations",
+				include:              []string{"destination=10.255.0.0/16"},
+				services:             []*libipvs.Service{web, dns, api, ingress},
+				destinations:         4,
+				filteredServices:     0,
+				filteredDestinations: 1,
+			},
+			{
+				desc:                 "exclude destinations",
+				exclude:              []string{"destination=10.255.0.5", "destination=10.254.0.0/16"},
+				services:             []*libipvs.Service{web, dns, api, ingress},
+				destinations:         3,
+				filteredServices:     0,
+				filteredDestinations: 2,
+			},
+		}
+	)
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			include, err := ParseFilter(tc.include)
+			require.NoError(t, err)
+
+			exclude, err := ParseFilter(tc.exclude)
+			require.NoError(t, err)
+
+			var (
+				handle = &fakeIPVSHandle{
+					services:     []*libipvs.Service{web, dns, api, ingress},
+					destinations: destinations,
+				}
+				collector = newFakeCollector(handle, CollectorConfig{
+					SkipMappings: true,
+					Include:      include,
+					Exclude:      exclude,
+				})
+			)
+
+			metrics := collectMetrics(t, &collector)
+
+			require.Len(t, metrics["ipvs_services_total"], 1)
+			assert.Equal(t, float64(len(tc.services)),
+				metrics["ipvs_services_total"][0].GetGauge().GetValue())
+			assert.Len(t, metrics["ipvs_destination_weight"], tc.destinations)
+
+			// services left out are never asked for their
+			// destinations.
+			for _, service := range []*libipvs.Service{web, dns, api, ingress} {
+				var expected int
+				for _, kept := range tc.services {
+					if kept == service {
+						expected = 1
+					}
+				}
+
+				assert.Equal(t, expected, handle.listed[service])
+			}
+
+			filtered := map[string]float64{}
+			for _, metric := range metrics["ipvs_filtered_objects"] {
+				filtered[metricLabels(metric)["kind"]] = metric.GetGauge().GetValue()
+			}
+
+			assert.Equal(t, map[string]float64{
+				"service":     tc.filteredServices,
+				"destination": tc.filteredDestinations,
+			}, filtered)
+		})
+	}
+
+	// the source's destinations are left untouched
+	assert.Len(t, destinations[web], 2)
+}
+
+func TestCollectorWithoutFilters(t *testing.T) {
+	collector := newFakeCollector(&fakeIPVSHandle{}, CollectorConfig{})
+
+	metrics := collectMetrics(t, &collector)
+	assert.Empty(t, metrics["ipvs_filtered_objects"])
+}
+
+func TestCollectorFiltersWithMappings(t *testing.T) {
+	var (
+		web = &libipvs.Service{
+			AddressFamily: syscall.AF_INET,
+			FWMark:        260,
+		}
+		dns = &libipvs.Service{
+			AddressFamily: syscall.AF_INET,
+			FWMark:        261,
+		}
+		handle = &fakeIPVSHandle{
+			services: []*libipvs.Service{web, dns},
+			destinations: map[*libipvs.Service][]*libipvs.Destination{
+				web: {{Address: net.ParseIP("10.255.0.5")}},
+				dns: {{Address: net.ParseIP("10.255.0.6")}},
+			},
+		}
+		mappings = map[mapper.Family]map[uint32][]mapper.Mapping{
+			mapper.IPv4: {
+				260: {{Protocol: syscall.IPPROTO_TCP, Ports: []mapper.PortRange{{From: 80, To: 80}, {From: 8000, To: 8080}}}},
+				261: {
+					{Protocol: syscall.IPPROTO_TCP, Ports: []mapper.PortRange{{From: 53, To: 53}}},
+					{Protocol: syscall.IPPROTO_UDP, Ports: []mapper.PortRange{{From: 53, To: 53}}},
+				},
+			},
+		}
+		testCases = []struct {
+			desc     string
+			include  []string
+			exclude  []string
+			services []string
+		}{
+			{
+				desc:     "include by protocol",
+				include:  []string{"protocol=udp"},
+				services: []string{"261"},
+			},
+			{
+				desc:     "include by port in a range",
+				include:  []string{"port=8080-8443"},
+				services: []string{"260"},
+			},
+			{
+				desc:     "exclude by protocol",
+				exclude:  []string{"protocol=tcp"},
+				services: nil,
+			},
+		}
+	)
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			include, err := ParseFilter(tc.include)
+			require.NoError(t, err)
+
+			exclude, err := ParseFilter(tc.exclude)
+			require.NoError(t, err)
+
+			collector := newFakeCollector(handle, CollectorConfig{
+				Include: include,
+				Exclude: exclude,
+			})
+			collector.getMappings = func() (map[mapper.Family]map[uint32][]mapper.Mapping, error) {
+				return mappings, nil
+			}
+
+			var fwmarks []string
+			for _, metric := range collectMetrics(t, &collector)["ipvs_destination_weight"] {
+				fwmarks = append(fwmarks, metricLabels(metric)["fwmark"])
+			}
+
+			assert.Equal(t, tc.services, fwmarks)
+		})
+	}
+}
+
+func TestCollectorFiltersBeforeMappings(t *testing.T) {
+	var (
+		web = &libipvs.Service{
+			AddressFamily: syscall.AF_INET,
+			FWMark:        260,
+		}
+		unmapped = &libipvs.Service{
+			AddressFamily: syscall.AF_INET,
+			FWMark:        261,
+		}
+		handle = &fakeIPVSHandle{
+			services: []*libipvs.Service{web, unmapped},
+			destinations: map[*libipvs.Service][]*libipvs.Destination{
+				web:      {{Address: net.ParseIP("10.255.0.5")}},
+				unmapped: {{Address: net.ParseIP("10.255.0.6")}},
+			},
+		}
+	)
+
+	exclude, err := ParseFilter([]string{"fwmark=261"})
+	require.NoError(t, err)
+
+	collector := newFakeCollector(handle, CollectorConfig{Exclude: exclude})
+	collector.getMappings = func() (map[mapper.Family]map[uint32][]mapper.Mapping, error) {
+		return map[mapper.Family]map[uint32][]mapper.Mapping{
+			mapper.IPv4: {
+				260: {{Protocol: syscall.IPPROTO_TCP, Ports: []mapper.PortRange{{From: 80, To: 80}}}},
+			},
+		}, nil
+	}
+
+	metrics := collectMetrics(t, &collector)
+
+	require.Len(t, metrics["ipvs_destination_weight"], 1)
+	assert.Equal(t, "260", metricLabels(metrics["ipvs_destination_weight"][0])["fwmark"])
+
+	// the excluded service is filtered out rather than failing
+	// to be mapped
+	for _, metric := range metrics["ipvs_scrape_errors_total"] {
+		assert.Equal(t, float64(0), metric.GetCounter().GetValue(),
+			metricLabels(metric)["stage"])
+	}
+
+	filtered := map[string]float64{}
+	for _, metric := range metrics["ipvs_filtered_objects"] {
+		filtered[metricLabels(metric)["kind"]] = metric.GetGauge().GetValue()
+	}
+
+	assert.Equal(t, float64(1), filtered["service"])
+}
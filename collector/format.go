@@ -0,0 +1,64 @@
+package collector
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/mqliang/libipvs"
+)
+
+// serviceFlagNames maps each of the virtual service flags
+// to the name used by `ipvsadm` when listing them.
+var serviceFlagNames = []struct {
+	flag uint32
+	name string
+}{
+	{libipvs.IP_VS_SVC_F_PERSISTENT, "persistent"},
+	{libipvs.IP_VS_SVC_F_HASHED, "hashed"},
+	{libipvs.IP_VS_SVC_F_ONEPACKET, "ops"},
+	{libipvs.IP_VS_SVC_F_SCHED1, "sched1"},
+	{libipvs.IP_VS_SVC_F_SCHED2, "sched2"},
+	{libipvs.IP_VS_SVC_F_SCHED3, "sched3"},
+}
+
+// formatServiceFlags renders the flags of a virtual service
+// as a comma-separated list of names so that it can be used
+// as a label value.
+//
+// Bits that are not known are rendered in hexadecimal.
+func formatServiceFlags(flags uint32) string {
+	var names = []string{}
+
+	for _, f := range serviceFlagNames {
+		if flags&f.flag == 0 {
+			continue
+		}
+
+		names = append(names, f.name)
+		flags &^= f.flag
+	}
+
+	if flags != 0 {
+		names = append(names, fmt.Sprintf("%#x", flags))
+	}
+
+	return strings.Join(names, ",")
+}
+
+// formatNetmask renders the persistence netmask of a
+// virtual service.
+//
+// For IPv4 services the kernel sends the mask in network
+// byte order (which libipvs reads as a host-order uint32),
+// while for IPv6 it sends the prefix length.
+func formatNetmask(af libipvs.AddressFamily, netmask uint32) string {
+	if af == syscall.AF_INET6 {
+		return strconv.Itoa(int(netmask))
+	}
+
+	return net.IP((*[4]byte)(unsafe.Pointer(&netmask))[:]).String()
+}
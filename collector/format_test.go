@@ -0,0 +1,87 @@
+package collector
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/mqliang/libipvs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatServiceFlags(t *testing.T) {
+	var testCases = []struct {
+		desc     string
+		flags    uint32
+		expected string
+	}{
+		{
+			desc:     "no flags",
+			flags:    0,
+			expected: "",
+		},
+		{
+			desc:     "single flag",
+			flags:    libipvs.IP_VS_SVC_F_HASHED,
+			expected: "hashed",
+		},
+		{
+			desc: "multiple flags",
+			flags: libipvs.IP_VS_SVC_F_PERSISTENT |
+				libipvs.IP_VS_SVC_F_HASHED,
+			expected: "persistent,hashed",
+		},
+		{
+			desc:     "unknown bits",
+			flags:    libipvs.IP_VS_SVC_F_HASHED | 0x100,
+			expected: "hashed,0x100",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.expected, formatServiceFlags(tc.flags))
+		})
+	}
+}
+
+// wireNetmask mimics how libipvs decodes an IPv4 netmask that
+// the kernel sends in network byte order.
+func wireNetmask(mask [4]byte) uint32 {
+	return *(*uint32)(unsafe.Pointer(&mask))
+}
+
+func TestFormatNetmask(t *testing.T) {
+	var testCases = []struct {
+		desc     string
+		af       libipvs.AddressFamily
+		netmask  uint32
+		expected string
+	}{
+		{
+			desc:     "ipv4 full mask",
+			af:       syscall.AF_INET,
+			netmask:  wireNetmask([4]byte{255, 255, 255, 255}),
+			expected: "255.255.255.255",
+		},
+		{
+			desc:     "ipv4 class c mask",
+			af:       syscall.AF_INET,
+			netmask:  wireNetmask([4]byte{255, 255, 255, 0}),
+			expected: "255.255.255.0",
+		},
+		{
+			desc:     "ipv6 prefix length",
+			af:       syscall.AF_INET6,
+			netmask:  64,
+			expected: "64",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.expected,
+				formatNetmask(tc.af, tc.netmask))
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package collector
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/mqliang/libipvs"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// overflowAddress is the address that the destinations rolled
+// up for exceeding the limit of destinations per service are
+// reported with.
+const overflowAddress = "__overflow__"
+
+// applyLimits bounds the services and destinations per service
+// to those configured (see CollectorConfig), returning the
+// services to report and the number of series left out (by a
+// source that is `detailed` or not).
+//
+// Services are kept in the order of their labels and
+// destinations in the order of their addresses so that the same
+// ones are kept across scrapes. The destinations beyond the
+// limit are rolled up into a single one (see rollUp).
+//
+// Given that it's meant to run after the counters got updated,
+// the rolled-up destinations sum already accumulated counters.
+func (c *Collector) applyLimits(infos []*ServiceInfo, detailed bool) (limited []*ServiceInfo, dropped int) {
+	if c.maxServices == 0 && c.maxDestinationsPerService == 0 {
+		limited = infos
+		return
+	}
+
+	limited = make([]*ServiceInfo, len(infos))
+	copy(limited, infos)
+
+	if c.maxServices > 0 && len(limited) > c.maxServices {
+		sort.Slice(limited, func(i, j int) bool {
+			return strings.Join(limited[i].identityLabelValues(), "|") <
+				strings.Join(limited[j].identityLabelValues(), "|")
+		})
+
+		for _, info := range limited[c.maxServices:] {
+			dropped += countMetrics(func(ch chan<- prometheus.Metric) {
+				c.collectService(ch, info, detailed)
+			})
+		}
+
+		limited = limited[:c.maxServices]
+	}
+
+	if c.maxDestinationsPerService == 0 {
+		return
+	}
+
+	for ndx, info := range limited {
+		if len(info.destinationServers) <= c.maxDestinationsPerService {
+			continue
+		}
+
+		limited[ndx] = c.rollUp(info)
+		dropped += countMetrics(func(ch chan<- prometheus.Metric) {
+			for _, destination := range limited[ndx].overflow {
+				c.collectDestination(ch, info, destination, detailed)
+			}
+		})
+	}
+
+	return
+}
+
+// rollUp creates a copy of a service that keeps the first
+// destinations up to the limit (by address) and aggregates the
+// rest into an overflow destination that sums their connections,
+// weights and stats.
+func (c *Collector) rollUp(info *ServiceInfo) (res *ServiceInfo) {
+	destinations := make([]*libipvs.Destination, len(info.destinationServers))
+	copy(destinations, info.destinationServers)
+
+	sort.Slice(destinations, func(i, j int) bool {
+		return bytes.Compare(destinations[i].Address.To16(),
+			destinations[j].Address.To16()) < 0
+	})
+
+	res = &ServiceInfo{}
+	*res = *info
+
+	res.overflow = destinations[c.maxDestinationsPerService:]
+	res.overflowDestination = &libipvs.Destination{
+		AddressFamily: info.AddressFamily,
+		FwdMethod:     res.overflow[0].FwdMethod,
+		Stats:         libipvs.Stats{Stats64: true},
+	}
+
+	for _, destination := range res.overflow {
+		aggregate := res.overflowDestination
+
+		aggregate.Weight += destination.Weight
+		aggregate.UThresh += destination.UThresh
+		aggregate.LThresh += destination.LThresh
+		aggregate.ActiveConns += destination.ActiveConns
+		aggregate.InactConns += destination.InactConns
+		aggregate.PersistConns += destination.PersistConns
+
+		aggregate.Stats.Connections += destination.Stats.Connections
+		aggregate.Stats.PacketsIn += destination.Stats.PacketsIn
+		aggregate.Stats.PacketsOut += destination.Stats.PacketsOut
+		aggregate.Stats.BytesIn += destination.Stats.BytesIn
+		aggregate.Stats.BytesOut += destination.Stats.BytesOut
+		aggregate.Stats.CPS += destination.Stats.CPS
+		aggregate.Stats.PPSIn += destination.Stats.PPSIn
+		aggregate.Stats.PPSOut += destination.Stats.PPSOut
+		aggregate.Stats.BPSIn += destination.Stats.BPSIn
+		aggregate.Stats.BPSOut += destination.Stats.BPSOut
+	}
+
+	res.destinationServers = make([]*libipvs.Destination, 0, c.maxDestinationsPerService+1)
+	res.destinationServers = append(res.destinationServers,
+		destinations[:c.maxDestinationsPerService]...)
+	res.destinationServers = append(res.destinationServers, res.overflowDestination)
+
+	if c.destinationEnricher != nil {
+		res.destinationEnrichment = map[*libipvs.Destination][]string{}
+		for _, destination := range res.destinationServers {
+			res.destinationEnrichment[destination] = info.destinationEnrichment[destination]
+		}
+
+		// the overflow destination stands for many, thus, it
+		// carries no enrichment.
+		res.destinationEnrichment[res.overflowDestination] =
+			make([]string, len(c.destinationEnricher.Labels()))
+	}
+
+	return
+}
+
+// countMetrics counts the metrics that `collect` sends.
+func countMetrics(collect func(ch chan<- prometheus.Metric)) (count int) {
+	var (
+		ch   = make(chan prometheus.Metric)
+		done = make(chan struct{})
+	)
+
+	go func() {
+		for range ch {
+			count++
+		}
+		close(done)
+	}()
+
+	collect(ch)
+	close(ch)
+	<-done
+
+	return
+}
@@ -0,0 +1,229 @@
+package collector
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mqliang/libipvs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// limitsFixture creates a source with three services, one of
+// them with four destinations.
+func limitsFixture() *fakeIPVSHandle {
+	var (
+		web = &libipvs.Service{
+			AddressFamily: syscall.AF_INET,
+			Protocol:      syscall.IPPROTO_TCP,
+			Address:       net.ParseIP("10.0.0.1"),
+			Port:          80,
+		}
+		api = &libipvs.Service{
+			AddressFamily: syscall.AF_INET,
+			Protocol:      syscall.IPPROTO_TCP,
+			Address:       net.ParseIP("10.0.0.3"),
+			Port:          8080,
+		}
+		dns = &libipvs.Service{
+			AddressFamily: syscall.AF_INET,
+			Protocol:      syscall.IPPROTO_UDP,
+			Address:       net.ParseIP("10.0.0.2"),
+			Port:          53,
+		}
+	)
+
+	return &fakeIPVSHandle{
+		services: []*libipvs.Service{dns, web, api},
+		destinations: map[*libipvs.Service][]*libipvs.Destination{
+			web: {
+				{Address: net.ParseIP("10.255.0.8"), Weight: 1, ActiveConns: 10},
+				{Address: net.ParseIP("10.255.0.5"), Weight: 2, ActiveConns: 20},
+				{Address: net.ParseIP("10.255.0.7"), Weight: 3, ActiveConns: 30},
+				{Address: net.ParseIP("10.255.0.6"), Weight: 4, ActiveConns: 40},
+			},
+			api: {{Address: net.ParseIP("10.255.0.9"), Weight: 1}},
+			dns: {{Address: net.ParseIP("10.255.0.10"), Weight: 1}},
+		},
+	}
+}
+
+// countSeries counts the series of the services and
+// destinations (leaving out those about the collector itself).
+func countSeries(t *testing.T, collector *Collector) (count int) {
+	for name, metrics := range collectMetrics(t, collector) {
+		switch name {
+		case "ipvs_up", "ipvs_scrape_duration_seconds",
+			"ipvs_scrape_errors_total", "ipvs_reopens_total",
+			"ipvs_services_total", "ipvs_series_dropped_total":
+			continue
+		}
+
+		count += len(metrics)
+	}
+
+	return
+}
+
+func TestCollectorLimits(t *testing.T) {
+	var (
+		unlimited = newFakeCollector(limitsFixture(), CollectorConfig{
+			DestinationEnricher: &fakeDestinationEnricher{},
+		})
+		collector = newFakeCollector(limitsFixture(), CollectorConfig{
+			MaxServices:               2,
+			MaxDestinationsPerService: 2,
+			DestinationEnricher:       &fakeDestinationEnricher{},
+		})
+	)
+
+	metrics := collectMetrics(t, &collector)
+
+	// the total keeps counting all of the services
+	require.Len(t, metrics["ipvs_services_total"], 1)
+	assert.Equal(t, float64(3), metrics["ipvs_services_total"][0].GetGauge().GetValue())
+
+	// services are kept in the order of their labels
+	var services []string
+	for _, metric := range metrics["ipvs_service_info"] {
+		services = append(services, metricLabels(metric)["address"])
+	}
+	assert.ElementsMatch(t, []string{"10.0.0.1", "10.0.0.3"}, services)
+
+	var (
+		weights       = map[string]float64{}
+		totals        = map[string]float64{}
+		overflowConns float64
+	)
+
+	for _, metric := range metrics["ipvs_destination_weight"] {
+		labels := metricLabels(metric)
+		if labels["address"] == overflowAddress {
+			assert.Equal(t, "", labels["task_id"])
+		}
+
+		weights[labels["address"]] = metric.GetGauge().GetValue()
+	}
+
+	for _, metric := range metrics["ipvs_destination_active_connections_total"] {
+		if metricLabels(metric)["address"] == overflowAddress {
+			overflowConns = metric.GetGauge().GetValue()
+		}
+	}
+
+	for _, metric := range metrics["ipvs_destination_total"] {
+		totals[metricLabels(metric)["address"]] = metric.GetGauge().GetValue()
+	}
+
+	// the destinations beyond the limit (by address) are
+	// rolled up
+	assert.Equal(t, map[string]float64{
+		"10.255.0.5":    2,
+		"10.255.0.6":    4,
+		overflowAddress: 4,
+		"10.255.0.9":    1,
+	}, weights)
+	assert.Equal(t, float64(40), overflowConns)
+	assert.Equal(t, map[string]float64{"10.0.0.1": 4, "10.0.0.3": 1}, totals)
+
+	// the series left out are those of the service dropped and
+	// of the destinations rolled up (which stand for as many
+	// series as the overflow ones).
+	var (
+		overflowSeries int
+		expected       = countSeries(t, &unlimited) - countSeries(t, &collector)
+	)
+
+	for _, metrics := range metrics {
+		for _, metric := range metrics {
+			if metricLabels(metric)["address"] == overflowAddress {
+				overflowSeries++
+			}
+		}
+	}
+	expected += overflowSeries
+
+	metrics = collectMetrics(t, &collector)
+	require.Len(t, metrics["ipvs_series_dropped_total"], 1)
+
+	// three scrapes so far
+	assert.Equal(t, float64(3*expected),
+		metrics["ipvs_series_dropped_total"][0].GetCounter().GetValue())
+}
+
+func TestCollectorWithoutLimits(t *testing.T) {
+	collector := newFakeCollector(limitsFixture(), CollectorConfig{})
+
+	metrics := collectMetrics(t, &collector)
+
+	assert.NotContains(t, metrics, "ipvs_series_dropped_total")
+	assert.Len(t, metrics["ipvs_service_info"], 3)
+	assert.Len(t, metrics["ipvs_destination_weight"], 6)
+}
+
+func TestCollectorNegativeLimits(t *testing.T) {
+	var collector Collector
+
+	err := collector.initDescriptors(CollectorConfig{MaxDestinationsPerService: -1})
+	assert.Error(t, err)
+}
+
+func TestAggregateConnTableOverflow(t *testing.T) {
+	var (
+		dest5 = &libipvs.Destination{Address: net.IPv4(10, 255, 0, 5).To4()}
+		dest6 = &libipvs.Destination{Address: net.IPv4(10, 255, 0, 6).To4()}
+
+		collector = Collector{maxDestinationsPerService: 1}
+		ingress   = collector.rollUp(&ServiceInfo{
+			Service: &libipvs.Service{
+				AddressFamily: syscall.AF_INET,
+				FWMark:        260,
+			},
+			destinationPort:    30000,
+			destinationServers: []*libipvs.Destination{dest6, dest5},
+		})
+	)
+
+	conns, err := parseConnTable(strings.NewReader(connTable))
+	require.NoError(t, err)
+
+	res := aggregateConnTable([]*ServiceInfo{ingress}, conns)
+	require.Len(t, res, 1)
+
+	assert.Equal(t, map[*libipvs.Destination]map[string]uint64{
+		dest5:                       {"ESTABLISHED": 2},
+		ingress.overflowDestination: {"TIME_WAIT": 1},
+	}, res[ingress].destinations)
+}
+
+func TestCollectorLimitsWithRefreshInterval(t *testing.T) {
+	var (
+		cfg = CollectorConfig{
+			MaxServices:               2,
+			MaxDestinationsPerService: 2,
+		}
+		scraped = newFakeCollector(limitsFixture(), cfg)
+	)
+
+	metrics := collectMetrics(t, &scraped)
+	require.Len(t, metrics["ipvs_series_dropped_total"], 1)
+	dropped := metrics["ipvs_series_dropped_total"][0].GetCounter().GetValue()
+	require.NotZero(t, dropped)
+
+	cfg.RefreshInterval = time.Hour
+	polled := newFakeCollector(limitsFixture(), cfg)
+	polled.snapshots.set(polled.gather())
+
+	// the series are only counted once per gathering, no
+	// matter how many scrapes serve them.
+	for i := 0; i < 3; i++ {
+		metrics = collectMetrics(t, &polled)
+	}
+
+	require.Len(t, metrics["ipvs_series_dropped_total"], 1)
+	assert.Equal(t, dropped,
+		metrics["ipvs_series_dropped_total"][0].GetCounter().GetValue())
+}
@@ -0,0 +1,57 @@
+package collector
+
+import (
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// ExpandNamespacePaths expands the glob patterns (e.g.,
+// "/var/run/docker/netns/lb_*") in a list of network
+// namespace paths, removing duplicates.
+//
+// Paths without any pattern are kept as they are, even if
+// they don't exist, so that NewCollector reports them.
+func ExpandNamespacePaths(patterns []string) (paths []string, err error) {
+	var seen = map[string]bool{}
+
+	for _, pattern := range patterns {
+		var matches []string
+
+		matches, err = filepath.Glob(pattern)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"malformed namespace path pattern %s",
+				pattern)
+			return
+		}
+
+		if len(matches) == 0 && !hasMeta(pattern) {
+			matches = []string{pattern}
+		}
+
+		for _, match := range matches {
+			if seen[match] {
+				continue
+			}
+
+			seen[match] = true
+			paths = append(paths, match)
+		}
+	}
+
+	return
+}
+
+// hasMeta indicates whether a path contains any of the special
+// characters recognized by filepath.Match.
+func hasMeta(path string) bool {
+	for _, c := range path {
+		switch c {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+
+	return false
+}
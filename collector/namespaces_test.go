@@ -0,0 +1,120 @@
+package collector
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandNamespacePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipvs-exporter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"ingress_sbox", "lb_abc", "lb_def", "1-xyz"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+
+	var testCases = []struct {
+		desc     string
+		patterns []string
+		expected []string
+	}{
+		{
+			desc:     "nothing",
+			patterns: nil,
+			expected: nil,
+		},
+		{
+			desc:     "plain path",
+			patterns: []string{filepath.Join(dir, "ingress_sbox")},
+			expected: []string{filepath.Join(dir, "ingress_sbox")},
+		},
+		{
+			desc:     "inexistent plain path",
+			patterns: []string{filepath.Join(dir, "inexistent")},
+			expected: []string{filepath.Join(dir, "inexistent")},
+		},
+		{
+			desc:     "pattern without matches",
+			patterns: []string{filepath.Join(dir, "nope_*")},
+			expected: nil,
+		},
+		{
+			desc: "pattern and plain path",
+			patterns: []string{
+				filepath.Join(dir, "ingress_sbox"),
+				filepath.Join(dir, "lb_*"),
+			},
+			expected: []string{
+				filepath.Join(dir, "ingress_sbox"),
+				filepath.Join(dir, "lb_abc"),
+				filepath.Join(dir, "lb_def"),
+			},
+		},
+		{
+			desc: "duplicates",
+			patterns: []string{
+				filepath.Join(dir, "lb_abc"),
+				filepath.Join(dir, "lb_*"),
+			},
+			expected: []string{
+				filepath.Join(dir, "lb_abc"),
+				filepath.Join(dir, "lb_def"),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			paths, err := ExpandNamespacePaths(tc.patterns)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, paths)
+		})
+	}
+
+	_, err = ExpandNamespacePaths([]string{"[malformed"})
+	assert.Error(t, err)
+}
+
+func TestMultipleNamespaces(t *testing.T) {
+	var (
+		registry = prometheus.NewRegistry()
+		healthy  = newFakeCollector(&fakeIPVSHandle{}, CollectorConfig{
+			NamespacePath: "/var/run/docker/netns/ingress_sbox",
+		})
+		broken = newFakeCollector(&fakeIPVSHandle{
+			servicesErr: errors.New("netlink failure"),
+		}, CollectorConfig{
+			NamespacePath: "/var/run/docker/netns/lb_abc",
+		})
+	)
+
+	require.NoError(t, registry.Register(&healthy))
+	require.NoError(t, registry.Register(&broken))
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	var up = map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "ipvs_up" {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			up[metricLabels(metric)["namespace"]] = metric.GetGauge().GetValue()
+		}
+	}
+
+	assert.Equal(t, map[string]float64{
+		"/var/run/docker/netns/ingress_sbox": 1,
+		"/var/run/docker/netns/lb_abc":       0,
+	}, up)
+}
@@ -0,0 +1,410 @@
+package collector
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/mqliang/libipvs"
+	"github.com/pkg/errors"
+)
+
+// ipvsTablePath is the path to the ipvs table of the
+// network namespace of the calling thread (see connTablePath).
+const ipvsTablePath = "/proc/thread-self/net/ip_vs"
+
+// procfsSource is a Source that retrieves ipvs information
+// by parsing `/proc/net/ip_vs`, which is useful in hosts
+// where generic netlink can't be used.
+//
+// The table carries neither stats nor thresholds (and the
+// persistence timeouts that it carries are in jiffies), thus,
+// the source is not detailed. It doesn't carry the address
+// family of fwmark-based services either: it's taken from
+// their destinations, being left unspecified (AF_UNSPEC) for
+// services without any so that the collector resolves it from
+// the mappings of their fwmarks.
+type procfsSource struct {
+	path string
+
+	// destinations holds the destinations of the services
+	// from the last parse of the table so that the table
+	// doesn't need to be parsed for each service.
+	destinations map[*libipvs.Service][]*libipvs.Destination
+	sync.Mutex
+}
+
+// newProcfsSource creates a procfs Source that reads the
+// table at the given path.
+func newProcfsSource(path string) (source Source) {
+	source = &procfsSource{
+		path:         path,
+		destinations: map[*libipvs.Service][]*libipvs.Destination{},
+	}
+	return
+}
+
+// Detailed is false for procfs given that `/proc/net/ip_vs`
+// doesn't carry stats, thresholds or persistent connections
+// (and shows persistence timeouts in jiffies).
+func (s *procfsSource) Detailed() bool {
+	return false
+}
+
+// Close does nothing as the table is opened on each read.
+func (s *procfsSource) Close() {}
+
+// ListServices parses the ipvs table, keeping the destinations
+// of the services for subsequent ListDestinations calls.
+func (s *procfsSource) ListServices() (services []*libipvs.Service, err error) {
+	destinations, err := s.read()
+	if err != nil {
+		return
+	}
+
+	for service := range destinations {
+		services = append(services, service)
+	}
+
+	s.Lock()
+	s.destinations = destinations
+	s.Unlock()
+
+	return
+}
+
+// ListDestinations retrieves the destinations of a service as
+// seen in the last parse of the table.
+//
+// In case a concurrent ListServices already replaced them, the
+// table is parsed again and the service looked up by what
+// identifies it.
+func (s *procfsSource) ListDestinations(service *libipvs.Service) (res []*libipvs.Destination, err error) {
+	s.Lock()
+	res, ok := s.destinations[service]
+	s.Unlock()
+
+	if ok {
+		return
+	}
+
+	destinations, err := s.read()
+	if err != nil {
+		return
+	}
+
+	for candidate, candidateDestinations := range destinations {
+		if serviceKey(candidate) == serviceKey(service) {
+			res = candidateDestinations
+			return
+		}
+	}
+
+	err = errors.Errorf("service %s not found in %s",
+		serviceKey(service), s.path)
+	return
+}
+
+// read opens and parses the ipvs table.
+func (s *procfsSource) read() (destinations map[*libipvs.Service][]*libipvs.Destination, err error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"failed to open ipvs table %s",
+			s.path)
+		return
+	}
+	defer file.Close()
+
+	destinations, err = parseIPVSTable(file)
+	return
+}
+
+// serviceKey creates a key that uniquely identifies a service.
+func serviceKey(service *libipvs.Service) string {
+	if service.FWMark != 0 {
+		return fmt.Sprintf("%s|fwmark|%d",
+			service.AddressFamily, service.FWMark)
+	}
+
+	return fmt.Sprintf("%s|%s|%s|%d",
+		service.AddressFamily, service.Protocol,
+		service.Address, service.Port)
+}
+
+// parseIPVSTable parses the contents of `/proc/net/ip_vs`,
+// which looks like the following:
+//
+//	IP Virtual Server version 1.2.1 (size=4096)
+//	Prot LocalAddress:Port Scheduler Flags
+//	  -> RemoteAddress:Port Forward Weight ActiveConn InActConn
+//	TCP  0A00000A:0050 rr persistent 75000 FFFFFFFF
+//	  -> 0AFF0005:0050      Masq    1      0          0
+//	FWM  00000104 wlc
+//	  -> 0AFF0006:0000      Masq    1      3          10
+//
+// where IPv4 addresses are in hexadecimal and IPv6 addresses
+// are in their full form, between brackets.
+func parseIPVSTable(r io.Reader) (destinations map[*libipvs.Service][]*libipvs.Destination, err error) {
+	var (
+		scanner = bufio.NewScanner(r)
+		service *libipvs.Service
+		line    int
+	)
+
+	destinations = map[*libipvs.Service][]*libipvs.Destination{}
+
+	for scanner.Scan() {
+		line++
+		if line <= 3 {
+			continue
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] != "->" {
+			service, err = parseIPVSService(fields)
+			if err != nil {
+				err = errors.Wrapf(err,
+					"malformed service at line %d",
+					line)
+				return
+			}
+
+			destinations[service] = nil
+			continue
+		}
+
+		if service == nil {
+			err = errors.Errorf(
+				"destination without service at line %d",
+				line)
+			return
+		}
+
+		var destination *libipvs.Destination
+		destination, err = parseIPVSDestination(fields)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"malformed destination at line %d",
+				line)
+			return
+		}
+
+		// the address family of fwmark-based services is
+		// not shown, thus, it's taken from the destinations
+		// (see procfsSource).
+		if service.FWMark != 0 {
+			service.AddressFamily = destination.AddressFamily
+		}
+
+		destinations[service] = append(destinations[service], destination)
+	}
+
+	err = scanner.Err()
+	return
+}
+
+// parseIPVSService parses the fields of a service line of the
+// ipvs table.
+func parseIPVSService(fields []string) (service *libipvs.Service, err error) {
+	if len(fields) < 3 {
+		err = errors.Errorf("expected at least 3 fields, got %d",
+			len(fields))
+		return
+	}
+
+	service = &libipvs.Service{
+		AddressFamily: syscall.AF_INET,
+		SchedName:     fields[2],
+		Flags: libipvs.Flags{
+			// services in the table are always hashed
+			Flags: libipvs.IP_VS_SVC_F_HASHED,
+			Mask:  ^uint32(0),
+		},
+	}
+
+	switch fields[0] {
+	case "FWM":
+		var fwmark uint64
+
+		fwmark, err = strconv.ParseUint(fields[1], 16, 32)
+		if err != nil {
+			err = errors.Wrapf(err, "invalid fwmark %s", fields[1])
+			return
+		}
+
+		service.FWMark = uint32(fwmark)
+		// unknown until a destination shows up (see
+		// parseIPVSTable)
+		service.AddressFamily = syscall.AF_UNSPEC
+	case "TCP", "UDP", "SCTP":
+		service.Protocol = map[string]libipvs.Protocol{
+			"TCP":  syscall.IPPROTO_TCP,
+			"UDP":  syscall.IPPROTO_UDP,
+			"SCTP": syscall.IPPROTO_SCTP,
+		}[fields[0]]
+
+		service.Address, service.Port, err = parseIPVSAddressPort(fields[1])
+		if err != nil {
+			return
+		}
+
+		if service.Address.To4() == nil {
+			service.AddressFamily = syscall.AF_INET6
+		}
+	default:
+		err = errors.Errorf("unknown protocol %s", fields[0])
+		return
+	}
+
+	for i := 3; i < len(fields); i++ {
+		switch fields[i] {
+		case "ops":
+			service.Flags.Flags |= libipvs.IP_VS_SVC_F_ONEPACKET
+		case "persistent":
+			if i+2 >= len(fields) {
+				err = errors.Errorf("incomplete persistence settings")
+				return
+			}
+
+			var netmask uint64
+
+			// the timeout is shown in jiffies (`timeout *
+			// HZ`), with HZ not being known to userspace,
+			// thus, it's left out (see Detailed)
+			_, err = strconv.ParseUint(fields[i+1], 10, 32)
+			if err != nil {
+				err = errors.Wrapf(err, "invalid timeout %s", fields[i+1])
+				return
+			}
+
+			netmask, err = strconv.ParseUint(fields[i+2], 16, 32)
+			if err != nil {
+				err = errors.Wrapf(err, "invalid netmask %s", fields[i+2])
+				return
+			}
+
+			service.Flags.Flags |= libipvs.IP_VS_SVC_F_PERSISTENT
+			service.Netmask = uint32(netmask)
+			i += 2
+		}
+	}
+
+	// the netmask is shown in host byte order (`ntohl`) while
+	// libipvs keeps it as read from netlink (see formatNetmask).
+	var b [4]byte
+
+	binary.BigEndian.PutUint32(b[:], service.Netmask)
+	service.Netmask = *(*uint32)(unsafe.Pointer(&b))
+
+	return
+}
+
+// ipvsForwardMethods maps the names of the forwarding methods
+// as shown in the ipvs table to their values.
+var ipvsForwardMethods = map[string]libipvs.FwdMethod{
+	"Masq":   libipvs.IP_VS_CONN_F_MASQ,
+	"Local":  libipvs.IP_VS_CONN_F_LOCALNODE,
+	"Tunnel": libipvs.IP_VS_CONN_F_TUNNEL,
+	"Route":  libipvs.IP_VS_CONN_F_DROUTE,
+	"Bypass": libipvs.IP_VS_CONN_F_BYPASS,
+}
+
+// parseIPVSDestination parses the fields of a destination
+// line of the ipvs table.
+func parseIPVSDestination(fields []string) (destination *libipvs.Destination, err error) {
+	if len(fields) != 6 {
+		err = errors.Errorf("expected 6 fields, got %d",
+			len(fields))
+		return
+	}
+
+	destination = &libipvs.Destination{
+		AddressFamily: syscall.AF_INET,
+	}
+
+	destination.Address, destination.Port, err = parseIPVSAddressPort(fields[1])
+	if err != nil {
+		return
+	}
+
+	if destination.Address.To4() == nil {
+		destination.AddressFamily = syscall.AF_INET6
+	}
+
+	fwdMethod, ok := ipvsForwardMethods[fields[2]]
+	if !ok {
+		err = errors.Errorf("unknown forwarding method %s", fields[2])
+		return
+	}
+	destination.FwdMethod = fwdMethod
+
+	values := []*uint32{
+		&destination.Weight, &destination.ActiveConns, &destination.InactConns,
+	}
+	for i, value := range values {
+		var v uint64
+
+		v, err = strconv.ParseUint(fields[3+i], 10, 32)
+		if err != nil {
+			err = errors.Wrapf(err, "invalid number %s", fields[3+i])
+			return
+		}
+
+		*value = uint32(v)
+	}
+
+	return
+}
+
+// parseIPVSAddressPort parses addresses in the form of
+// `0A000001:0050` (IPv4) or `[fd00:0000:...:0001]:0050` (IPv6).
+func parseIPVSAddressPort(field string) (ip net.IP, port uint16, err error) {
+	ndx := strings.LastIndex(field, ":")
+	if ndx == -1 {
+		err = errors.Errorf("invalid address %s", field)
+		return
+	}
+
+	address, portField := field[:ndx], field[ndx+1:]
+
+	if strings.HasPrefix(address, "[") && strings.HasSuffix(address, "]") {
+		ip = net.ParseIP(address[1 : len(address)-1])
+		if ip == nil {
+			err = errors.Errorf("invalid ipv6 address %s", address)
+			return
+		}
+	} else {
+		var b []byte
+
+		b, err = hex.DecodeString(address)
+		if err != nil || len(b) != net.IPv4len {
+			err = errors.Errorf("invalid ipv4 address %s", address)
+			return
+		}
+
+		ip = net.IP(b)
+	}
+
+	p, err := strconv.ParseUint(portField, 16, 16)
+	if err != nil {
+		err = errors.Wrapf(err, "invalid port %s", portField)
+		return
+	}
+
+	port = uint16(p)
+	return
+}
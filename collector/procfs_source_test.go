@@ -0,0 +1,248 @@
+package collector
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/cirocosta/ingress_ipvs_exporter/mapper"
+	"github.com/mqliang/libipvs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// servicesByKey indexes the services of a parsed table
+// by their keys (see serviceKey).
+func servicesByKey(destinations map[*libipvs.Service][]*libipvs.Destination) (services map[string]*libipvs.Service) {
+	services = map[string]*libipvs.Service{}
+	for service := range destinations {
+		services[serviceKey(service)] = service
+	}
+
+	return
+}
+
+func TestParseIPVSTable(t *testing.T) {
+	file, err := os.Open("testdata/ip_vs")
+	require.NoError(t, err)
+	defer file.Close()
+
+	destinations, err := parseIPVSTable(file)
+	require.NoError(t, err)
+	require.Len(t, destinations, 7)
+
+	services := servicesByKey(destinations)
+
+	persistent := services["inet|tcp|10.0.0.10|30000"]
+	require.NotNil(t, persistent)
+	assert.Equal(t, "rr", persistent.SchedName)
+	assert.Equal(t, "persistent,hashed", formatServiceFlags(persistent.Flags.Flags))
+	// `-p 300` is shown as 75000 jiffies with HZ=250,
+	// which can't be told from userspace
+	assert.Zero(t, persistent.Timeout)
+	assert.Equal(t, "255.255.255.0",
+		formatNetmask(persistent.AddressFamily, persistent.Netmask))
+	require.Len(t, destinations[persistent], 2)
+	assert.Equal(t, &libipvs.Destination{
+		AddressFamily: syscall.AF_INET,
+		Address:       net.IPv4(10, 255, 0, 5).To4(),
+		Port:          80,
+		FwdMethod:     libipvs.IP_VS_CONN_F_MASQ,
+		Weight:        1,
+		ActiveConns:   2,
+		InactConns:    10,
+	}, destinations[persistent][0])
+	assert.Equal(t, libipvs.FwdMethod(libipvs.IP_VS_CONN_F_DROUTE), destinations[persistent][1].FwdMethod)
+	assert.Equal(t, uint32(0), destinations[persistent][1].Weight)
+
+	noDestinations := services["inet|tcp|10.0.0.11|80"]
+	require.NotNil(t, noDestinations)
+	assert.Empty(t, destinations[noDestinations])
+
+	onePacket := services["inet|udp|10.0.0.20|53"]
+	require.NotNil(t, onePacket)
+	assert.Equal(t, "wlc", onePacket.SchedName)
+	assert.Equal(t, "hashed,ops", formatServiceFlags(onePacket.Flags.Flags))
+	require.Len(t, destinations[onePacket], 1)
+	assert.Equal(t, libipvs.FwdMethod(libipvs.IP_VS_CONN_F_TUNNEL), destinations[onePacket][0].FwdMethod)
+	assert.Equal(t, uint32(3), destinations[onePacket][0].Weight)
+
+	fwmark := services["inet|fwmark|260"]
+	require.NotNil(t, fwmark)
+	require.Len(t, destinations[fwmark], 1)
+	assert.Equal(t, uint32(4), destinations[fwmark][0].ActiveConns)
+	assert.Equal(t, uint32(7), destinations[fwmark][0].InactConns)
+
+	fwmark6 := services["inet6|fwmark|261"]
+	require.NotNil(t, fwmark6)
+	require.Len(t, destinations[fwmark6], 1)
+	assert.Equal(t, "fd00::5", destinations[fwmark6][0].Address.String())
+
+	// without destinations, the family can't be told
+	unresolved := services["0|fwmark|262"]
+	require.NotNil(t, unresolved)
+	assert.Equal(t, syscall.AF_UNSPEC, int(unresolved.AddressFamily))
+	assert.Empty(t, destinations[unresolved])
+
+	service6 := services["inet6|tcp|fd00::a|443"]
+	require.NotNil(t, service6)
+	assert.Equal(t, "lc", service6.SchedName)
+	require.Len(t, destinations[service6], 1)
+	assert.Equal(t, syscall.AF_INET6, int(destinations[service6][0].AddressFamily))
+	assert.Equal(t, "fd00::6", destinations[service6][0].Address.String())
+	assert.Equal(t, uint16(443), destinations[service6][0].Port)
+	assert.Equal(t, libipvs.FwdMethod(libipvs.IP_VS_CONN_F_LOCALNODE), destinations[service6][0].FwdMethod)
+}
+
+func TestParseIPVSTableMalformed(t *testing.T) {
+	const header = "IP Virtual Server version 1.2.1 (size=4096)\n" +
+		"Prot LocalAddress:Port Scheduler Flags\n" +
+		"  -> RemoteAddress:Port Forward Weight ActiveConn InActConn\n"
+
+	var testCases = []struct {
+		desc  string
+		table string
+	}{
+		{
+			desc:  "unknown protocol",
+			table: header + "ICMP 0A00000A:0050 rr\n",
+		},
+		{
+			desc:  "invalid address",
+			table: header + "TCP  0A00:0050 rr\n",
+		},
+		{
+			desc:  "incomplete persistence",
+			table: header + "TCP  0A00000A:0050 rr persistent 300\n",
+		},
+		{
+			desc:  "destination without service",
+			table: header + "  -> 0AFF0005:0050      Masq    1      0          0\n",
+		},
+		{
+			desc: "unknown forwarding method",
+			table: header + "TCP  0A00000A:0050 rr\n" +
+				"  -> 0AFF0005:0050      Nat     1      0          0\n",
+		},
+		{
+			desc: "missing counts",
+			table: header + "TCP  0A00000A:0050 rr\n" +
+				"  -> 0AFF0005:0050      Masq    1\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := parseIPVSTable(strings.NewReader(tc.table))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestProcfsSource(t *testing.T) {
+	source := newProcfsSource("testdata/ip_vs")
+	assert.False(t, source.Detailed())
+
+	services, err := source.ListServices()
+	require.NoError(t, err)
+	require.Len(t, services, 7)
+
+	for _, service := range services {
+		_, err := source.ListDestinations(service)
+		assert.NoError(t, err)
+	}
+
+	// services that didn't come from the last listing are
+	// looked up by what identifies them.
+	destinations, err := source.ListDestinations(&libipvs.Service{
+		AddressFamily: syscall.AF_INET,
+		Protocol:      syscall.IPPROTO_TCP,
+		Address:       net.IPv4(10, 0, 0, 10).To4(),
+		Port:          30000,
+	})
+	require.NoError(t, err)
+	assert.Len(t, destinations, 2)
+
+	_, err = source.ListDestinations(&libipvs.Service{
+		AddressFamily: syscall.AF_INET,
+		Protocol:      syscall.IPPROTO_TCP,
+		Address:       net.IPv4(10, 0, 0, 99).To4(),
+		Port:          80,
+	})
+	assert.Error(t, err)
+
+	_, err = newProcfsSource("testdata/inexistent").ListServices()
+	assert.Error(t, err)
+}
+
+func TestCollectorProcfsSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipvs-exporter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "ip_vs")
+	require.NoError(t, ioutil.WriteFile(path, []byte(
+		"IP Virtual Server version 1.2.1 (size=4096)\n"+
+			"Prot LocalAddress:Port Scheduler Flags\n"+
+			"  -> RemoteAddress:Port Forward Weight ActiveConn InActConn\n"+
+			"TCP  0A00000A:0050 rr\n"+
+			"  -> 0AFF0005:0050      Masq    1      2          10\n"), 0644))
+
+	collector := newFakeCollector(newProcfsSource(path), CollectorConfig{})
+	metrics := collectMetrics(t, &collector)
+
+	require.Len(t, metrics["ipvs_up"], 1)
+	assert.Equal(t, float64(1), metrics["ipvs_up"][0].GetGauge().GetValue())
+
+	require.Len(t, metrics["ipvs_destination_active_connections_total"], 1)
+	assert.Equal(t, float64(2),
+		metrics["ipvs_destination_active_connections_total"][0].GetGauge().GetValue())
+	assert.Len(t, metrics["ipvs_service_info"], 1)
+	assert.Len(t, metrics["ipvs_destination_weight"], 1)
+
+	assert.Empty(t, metrics["ipvs_connections_total"])
+	assert.Empty(t, metrics["ipvs_destination_bytes_in_total"])
+	assert.Empty(t, metrics["ipvs_destination_upper_threshold_connections"])
+}
+
+func TestCollectorProcfsSourceFWMarkFamilies(t *testing.T) {
+	collector := newFakeCollector(newProcfsSource("testdata/ip_vs"), CollectorConfig{})
+	collector.getMappings = func() (map[mapper.Family]map[uint32][]mapper.Mapping, error) {
+		return map[mapper.Family]map[uint32][]mapper.Mapping{
+			mapper.IPv4: {
+				260: {{Protocol: syscall.IPPROTO_TCP, Ports: []mapper.PortRange{{From: 80, To: 80}}}},
+			},
+			mapper.IPv6: {
+				261: {{Protocol: syscall.IPPROTO_TCP, Ports: []mapper.PortRange{{From: 443, To: 443}}}},
+				262: {{Protocol: syscall.IPPROTO_UDP, Ports: []mapper.PortRange{{From: 53, To: 53}}}},
+			},
+		}, nil
+	}
+
+	metrics := collectMetrics(t, &collector)
+
+	families := map[string]string{}
+	for _, metric := range metrics["ipvs_service_info"] {
+		labels := metricLabels(metric)
+		if labels["fwmark"] != "" {
+			families[labels["fwmark"]] = labels["family"]
+		}
+	}
+
+	// the family of the service without destinations comes
+	// from the mappings of its fwmark
+	assert.Equal(t, map[string]string{
+		"260": "inet",
+		"261": "inet6",
+		"262": "inet6",
+	}, families)
+
+	for _, metric := range metrics["ipvs_scrape_errors_total"] {
+		assert.Equal(t, float64(0), metric.GetCounter().GetValue(),
+			metricLabels(metric)["stage"])
+	}
+}
@@ -0,0 +1,158 @@
+package collector
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netns"
+)
+
+// Reasons for reopening the handles, as reported in the `reason`
+// label of the `ipvs_reopens_total` metric.
+const (
+	reopenReasonNamespaceChanged = "namespace_changed"
+	reopenReasonError            = "error"
+)
+
+// nsInode identifies a network namespace by the device and
+// inode of its nsfs file.
+//
+// When docker recreates a sandbox, the path to its namespace
+// (e.g., `/var/run/docker/netns/ingress_sbox`) stays the same
+// while the inode changes.
+type nsInode struct {
+	dev uint64
+	ino uint64
+}
+
+// pathInode retrieves the inode of the namespace bind-mounted
+// at `path`.
+func pathInode(path string) (inode nsInode, err error) {
+	var stat syscall.Stat_t
+
+	err = syscall.Stat(path, &stat)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"failed to stat namespace path %s",
+			path)
+		return
+	}
+
+	inode = nsInode{dev: uint64(stat.Dev), ino: stat.Ino}
+	return
+}
+
+// handleInode retrieves the inode of the namespace that
+// `nsHandle` refers to.
+func handleInode(nsHandle netns.NsHandle) (inode nsInode, err error) {
+	var stat syscall.Stat_t
+
+	err = syscall.Fstat(int(nsHandle), &stat)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"failed to stat namespace handle")
+		return
+	}
+
+	inode = nsInode{dev: uint64(stat.Dev), ino: stat.Ino}
+	return
+}
+
+// openHandles opens the namespace at `namespacePath` (if any)
+// and creates the ipvs source within it.
+func (c *Collector) openHandles() (nsHandle *netns.NsHandle, inode nsInode, source Source, err error) {
+	if c.namespacePath != "" {
+		var handle netns.NsHandle
+
+		handle, err = netns.GetFromPath(c.namespacePath)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"failed to retrieve ns from path %s",
+				c.namespacePath)
+			return
+		}
+
+		nsHandle = &handle
+
+		inode, err = handleInode(handle)
+		if err != nil {
+			nsHandle.Close()
+			return
+		}
+	}
+
+	getIpvsHandle := func() (err error) {
+		source, err = c.newSource()
+		if err != nil {
+			err = errors.Wrapf(err,
+				"failed to create ipvs handle for namespace path")
+			return
+		}
+
+		return
+	}
+
+	if nsHandle != nil {
+		err = runInNetns(*nsHandle, getIpvsHandle)
+	} else {
+		err = getIpvsHandle()
+	}
+	if err != nil {
+		err = errors.Wrapf(err,
+			"failed to retrieve ipvs handle")
+		if nsHandle != nil {
+			nsHandle.Close()
+		}
+		return
+	}
+
+	return
+}
+
+// namespaceChanged indicates whether the namespace at
+// `namespacePath` is not the one that the collector has
+// a handle to anymore.
+//
+// Namespaces that can't be inspected (e.g., removed) are
+// not considered changed.
+func (c *Collector) namespaceChanged() bool {
+	if c.namespacePath == "" {
+		return false
+	}
+
+	inode, err := pathInode(c.namespacePath)
+	if err != nil {
+		return false
+	}
+
+	return inode != c.nsInode
+}
+
+// reopen replaces the namespace and ipvs handles by new ones,
+// keeping the current ones in case it fails (or the collector
+// got closed).
+//
+// The caller must hold `handlesMutex`.
+func (c *Collector) reopen(reason string) (err error) {
+	if c.closed {
+		err = errors.New("collector closed")
+		return
+	}
+
+	nsHandle, inode, source, err := c.openHandles()
+	if err != nil {
+		err = errors.Wrapf(err,
+			"failed to reopen handles")
+		return
+	}
+
+	c.closeHandles()
+	c.nsHandle, c.nsInode, c.ipvs = nsHandle, inode, source
+
+	c.reopens.WithLabelValues(reason).Inc()
+	c.logger.Info().
+		Str("reason", reason).
+		Msg("reopened namespace and ipvs handles")
+
+	return
+}
@@ -0,0 +1,137 @@
+package collector
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/mqliang/libipvs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reopenCounts indexes the values of `ipvs_reopens_total`
+// by reason.
+func reopenCounts(t *testing.T, collector *Collector) (counts map[string]float64) {
+	counts = map[string]float64{}
+	for _, metric := range collectMetrics(t, collector)["ipvs_reopens_total"] {
+		counts[metricLabels(metric)["reason"]] = metric.GetCounter().GetValue()
+	}
+
+	return
+}
+
+func TestCollectorReopensOnError(t *testing.T) {
+	var (
+		broken = &fakeIPVSHandle{
+			servicesErr: errors.New("netlink failure"),
+		}
+		healthy = &fakeIPVSHandle{
+			services: []*libipvs.Service{{
+				Protocol: syscall.IPPROTO_TCP,
+				Address:  net.ParseIP("10.0.0.1"),
+				Port:     80,
+			}},
+		}
+		collector = newFakeCollector(broken, CollectorConfig{})
+	)
+
+	collector.newSource = func() (Source, error) {
+		return healthy, nil
+	}
+
+	metrics := collectMetrics(t, &collector)
+	require.Len(t, metrics["ipvs_up"], 1)
+	assert.Equal(t, float64(0), metrics["ipvs_up"][0].GetGauge().GetValue())
+	assert.True(t, broken.closed)
+
+	metrics = collectMetrics(t, &collector)
+	require.Len(t, metrics["ipvs_up"], 1)
+	assert.Equal(t, float64(1), metrics["ipvs_up"][0].GetGauge().GetValue())
+	require.Len(t, metrics["ipvs_services_total"], 1)
+	assert.Equal(t, float64(1), metrics["ipvs_services_total"][0].GetGauge().GetValue())
+
+	assert.Equal(t, map[string]float64{
+		"namespace_changed": 0,
+		"error":             1,
+	}, reopenCounts(t, &collector))
+}
+
+func TestCollectorKeepsHandlesIfReopenFails(t *testing.T) {
+	var (
+		broken = &fakeIPVSHandle{
+			servicesErr: errors.New("netlink failure"),
+		}
+		collector = newFakeCollector(broken, CollectorConfig{})
+	)
+
+	collector.newSource = func() (Source, error) {
+		return nil, errors.New("no ipvs")
+	}
+
+	metrics := collectMetrics(t, &collector)
+	require.Len(t, metrics["ipvs_up"], 1)
+	assert.Equal(t, float64(0), metrics["ipvs_up"][0].GetGauge().GetValue())
+	assert.False(t, broken.closed)
+	assert.Equal(t, broken, collector.ipvs)
+	assert.Equal(t, float64(0), reopenCounts(t, &collector)["error"])
+}
+
+func TestCollectorNamespaceChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipvs-exporter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var (
+		path      = filepath.Join(dir, "ingress_sbox")
+		collector = newFakeCollector(&fakeIPVSHandle{}, CollectorConfig{})
+	)
+
+	assert.False(t, collector.namespaceChanged())
+
+	require.NoError(t, ioutil.WriteFile(path, nil, 0644))
+	collector.namespacePath = path
+	collector.nsInode, err = pathInode(path)
+	require.NoError(t, err)
+	assert.False(t, collector.namespaceChanged())
+
+	// recreating the file gives it a new inode
+	require.NoError(t, ioutil.WriteFile(path+".new", nil, 0644))
+	require.NoError(t, os.Rename(path+".new", path))
+	assert.True(t, collector.namespaceChanged())
+
+	require.NoError(t, os.Remove(path))
+	assert.False(t, collector.namespaceChanged())
+}
+
+func TestCollectorFollowsRecreatedNamespace(t *testing.T) {
+	var namespacePath = "/var/run/netns/" + ipvsNamespace
+
+	require.NoError(t, createNamespace(ipvsNamespace))
+	defer deleteNamespace(ipvsNamespace)
+	require.NoError(t, setupIPVSInNamespace(ipvsNamespace))
+
+	collector, err := NewCollector(CollectorConfig{
+		NamespacePath: namespacePath,
+	})
+	require.NoError(t, err)
+	defer collector.Close()
+
+	metrics := collectMetrics(t, &collector)
+	require.Len(t, metrics["ipvs_services_total"], 1)
+	assert.Equal(t, float64(1), metrics["ipvs_services_total"][0].GetGauge().GetValue())
+
+	// the old namespace is kept alive by the collector's
+	// handle, thus, it'd keep reporting its service.
+	require.NoError(t, deleteNamespace(ipvsNamespace))
+	require.NoError(t, createNamespace(ipvsNamespace))
+
+	metrics = collectMetrics(t, &collector)
+	require.Len(t, metrics["ipvs_services_total"], 1)
+	assert.Equal(t, float64(0), metrics["ipvs_services_total"][0].GetGauge().GetValue())
+	assert.Equal(t, float64(1), reopenCounts(t, &collector)["namespace_changed"])
+}
@@ -0,0 +1,81 @@
+package collector
+
+import (
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MetricSchemaLegacy names the metrics as they've always
+	// been named, regardless of their types.
+	MetricSchemaLegacy = "legacy"
+
+	// MetricSchemaV2 names the metrics following the Prometheus
+	// naming conventions (e.g., no `_total` suffix for gauges).
+	MetricSchemaV2 = "v2"
+
+	// DefaultMetricPrefix is the prefix of the names of all
+	// metrics unless configured otherwise.
+	DefaultMetricPrefix = "ipvs"
+)
+
+var (
+	// v2MetricNames maps the (unprefixed) legacy names of the
+	// metrics that MetricSchemaV2 renames to their new names.
+	v2MetricNames = map[string]string{
+		// gauges with counter-like names
+		"services_total":                         "services",
+		"destination_total":                      "destinations",
+		"destination_active_connections_total":   "destination_active_connections",
+		"destination_inactive_connections_total": "destination_inactive_connections",
+	}
+
+	// metricPrefixRegexp matches the prefixes that make for
+	// valid metric names.
+	metricPrefixRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+)
+
+// metricNamer names the metrics according to a schema.
+type metricNamer struct {
+	schema string
+	prefix string
+}
+
+// newMetricNamer validates a metric schema and prefix, falling
+// back to MetricSchemaLegacy and DefaultMetricPrefix when these
+// are not set.
+func newMetricNamer(schema, prefix string) (namer metricNamer, err error) {
+	switch schema {
+	case "":
+		schema = MetricSchemaLegacy
+	case MetricSchemaLegacy, MetricSchemaV2:
+	default:
+		err = errors.Errorf("unknown metric schema %s", schema)
+		return
+	}
+
+	if prefix == "" {
+		prefix = DefaultMetricPrefix
+	}
+
+	if !metricPrefixRegexp.MatchString(prefix) {
+		err = errors.Errorf("invalid metric prefix %s", prefix)
+		return
+	}
+
+	namer = metricNamer{schema: schema, prefix: prefix}
+	return
+}
+
+// name retrieves the full name of a metric given its legacy
+// name without the prefix (e.g., "services_total").
+func (n metricNamer) name(legacy string) string {
+	if n.schema == MetricSchemaV2 {
+		if renamed, ok := v2MetricNames[legacy]; ok {
+			legacy = renamed
+		}
+	}
+
+	return n.prefix + "_" + legacy
+}
@@ -0,0 +1,86 @@
+package collector
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// describe retrieves the descriptions of all the metrics that
+// a collector (with every optional metric enabled) reports.
+func describe(cfg CollectorConfig) (descs []string) {
+	cfg.NamespacePath = "/var/run/docker/netns/ingress_sbox"
+	cfg.ConnectionTable = true
+	cfg.RefreshInterval = time.Second
+
+	var (
+		collector = newFakeCollector(&fakeIPVSHandle{}, cfg)
+		ch        = make(chan *prometheus.Desc, 100)
+	)
+
+	collector.Describe(ch)
+	close(ch)
+
+	for desc := range ch {
+		descs = append(descs, desc.String())
+	}
+
+	return
+}
+
+func TestMetricSchemaLegacy(t *testing.T) {
+	expected, err := ioutil.ReadFile("testdata/legacy_descriptors")
+	require.NoError(t, err)
+
+	for _, schema := range []string{"", MetricSchemaLegacy} {
+		descs := describe(CollectorConfig{MetricSchema: schema})
+		assert.Equal(t, string(expected), strings.Join(descs, "\n")+"\n", schema)
+	}
+}
+
+func TestMetricSchemaV2(t *testing.T) {
+	var (
+		legacy = describe(CollectorConfig{})
+		v2     = describe(CollectorConfig{
+			MetricSchema: MetricSchemaV2,
+			MetricPrefix: "lb",
+		})
+	)
+
+	require.Len(t, v2, len(legacy))
+
+	for ndx, desc := range legacy {
+		var expected = strings.Replace(desc, `fqName: "ipvs_`, `fqName: "lb_`, 1)
+
+		for old, renamed := range v2MetricNames {
+			expected = strings.Replace(expected,
+				`fqName: "lb_`+old+`"`, `fqName: "lb_`+renamed+`"`, 1)
+		}
+
+		assert.Equal(t, expected, v2[ndx])
+	}
+
+	joined := strings.Join(v2, "\n")
+	for _, name := range []string{
+		"lb_services",
+		"lb_destinations",
+		"lb_destination_active_connections",
+		"lb_destination_inactive_connections",
+	} {
+		assert.Contains(t, joined, `fqName: "`+name+`"`)
+	}
+	assert.NotContains(t, joined, `_active_connections_total"`)
+}
+
+func TestMetricSchemaInvalid(t *testing.T) {
+	_, err := NewCollector(CollectorConfig{MetricSchema: "v3"})
+	assert.Error(t, err)
+
+	_, err = NewCollector(CollectorConfig{MetricPrefix: "ipvs-exporter"})
+	assert.Error(t, err)
+}
@@ -1,6 +1,11 @@
 package collector
 
 import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/cirocosta/ingress_ipvs_exporter/mapper"
 	"github.com/mqliang/libipvs"
 )
 
@@ -19,10 +24,193 @@ type ServiceInfo struct {
 
 	// destinationPort represents the port that is
 	// used in iptables as the destination port for
-	// the fwmark set by docker.
+	// the fwmark set by docker (the first one, if the
+	// fwmark is set for several).
+	//
+	// It's only set for fwmark-based services.
 	destinationPort uint16
 
+	// mappings describes the protocols and destination
+	// ports of the rules that set the fwmark.
+	//
+	// It's only set for fwmark-based services.
+	mappings []mapper.Mapping
+
+	// enrichment holds the values of the labels that a
+	// ServiceEnricher provides for the service (if any).
+	enrichment []string
+
+	// destinationEnrichment holds the values of the labels that
+	// a DestinationEnricher provides for each of the
+	// destinations (if any).
+	destinationEnrichment map[*libipvs.Destination][]string
+
+	// overflow holds the destinations that were rolled up
+	// into overflowDestination for exceeding the limit of
+	// destinations per service (see CollectorConfig).
+	overflow []*libipvs.Destination
+
+	// overflowDestination aggregates the destinations in
+	// overflow, being reported with the `__overflow__`
+	// address.
+	overflowDestination *libipvs.Destination
+
 	// Service makes ServiceInfo act as an "enhanced
 	// service" class.
 	*libipvs.Service
 }
+
+// labelValues returns the values of the labels that identify
+// the service (see `serviceLabels`) and of the labels from the
+// enricher (if any) followed by `extra`.
+func (s *ServiceInfo) labelValues(extra ...string) (res []string) {
+	res = s.identityLabelValues()
+	res = append(res, s.enrichment...)
+	res = append(res, extra...)
+	return
+}
+
+// destinationLabelValues returns the values of the labels that
+// identify a real server of the service (see `destinationLabels`)
+// and of the labels from the enrichers (if any) followed by `extra`.
+func (s *ServiceInfo) destinationLabelValues(
+	destination *libipvs.Destination, extra ...string,
+) (res []string) {
+	address := destination.Address.String()
+	if destination == s.overflowDestination {
+		address = overflowAddress
+	}
+
+	res = s.identityLabelValues()
+	res = append(res, address)
+	res = append(res, s.enrichment...)
+	res = append(res, s.destinationEnrichment[destination]...)
+	res = append(res, extra...)
+	return
+}
+
+// identityLabelValues returns the values of the labels that
+// identify the service (see `serviceLabels`).
+func (s *ServiceInfo) identityLabelValues() (res []string) {
+	if s.FWMark != 0 {
+		res = []string{
+			s.AddressFamily.String(),
+			strconv.Itoa(int(s.FWMark)),
+			s.mappingsProtocols(),
+			"",
+			s.mappingsPorts(),
+		}
+		return
+	}
+
+	res = []string{
+		s.AddressFamily.String(),
+		"",
+		s.Protocol.String(),
+		s.Address.String(),
+		strconv.Itoa(int(s.Port)),
+	}
+	return
+}
+
+// destinationsTotal returns the number of real servers of the
+// service, including those rolled up into overflowDestination.
+func (s *ServiceInfo) destinationsTotal() int {
+	if s.overflowDestination == nil {
+		return len(s.destinationServers)
+	}
+
+	return len(s.destinationServers) - 1 + len(s.overflow)
+}
+
+// mappingsProtocols returns the protocols of the mappings of a
+// fwmark-based service (e.g., `tcp` or `tcp,udp`).
+func (s *ServiceInfo) mappingsProtocols() string {
+	var (
+		protocols []string
+		seen      = map[uint16]bool{}
+	)
+
+	for _, mapping := range s.mappings {
+		if mapping.Protocol == 0 || seen[mapping.Protocol] {
+			continue
+		}
+
+		seen[mapping.Protocol] = true
+		protocols = append(protocols, libipvs.Protocol(mapping.Protocol).String())
+	}
+
+	return strings.Join(protocols, ",")
+}
+
+// mappingsPorts returns the destination ports of the mappings of
+// a fwmark-based service (e.g., `30000` or `80,8000-8080`),
+// falling back to destinationPort if they have none.
+func (s *ServiceInfo) mappingsPorts() string {
+	var (
+		ports []string
+		seen  = map[mapper.PortRange]bool{}
+	)
+
+	for _, mapping := range s.mappings {
+		for _, portRange := range mapping.Ports {
+			if seen[portRange] {
+				continue
+			}
+
+			seen[portRange] = true
+
+			port := strconv.Itoa(int(portRange.From))
+			if portRange.To != portRange.From {
+				port += "-" + strconv.Itoa(int(portRange.To))
+			}
+
+			ports = append(ports, port)
+		}
+	}
+
+	if len(ports) == 0 {
+		return strconv.Itoa(int(s.destinationPort))
+	}
+
+	return strings.Join(ports, ",")
+}
+
+// marksConnection indicates whether a connection (by its
+// lowercase protocol, virtual address and virtual port) is one
+// of those that the fwmark of a fwmark-based service is set for.
+//
+// Mappings without ports (or protocol, or destination) match any
+// of them. Without mappings, only the destinationPort is matched.
+// Persistence templates (protocol `ip`) never match.
+func (s *ServiceInfo) marksConnection(protocol string, address net.IP, port uint16) bool {
+	if protocol == "ip" {
+		return false
+	}
+
+	if len(s.mappings) == 0 {
+		return port == s.destinationPort
+	}
+
+	for _, mapping := range s.mappings {
+		if mapping.Protocol != 0 && libipvs.Protocol(mapping.Protocol).String() != protocol {
+			continue
+		}
+
+		if mapping.Destination != nil && !mapping.Destination.Equal(address) {
+			continue
+		}
+
+		if len(mapping.Ports) == 0 {
+			return true
+		}
+
+		for _, portRange := range mapping.Ports {
+			if port >= portRange.From && port <= portRange.To {
+				return true
+			}
+		}
+	}
+
+	return false
+}
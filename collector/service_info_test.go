@@ -0,0 +1,141 @@
+package collector
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/cirocosta/ingress_ipvs_exporter/mapper"
+	"github.com/mqliang/libipvs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceInfoLabelValues(t *testing.T) {
+	var (
+		destination = &libipvs.Destination{
+			Address: net.ParseIP("10.255.0.5"),
+		}
+		testCases = []struct {
+			desc                string
+			info                *ServiceInfo
+			expected            []string
+			expectedDestination []string
+		}{
+			{
+				desc: "fwmark service",
+				info: &ServiceInfo{
+					Service: &libipvs.Service{
+						AddressFamily: syscall.AF_INET,
+						FWMark:        260,
+					},
+					destinationPort: 30000,
+				},
+				expected:            []string{"inet", "260", "", "", "30000"},
+				expectedDestination: []string{"inet", "260", "", "", "30000", "10.255.0.5"},
+			},
+			{
+				desc: "fwmark service with mappings",
+				info: &ServiceInfo{
+					Service: &libipvs.Service{
+						AddressFamily: syscall.AF_INET,
+						FWMark:        261,
+					},
+					destinationPort: 80,
+					mappings: []mapper.Mapping{
+						{Protocol: syscall.IPPROTO_TCP, Ports: []mapper.PortRange{{From: 80, To: 80}, {From: 8000, To: 8080}}},
+						{Protocol: syscall.IPPROTO_UDP, Ports: []mapper.PortRange{{From: 80, To: 80}}},
+					},
+				},
+				expected:            []string{"inet", "261", "tcp,udp", "", "80,8000-8080"},
+				expectedDestination: []string{"inet", "261", "tcp,udp", "", "80,8000-8080", "10.255.0.5"},
+			},
+			{
+				desc: "tcp service",
+				info: &ServiceInfo{
+					Service: &libipvs.Service{
+						AddressFamily: syscall.AF_INET,
+						Protocol:      syscall.IPPROTO_TCP,
+						Address:       net.ParseIP("10.0.0.1"),
+						Port:          80,
+					},
+				},
+				expected:            []string{"inet", "", "tcp", "10.0.0.1", "80"},
+				expectedDestination: []string{"inet", "", "tcp", "10.0.0.1", "80", "10.255.0.5"},
+			},
+			{
+				desc: "ipv6 udp service",
+				info: &ServiceInfo{
+					Service: &libipvs.Service{
+						AddressFamily: syscall.AF_INET6,
+						Protocol:      syscall.IPPROTO_UDP,
+						Address:       net.ParseIP("fd00::1"),
+						Port:          53,
+					},
+				},
+				expected:            []string{"inet6", "", "udp", "fd00::1", "53"},
+				expectedDestination: []string{"inet6", "", "udp", "fd00::1", "53", "10.255.0.5"},
+			},
+		}
+	)
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.info.labelValues())
+			assert.Len(t, tc.info.labelValues(), len(serviceLabels))
+
+			assert.Equal(t, tc.expectedDestination,
+				tc.info.destinationLabelValues(destination))
+			assert.Len(t, tc.info.destinationLabelValues(destination),
+				len(destinationLabels))
+		})
+	}
+}
+
+func TestServiceInfoMarksConnection(t *testing.T) {
+	var (
+		info = &ServiceInfo{
+			Service: &libipvs.Service{
+				AddressFamily: syscall.AF_INET,
+				FWMark:        261,
+			},
+			destinationPort: 30010,
+			mappings: []mapper.Mapping{
+				{Protocol: syscall.IPPROTO_TCP, Ports: []mapper.PortRange{{From: 30010, To: 30019}}},
+				{Ports: []mapper.PortRange{{From: 53, To: 53}}},
+			},
+		}
+		withoutPorts = &ServiceInfo{
+			Service: info.Service,
+			mappings: []mapper.Mapping{
+				{Destination: net.IPv4(10, 0, 0, 5).To4()},
+			},
+		}
+		withoutMappings = &ServiceInfo{
+			Service:         info.Service,
+			destinationPort: 30000,
+		}
+		skippedMappings = &ServiceInfo{
+			Service: info.Service,
+		}
+		vip      = net.IPv4(10, 0, 0, 5).To4()
+		template = net.IPv4(0, 0, 1, 5).To4()
+	)
+
+	assert.True(t, info.marksConnection("tcp", vip, 30015))
+	assert.False(t, info.marksConnection("udp", vip, 30015))
+	assert.True(t, info.marksConnection("udp", vip, 53))
+	assert.False(t, info.marksConnection("tcp", vip, 30020))
+
+	// mappings without ports match any port (of the
+	// destination, if any)
+	assert.True(t, withoutPorts.marksConnection("tcp", vip, 80))
+	assert.True(t, withoutPorts.marksConnection("udp", vip, 53))
+	assert.False(t, withoutPorts.marksConnection("tcp", net.IPv4(10, 0, 0, 6).To4(), 80))
+
+	assert.True(t, withoutMappings.marksConnection("udp", vip, 30000))
+	assert.False(t, withoutMappings.marksConnection("tcp", vip, 30001))
+
+	// persistence templates never match
+	assert.False(t, withoutPorts.marksConnection("ip", template, 0))
+	assert.False(t, skippedMappings.marksConnection("ip", template, 0))
+}
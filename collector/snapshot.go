@@ -0,0 +1,213 @@
+package collector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// snapshot holds the ipvs information gathered from the
+// network namespace at a given point in time.
+type snapshot struct {
+	infos []*ServiceInfo
+	err   error
+
+	// filtered holds the number of services and
+	// destinations left out by the filters.
+	filtered filterCounts
+
+	// servicesTotal holds the number of services before
+	// applying the limits.
+	servicesTotal int
+
+	// detailed indicates whether the source that the
+	// services came from is detailed (see Source).
+	detailed bool
+
+	// conns holds the connection table entries (only when
+	// the connection table is inspected).
+	conns    []*Connection
+	connsErr error
+
+	time time.Time
+}
+
+// snapshotCache keeps the most recent snapshot gathered by the
+// background loop (see Poll) so that concurrent scrapes can be
+// served from it.
+type snapshotCache struct {
+	sync.RWMutex
+
+	last *snapshot
+
+	// lastSuccess is the time of the last snapshot that
+	// could list the services.
+	lastSuccess time.Time
+}
+
+// get retrieves the most recent snapshot, if any.
+func (s *snapshotCache) get() *snapshot {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.last
+}
+
+// set replaces the most recent snapshot.
+func (s *snapshotCache) set(snap *snapshot) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.last = snap
+	if snap.err == nil {
+		s.lastSuccess = snap.time
+	}
+}
+
+// gather retrieves the services (and the connection table, if
+// configured) from the network namespace, accumulating the
+// 32-bit counters of the services and destinations.
+//
+// The handles are reopened beforehand if the namespace got
+// recreated, and afterwards if the services can't be listed
+// so that the next gathering uses fresh ones.
+//
+// Nothing is gathered once the collector is closed.
+func (c *Collector) gather() (snap *snapshot) {
+	c.handlesMutex.Lock()
+	defer c.handlesMutex.Unlock()
+
+	if c.closed {
+		snap = &snapshot{
+			err:  errors.New("collector closed"),
+			time: time.Now(),
+		}
+		return
+	}
+
+	if c.namespaceChanged() {
+		err := c.reopen(reopenReasonNamespaceChanged)
+		if err != nil {
+			c.logger.Error().
+				Err(err).
+				Msg("failed to follow recreated namespace")
+		}
+	}
+
+	snap = c.gatherOnce()
+	if snap.err == nil {
+		return
+	}
+
+	c.logger.Error().
+		Err(snap.err).
+		Msg("failed to retrieve ipvs info")
+
+	err := c.reopen(reopenReasonError)
+	if err != nil {
+		c.logger.Error().
+			Err(err).
+			Msg("failed to recover from ipvs failure")
+	}
+
+	return
+}
+
+// gatherOnce retrieves the ipvs information using the
+// current handles.
+func (c *Collector) gatherOnce() (snap *snapshot) {
+	snap = &snapshot{
+		detailed: c.ipvs.Detailed(),
+		time:     time.Now(),
+	}
+
+	f := func() (err error) {
+		snap.infos, snap.filtered, err = c.getServicesInfos()
+		if err != nil || !c.connTable {
+			return
+		}
+
+		snap.conns, snap.connsErr = ReadConnTable()
+		return
+	}
+
+	if c.nsHandle != nil {
+		snap.err = c.RunInNetns(f)
+	} else {
+		snap.err = f()
+	}
+	if snap.err != nil {
+		return
+	}
+
+	c.counters.update(snap.infos)
+
+	var dropped int
+
+	snap.servicesTotal = len(snap.infos)
+	snap.infos, dropped = c.applyLimits(snap.infos, snap.detailed)
+	if c.seriesDropped != nil {
+		c.seriesDropped.Add(float64(dropped))
+	}
+
+	if snap.connsErr != nil {
+		c.scrapeErrors.WithLabelValues(scrapeStageConnections).Inc()
+		c.logger.Error().
+			Err(snap.connsErr).
+			Msg("failed to retrieve connection table")
+	}
+
+	return
+}
+
+// Poll refreshes the snapshot that Collect serves from every
+// `RefreshInterval` (as configured in CollectorConfig) until
+// `stop` is closed.
+//
+// It returns right away if no interval has been configured.
+func (c *Collector) Poll(stop <-chan struct{}) {
+	if c.refreshInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		c.snapshots.set(c.gather())
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collectRefresh sends the time of the last successful refresh
+// and how old the data served is to the supplied channel.
+//
+// Nothing is sent before the first successful refresh.
+func (c *Collector) collectRefresh(ch chan<- prometheus.Metric) {
+	c.snapshots.RLock()
+	lastSuccess := c.snapshots.lastSuccess
+	c.snapshots.RUnlock()
+
+	if lastSuccess.IsZero() {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		c.lastRefreshDesc,
+		prometheus.GaugeValue,
+		float64(lastSuccess.UnixNano())/1e9,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.dataAgeDesc,
+		prometheus.GaugeValue,
+		time.Since(lastSuccess).Seconds(),
+	)
+}
@@ -0,0 +1,178 @@
+package collector
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mqliang/libipvs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectorWithoutRefreshInterval(t *testing.T) {
+	collector := newFakeCollector(&fakeIPVSHandle{}, CollectorConfig{})
+
+	done := make(chan struct{})
+	go func() {
+		collector.Poll(nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Poll should return right away without an interval")
+	}
+
+	metrics := collectMetrics(t, &collector)
+	assert.Empty(t, metrics["ipvs_last_refresh_timestamp_seconds"])
+	assert.Empty(t, metrics["ipvs_data_age_seconds"])
+}
+
+func TestCollectorRefreshInterval(t *testing.T) {
+	var (
+		service = &libipvs.Service{
+			Protocol: syscall.IPPROTO_TCP,
+			Address:  net.ParseIP("10.0.0.1"),
+			Port:     80,
+		}
+		handle    = &fakeIPVSHandle{}
+		collector = newFakeCollector(handle, CollectorConfig{
+			RefreshInterval: time.Hour,
+		})
+	)
+
+	// before the first refresh, there's nothing to serve
+	metrics := collectMetrics(t, &collector)
+	require.Len(t, metrics["ipvs_up"], 1)
+	assert.Equal(t, float64(0), metrics["ipvs_up"][0].GetGauge().GetValue())
+	assert.Empty(t, metrics["ipvs_last_refresh_timestamp_seconds"])
+
+	handle.services = []*libipvs.Service{service}
+
+	var (
+		stop = make(chan struct{})
+		done = make(chan struct{})
+	)
+
+	go func() {
+		collector.Poll(stop)
+		close(done)
+	}()
+
+	for deadline := time.Now().Add(time.Second); collector.snapshots.get() == nil; {
+		require.True(t, time.Now().Before(deadline), "no refresh happened")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(stop)
+	<-done
+
+	// scrapes are served from the snapshot regardless of
+	// what's currently in ipvs.
+	handle.services = nil
+
+	metrics = collectMetrics(t, &collector)
+	require.Len(t, metrics["ipvs_up"], 1)
+	assert.Equal(t, float64(1), metrics["ipvs_up"][0].GetGauge().GetValue())
+	require.Len(t, metrics["ipvs_services_total"], 1)
+	assert.Equal(t, float64(1), metrics["ipvs_services_total"][0].GetGauge().GetValue())
+
+	require.Len(t, metrics["ipvs_last_refresh_timestamp_seconds"], 1)
+	lastRefresh := metrics["ipvs_last_refresh_timestamp_seconds"][0].GetGauge().GetValue()
+	assert.InDelta(t, float64(time.Now().Unix()), lastRefresh, 5)
+
+	require.Len(t, metrics["ipvs_data_age_seconds"], 1)
+	assert.True(t, metrics["ipvs_data_age_seconds"][0].GetGauge().GetValue() >= 0)
+
+	// failed refreshes are reported via `ipvs_up` while the
+	// time of the last successful one is kept.
+	handle.servicesErr = errors.New("netlink failure")
+	collector.snapshots.set(collector.gather())
+
+	metrics = collectMetrics(t, &collector)
+	require.Len(t, metrics["ipvs_up"], 1)
+	assert.Equal(t, float64(0), metrics["ipvs_up"][0].GetGauge().GetValue())
+	require.Len(t, metrics["ipvs_last_refresh_timestamp_seconds"], 1)
+	assert.Equal(t, lastRefresh,
+		metrics["ipvs_last_refresh_timestamp_seconds"][0].GetGauge().GetValue())
+}
+
+func TestCollectorClosed(t *testing.T) {
+	var (
+		handle = &fakeIPVSHandle{
+			services: []*libipvs.Service{{
+				Protocol: syscall.IPPROTO_TCP,
+				Address:  net.ParseIP("10.0.0.1"),
+				Port:     80,
+			}},
+		}
+		collector = newFakeCollector(handle, CollectorConfig{})
+		opened    int
+	)
+
+	collector.newSource = func() (Source, error) {
+		opened++
+		return handle, nil
+	}
+
+	collector.Close()
+	assert.True(t, handle.closed)
+
+	// neither the closed source is used nor new handles get
+	// opened
+	snap := collector.gather()
+	assert.Error(t, snap.err)
+	assert.Zero(t, opened)
+
+	metrics := collectMetrics(t, &collector)
+	require.Len(t, metrics["ipvs_up"], 1)
+	assert.Equal(t, float64(0), metrics["ipvs_up"][0].GetGauge().GetValue())
+}
+
+func TestCollectorReopenWhileServing(t *testing.T) {
+	var (
+		newHandle = func() *fakeIPVSHandle {
+			return &fakeIPVSHandle{
+				services: []*libipvs.Service{{
+					Protocol: syscall.IPPROTO_TCP,
+					Address:  net.ParseIP("10.0.0.1"),
+					Port:     80,
+				}},
+			}
+		}
+		collector = newFakeCollector(newHandle(), CollectorConfig{
+			RefreshInterval: time.Hour,
+		})
+		done = make(chan struct{})
+	)
+
+	collector.newSource = func() (Source, error) {
+		return newHandle(), nil
+	}
+
+	collector.snapshots.set(collector.gather())
+
+	// scrapes served from the snapshot don't touch the
+	// handles that get replaced meanwhile (see -race)
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 50; i++ {
+			collector.handlesMutex.Lock()
+			assert.NoError(t, collector.reopen(reopenReasonError))
+			collector.handlesMutex.Unlock()
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		metrics := collectMetrics(t, &collector)
+		require.Len(t, metrics["ipvs_service_info"], 1)
+		assert.Equal(t, "0", metricLabels(metrics["ipvs_service_info"][0])["timeout"])
+	}
+
+	<-done
+}
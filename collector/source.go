@@ -0,0 +1,63 @@
+package collector
+
+import (
+	"github.com/mqliang/libipvs"
+	"github.com/pkg/errors"
+)
+
+const (
+	// SourceNetlink gathers ipvs information by issuing
+	// generic netlink commands to the ip_vs module.
+	SourceNetlink = "netlink"
+
+	// SourceProcfs gathers ipvs information by parsing
+	// `/proc/net/ip_vs`.
+	SourceProcfs = "procfs"
+)
+
+// Source provides the services and destinations configured
+// in ipvs in the network namespace of the calling thread.
+type Source interface {
+	// ListServices retrieves all of the ipvs services.
+	ListServices() (services []*libipvs.Service, err error)
+
+	// ListDestinations retrieves the destinations (real
+	// servers) of a service retrieved via ListServices.
+	ListDestinations(service *libipvs.Service) (destinations []*libipvs.Destination, err error)
+
+	// Detailed indicates whether the services and
+	// destinations retrieved carry stats (counters and
+	// rates), thresholds, persistence timeouts and
+	// persistent connections.
+	Detailed() bool
+
+	// Close releases the resources held by the source.
+	Close()
+}
+
+// netlinkSource is a Source that retrieves ipvs information
+// via generic netlink using libipvs.
+type netlinkSource struct {
+	libipvs.IPVSHandle
+}
+
+// newNetlinkSource creates a netlink Source for the network
+// namespace of the calling thread.
+func newNetlinkSource() (source Source, err error) {
+	handle, err := libipvs.New()
+	if err != nil {
+		err = errors.Wrapf(err,
+			"failed to create ipvs handle")
+		return
+	}
+
+	source = &netlinkSource{handle}
+	return
+}
+
+// Detailed is always true for netlink given that all the
+// information is provided by IPVS_CMD_GET_SERVICE and
+// IPVS_CMD_GET_DEST.
+func (s *netlinkSource) Detailed() bool {
+	return true
+}
@@ -0,0 +1,257 @@
+// docker defines a minimal client of the Docker Engine API
+// (over its unix socket) and the enrichers that make use of it
+// to label ipvs metrics with docker swarm information.
+package docker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultSocketPath is the path to the unix socket that
+	// the docker daemon listens on by default.
+	DefaultSocketPath = "/var/run/docker.sock"
+
+	// apiVersion is the version of the Docker Engine API used
+	// (docker 17.06+), the first to emit service events.
+	apiVersion = "v1.30"
+
+	// stackNamespaceLabel is the label that `docker stack
+	// deploy` sets on the services of a stack.
+	stackNamespaceLabel = "com.docker.stack.namespace"
+)
+
+// Service is a docker swarm service as retrieved via
+// `GET /services`, with only the fields that matter here.
+type Service struct {
+	ID string
+
+	Spec struct {
+		Name   string
+		Labels map[string]string
+	}
+
+	Endpoint struct {
+		Ports []struct {
+			Protocol      string
+			TargetPort    uint32
+			PublishedPort uint32
+			PublishMode   string
+		}
+
+		VirtualIPs []struct {
+			NetworkID string
+			Addr      string
+		}
+	}
+}
+
+// Task is a docker swarm task as retrieved via `GET /tasks`,
+// with only the fields that matter here.
+type Task struct {
+	ID        string
+	ServiceID string
+	NodeID    string
+	Slot      int
+
+	Status struct {
+		ContainerStatus struct {
+			ContainerID string
+		}
+	}
+
+	NetworksAttachments []struct {
+		Network struct {
+			ID   string
+			Spec struct {
+				Name    string
+				Ingress bool
+			}
+		}
+		Addresses []string
+	}
+}
+
+// Node is a docker swarm node as retrieved via `GET /nodes`,
+// with only the fields that matter here.
+type Node struct {
+	ID string
+
+	Description struct {
+		Hostname string
+	}
+}
+
+// Event is an event from the docker events stream
+// (`GET /events`).
+type Event struct {
+	Type   string
+	Action string
+	Actor  struct {
+		ID string
+	}
+}
+
+// Client talks to the Docker Engine API over a unix socket.
+type Client struct {
+	http *http.Client
+}
+
+// NewClient creates a Client that talks to the docker daemon
+// listening on the unix socket at `socketPath`.
+func NewClient(socketPath string) (client *Client) {
+	client = &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+	return
+}
+
+// get performs a request against an API endpoint, checking
+// that it succeeded.
+func (c *Client) get(ctx context.Context, path string, query url.Values) (res *http.Response, err error) {
+	u := url.URL{
+		Scheme:   "http",
+		Host:     "docker",
+		Path:     "/" + apiVersion + path,
+		RawQuery: query.Encode(),
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"failed to create request to %s",
+			path)
+		return
+	}
+
+	res, err = c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		err = errors.Wrapf(err,
+			"failed to request %s",
+			path)
+		return
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		err = errors.Errorf("request to %s failed with status %d",
+			path, res.StatusCode)
+		return
+	}
+
+	return
+}
+
+// getJSON performs a request against an API endpoint, decoding
+// its JSON response into `v`.
+func (c *Client) getJSON(path string, query url.Values, v interface{}) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := c.get(ctx, path, query)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	err = json.NewDecoder(res.Body).Decode(v)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"failed to decode response from %s",
+			path)
+		return
+	}
+
+	return
+}
+
+// ListServices retrieves all of the docker swarm services.
+func (c *Client) ListServices() (services []Service, err error) {
+	err = c.getJSON("/services", nil, &services)
+	return
+}
+
+// ListTasks retrieves the docker swarm tasks that are meant to
+// be running.
+func (c *Client) ListTasks() (tasks []Task, err error) {
+	filters, err := json.Marshal(map[string][]string{"desired-state": {"running"}})
+	if err != nil {
+		return
+	}
+
+	err = c.getJSON("/tasks", url.Values{"filters": {string(filters)}}, &tasks)
+	return
+}
+
+// ListNodes retrieves all of the docker swarm nodes.
+func (c *Client) ListNodes() (nodes []Node, err error) {
+	err = c.getJSON("/nodes", nil, &nodes)
+	return
+}
+
+// Events streams the docker events of the given types (e.g.,
+// "service") to `events` until either the stream breaks or
+// `stop` is closed.
+//
+// It blocks, always returning an error (except when stopped).
+func (c *Client) Events(types []string, events chan<- Event, stop <-chan struct{}) (err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	filters, err := json.Marshal(map[string][]string{"type": types})
+	if err != nil {
+		return
+	}
+
+	res, err := c.get(ctx, "/events", url.Values{"filters": {string(filters)}})
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(res.Body))
+	for {
+		var event Event
+
+		err = decoder.Decode(&event)
+		if err != nil {
+			select {
+			case <-stop:
+				err = nil
+			default:
+				err = errors.Wrapf(err,
+					"events stream broke")
+			}
+			return
+		}
+
+		select {
+		case events <- event:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package docker
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mqliang/libipvs"
+	"github.com/rs/zerolog"
+)
+
+// serviceLabels are the labels that the ServiceEnricher
+// provides.
+var serviceLabels = []string{"service_name", "stack"}
+
+// ServiceEnricherConfig provides the necessary configuration
+// for initializing a ServiceEnricher.
+type ServiceEnricherConfig struct {
+	// Client is the client of the docker daemon.
+	Client *Client
+
+	// RetryInterval is how long to wait before reconnecting
+	// to the events stream when it breaks.
+	RetryInterval time.Duration
+}
+
+// swarmService holds what identifies a docker swarm service.
+type swarmService struct {
+	id    string
+	name  string
+	stack string
+}
+
+// ServiceEnricher labels the ipvs services with the name (and
+// stack) of the docker swarm services that they belong to.
+//
+// Fwmark-based services are matched by the published port that
+// iptables marks (ingress) or, when the rules mark a single
+// address instead, by it being a virtual IP (e.g., the `lb_*`
+// load balancers of the overlay networks), while the rest are
+// matched by their virtual IPs.
+//
+// Services are cached, being refreshed whenever docker reports
+// a change to any service.
+type ServiceEnricher struct {
+	logger zerolog.Logger
+	cfg    ServiceEnricherConfig
+
+	byPort map[uint16]*swarmService
+	byVIP  map[string]*swarmService
+	sync.RWMutex
+}
+
+// NewServiceEnricher initializes a ServiceEnricher.
+//
+// The cache is only filled once Run is called.
+func NewServiceEnricher(cfg ServiceEnricherConfig) (enricher *ServiceEnricher) {
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = 5 * time.Second
+	}
+
+	enricher = &ServiceEnricher{
+		cfg:    cfg,
+		byPort: map[uint16]*swarmService{},
+		byVIP:  map[string]*swarmService{},
+		logger: zerolog.New(os.Stdout).
+			With().
+			Str("from", "docker").
+			Logger(),
+	}
+	return
+}
+
+// Labels retrieves the names of the labels that the enricher
+// provides (`service_name` and `stack`).
+func (e *ServiceEnricher) Labels() []string {
+	return serviceLabels
+}
+
+// LabelValues retrieves the name and stack of the swarm service
+// that an ipvs service belongs to, if known.
+func (e *ServiceEnricher) LabelValues(service *libipvs.Service, destinationPort uint16, destinationAddress net.IP) []string {
+	e.RLock()
+	defer e.RUnlock()
+
+	var (
+		swarm *swarmService
+		ok    bool
+	)
+
+	switch {
+	case service.FWMark == 0:
+		swarm, ok = e.byVIP[service.Address.String()]
+	case destinationPort != 0:
+		swarm, ok = e.byPort[destinationPort]
+	}
+
+	if !ok && service.FWMark != 0 && destinationAddress != nil {
+		swarm, ok = e.byVIP[destinationAddress.String()]
+	}
+
+	if !ok {
+		return []string{"", ""}
+	}
+
+	return []string{swarm.name, swarm.stack}
+}
+
+// Run fills the cache and keeps it up to date by following the
+// docker events stream until `stop` is closed.
+//
+// Whenever the stream breaks, it's reconnected to (and the
+// cache refreshed) after `RetryInterval`.
+func (e *ServiceEnricher) Run(stop <-chan struct{}) {
+	watch(watchConfig{
+		client:        e.cfg.Client,
+		logger:        e.logger,
+		types:         []string{"service"},
+		refresh:       e.refresh,
+		retryInterval: e.cfg.RetryInterval,
+	}, stop)
+}
+
+// refresh replaces the cache by the services currently known
+// by docker.
+//
+// In case docker can't be reached, the cache is kept as it is.
+func (e *ServiceEnricher) refresh() {
+	services, err := e.cfg.Client.ListServices()
+	if err != nil {
+		e.logger.Error().
+			Err(err).
+			Msg("failed to list docker services")
+		return
+	}
+
+	var (
+		byPort = map[uint16]*swarmService{}
+		byVIP  = map[string]*swarmService{}
+	)
+
+	for _, service := range services {
+		swarm := &swarmService{
+			id:    service.ID,
+			name:  service.Spec.Name,
+			stack: service.Spec.Labels[stackNamespaceLabel],
+		}
+
+		for _, port := range service.Endpoint.Ports {
+			if port.PublishMode != "" && port.PublishMode != "ingress" {
+				continue
+			}
+
+			if port.PublishedPort != 0 {
+				byPort[uint16(port.PublishedPort)] = swarm
+			}
+		}
+
+		for _, vip := range service.Endpoint.VirtualIPs {
+			ip := vip.Addr
+			if ndx := strings.Index(ip, "/"); ndx != -1 {
+				ip = ip[:ndx]
+			}
+
+			parsed := net.ParseIP(ip)
+			if parsed == nil {
+				continue
+			}
+
+			byVIP[parsed.String()] = swarm
+		}
+	}
+
+	e.Lock()
+	e.byPort, e.byVIP = byPort, byVIP
+	e.Unlock()
+
+	e.logger.Debug().
+		Int("services", len(services)).
+		Msg("refreshed docker services")
+}
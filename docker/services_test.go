@@ -0,0 +1,275 @@
+package docker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mqliang/libipvs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDaemon serves a subset of the Docker Engine API over a
+// unix socket.
+type fakeDaemon struct {
+	server     *httptest.Server
+	socketPath string
+	dir        string
+
+	services []Service
+	tasks    []Task
+	nodes    []Node
+	events   chan Event
+
+	// eventTypes are the types of events that clients are
+	// expected to filter by.
+	eventTypes []string
+	sync.Mutex
+}
+
+func newFakeDaemon(t *testing.T) (daemon *fakeDaemon) {
+	dir, err := ioutil.TempDir("", "docker")
+	require.NoError(t, err)
+
+	daemon = &fakeDaemon{
+		dir:        dir,
+		socketPath: filepath.Join(dir, "docker.sock"),
+		events:     make(chan Event),
+		eventTypes: []string{"service"},
+	}
+
+	listener, err := net.Listen("unix", daemon.socketPath)
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+apiVersion+"/services", func(w http.ResponseWriter, r *http.Request) {
+		daemon.Lock()
+		defer daemon.Unlock()
+
+		json.NewEncoder(w).Encode(daemon.services)
+	})
+	mux.HandleFunc("/"+apiVersion+"/tasks", func(w http.ResponseWriter, r *http.Request) {
+		var filters map[string][]string
+
+		err := json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+		if err != nil || !reflect.DeepEqual(filters["desired-state"], []string{"running"}) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		daemon.Lock()
+		defer daemon.Unlock()
+
+		if daemon.tasks == nil {
+			// docker refuses to list tasks on worker nodes
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		json.NewEncoder(w).Encode(daemon.tasks)
+	})
+	mux.HandleFunc("/"+apiVersion+"/nodes", func(w http.ResponseWriter, r *http.Request) {
+		daemon.Lock()
+		defer daemon.Unlock()
+
+		json.NewEncoder(w).Encode(daemon.nodes)
+	})
+	mux.HandleFunc("/"+apiVersion+"/events", func(w http.ResponseWriter, r *http.Request) {
+		var filters map[string][]string
+
+		err := json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+		if err != nil || !reflect.DeepEqual(filters["type"], daemon.eventTypes) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		for {
+			select {
+			case event := <-daemon.events:
+				json.NewEncoder(w).Encode(event)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+
+	daemon.server = httptest.NewUnstartedServer(mux)
+	daemon.server.Listener = listener
+	daemon.server.Start()
+
+	return
+}
+
+func (d *fakeDaemon) setServices(services ...Service) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.services = services
+}
+
+func (d *fakeDaemon) close() {
+	d.server.CloseClientConnections()
+	d.server.Close()
+	os.RemoveAll(d.dir)
+}
+
+// newService creates a swarm service that publishes a port
+// via ingress and has a virtual IP.
+func newService(name, stack string, publishedPort uint32, vip string) (service Service) {
+	service.ID = name + "-id"
+	service.Spec.Name = name
+	if stack != "" {
+		service.Spec.Labels = map[string]string{stackNamespaceLabel: stack}
+	}
+
+	service.Endpoint.Ports = append(service.Endpoint.Ports, struct {
+		Protocol      string
+		TargetPort    uint32
+		PublishedPort uint32
+		PublishMode   string
+	}{"tcp", 80, publishedPort, "ingress"})
+
+	service.Endpoint.VirtualIPs = append(service.Endpoint.VirtualIPs, struct {
+		NetworkID string
+		Addr      string
+	}{"ingress-id", vip})
+
+	return
+}
+
+// waitFor waits up to a second for `condition` to hold.
+func waitFor(t *testing.T, condition func() bool) {
+	for deadline := time.Now().Add(time.Second); !condition(); {
+		require.True(t, time.Now().Before(deadline), "condition never met")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+var (
+	fwmarkService = &libipvs.Service{
+		AddressFamily: syscall.AF_INET,
+		FWMark:        260,
+	}
+	vipService = &libipvs.Service{
+		AddressFamily: syscall.AF_INET,
+		Protocol:      syscall.IPPROTO_TCP,
+		Address:       net.ParseIP("10.0.0.5"),
+		Port:          80,
+	}
+)
+
+func TestClientListServices(t *testing.T) {
+	daemon := newFakeDaemon(t)
+	defer daemon.close()
+
+	daemon.setServices(newService("web", "shop", 30000, "10.255.0.5/16"))
+
+	services, err := NewClient(daemon.socketPath).ListServices()
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+	assert.Equal(t, "web", services[0].Spec.Name)
+	assert.Equal(t, "shop", services[0].Spec.Labels[stackNamespaceLabel])
+	assert.Equal(t, uint32(30000), services[0].Endpoint.Ports[0].PublishedPort)
+	assert.Equal(t, "10.255.0.5/16", services[0].Endpoint.VirtualIPs[0].Addr)
+
+	_, err = NewClient(filepath.Join(daemon.dir, "inexistent.sock")).ListServices()
+	assert.Error(t, err)
+}
+
+func TestServiceEnricher(t *testing.T) {
+	daemon := newFakeDaemon(t)
+	defer daemon.close()
+
+	daemon.setServices(
+		newService("web", "shop", 30000, "10.255.0.5/16"),
+		newService("api", "", 30001, "10.0.0.5/24"),
+	)
+
+	enricher := NewServiceEnricher(ServiceEnricherConfig{
+		Client: NewClient(daemon.socketPath),
+	})
+	assert.Equal(t, []string{"service_name", "stack"}, enricher.Labels())
+	assert.Equal(t, []string{"", ""}, enricher.LabelValues(fwmarkService, 30000, nil))
+
+	var (
+		stop = make(chan struct{})
+		done = make(chan struct{})
+	)
+
+	go func() {
+		enricher.Run(stop)
+		close(done)
+	}()
+
+	waitFor(t, func() bool {
+		return enricher.LabelValues(fwmarkService, 30000, nil)[0] != ""
+	})
+
+	assert.Equal(t, []string{"web", "shop"}, enricher.LabelValues(fwmarkService, 30000, nil))
+	assert.Equal(t, []string{"api", ""}, enricher.LabelValues(vipService, 0, nil))
+	assert.Equal(t, []string{"", ""}, enricher.LabelValues(fwmarkService, 30002, nil))
+
+	// fwmark services of virtual IPs are matched by the
+	// address that the rules mark
+	assert.Equal(t, []string{"api", ""}, enricher.LabelValues(fwmarkService, 0, net.ParseIP("10.0.0.5")))
+	assert.Equal(t, []string{"web", "shop"}, enricher.LabelValues(fwmarkService, 30002, net.ParseIP("10.255.0.5")))
+	assert.Equal(t, []string{"", ""}, enricher.LabelValues(fwmarkService, 0, net.ParseIP("10.0.0.6")))
+
+	// changes are picked up once docker reports them
+	daemon.setServices(newService("web", "shop", 30002, "10.255.0.5/16"))
+	daemon.events <- Event{Type: "service", Action: "update"}
+
+	waitFor(t, func() bool {
+		return enricher.LabelValues(fwmarkService, 30002, nil)[0] != ""
+	})
+	assert.Equal(t, []string{"", ""}, enricher.LabelValues(fwmarkService, 30000, nil))
+	assert.Equal(t, []string{"", ""}, enricher.LabelValues(vipService, 0, nil))
+
+	close(stop)
+	<-done
+}
+
+func TestServiceEnricherReconnects(t *testing.T) {
+	daemon := newFakeDaemon(t)
+	defer daemon.close()
+
+	enricher := NewServiceEnricher(ServiceEnricherConfig{
+		Client:        NewClient(daemon.socketPath),
+		RetryInterval: 10 * time.Millisecond,
+	})
+
+	var (
+		stop = make(chan struct{})
+		done = make(chan struct{})
+	)
+
+	go func() {
+		enricher.Run(stop)
+		close(done)
+	}()
+
+	// once the stream breaks, the services are listed again
+	// after reconnecting.
+	daemon.setServices(newService("web", "shop", 30000, "10.255.0.5/16"))
+	waitFor(t, func() bool {
+		daemon.server.CloseClientConnections()
+		return enricher.LabelValues(fwmarkService, 30000, nil)[0] != ""
+	})
+
+	close(stop)
+	<-done
+}
@@ -0,0 +1,185 @@
+package docker
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mqliang/libipvs"
+	"github.com/rs/zerolog"
+)
+
+// taskLabels are the labels that the TaskEnricher provides.
+var taskLabels = []string{"task_id", "task_slot", "container_id", "node"}
+
+// TaskEnricherConfig provides the necessary configuration for
+// initializing a TaskEnricher.
+type TaskEnricherConfig struct {
+	// Client is the client of the docker daemon.
+	Client *Client
+
+	// RefreshInterval is how often the tasks are listed again
+	// regardless of events.
+	//
+	// Tasks rescheduled on other nodes don't generate events
+	// on this node, thus, this bounds how stale the cache gets.
+	RefreshInterval time.Duration
+
+	// RetryInterval is how long to wait before reconnecting
+	// to the events stream when it breaks.
+	RetryInterval time.Duration
+}
+
+// swarmTask holds what identifies the docker swarm task behind
+// a real server address.
+type swarmTask struct {
+	id          string
+	slot        string
+	containerID string
+	node        string
+}
+
+// TaskEnricher labels the ipvs destinations (real servers) with
+// the docker swarm task (and the node it runs on) that owns the
+// address on the ingress network.
+//
+// Tasks are cached, being refreshed whenever docker reports a
+// change to services, nodes or containers and every
+// `RefreshInterval`.
+//
+// Listing tasks requires a manager node - when docker can't be
+// reached, destinations are only identified by their address.
+type TaskEnricher struct {
+	logger zerolog.Logger
+	cfg    TaskEnricherConfig
+
+	byAddress map[string]*swarmTask
+	sync.RWMutex
+}
+
+// NewTaskEnricher initializes a TaskEnricher.
+//
+// The cache is only filled once Run is called.
+func NewTaskEnricher(cfg TaskEnricherConfig) (enricher *TaskEnricher) {
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = time.Minute
+	}
+
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = 5 * time.Second
+	}
+
+	enricher = &TaskEnricher{
+		cfg:       cfg,
+		byAddress: map[string]*swarmTask{},
+		logger: zerolog.New(os.Stdout).
+			With().
+			Str("from", "docker").
+			Logger(),
+	}
+	return
+}
+
+// Labels retrieves the names of the labels that the enricher
+// provides (`task_id`, `task_slot`, `container_id` and `node`).
+func (e *TaskEnricher) Labels() []string {
+	return taskLabels
+}
+
+// LabelValues retrieves the task, slot, container and node
+// hostname behind a real server address, if known.
+func (e *TaskEnricher) LabelValues(destination *libipvs.Destination) []string {
+	e.RLock()
+	defer e.RUnlock()
+
+	task, ok := e.byAddress[destination.Address.String()]
+	if !ok {
+		return []string{"", "", "", ""}
+	}
+
+	return []string{task.id, task.slot, task.containerID, task.node}
+}
+
+// Run fills the cache and keeps it up to date by following the
+// docker events stream until `stop` is closed.
+func (e *TaskEnricher) Run(stop <-chan struct{}) {
+	watch(watchConfig{
+		client:          e.cfg.Client,
+		logger:          e.logger,
+		types:           []string{"service", "node", "container"},
+		refresh:         e.refresh,
+		refreshInterval: e.cfg.RefreshInterval,
+		retryInterval:   e.cfg.RetryInterval,
+	}, stop)
+}
+
+// refresh replaces the cache by the tasks currently known by
+// docker.
+//
+// In case docker can't be reached, the cache is kept as it is.
+func (e *TaskEnricher) refresh() {
+	tasks, err := e.cfg.Client.ListTasks()
+	if err != nil {
+		e.logger.Error().
+			Err(err).
+			Msg("failed to list docker tasks")
+		return
+	}
+
+	nodes, err := e.cfg.Client.ListNodes()
+	if err != nil {
+		e.logger.Error().
+			Err(err).
+			Msg("failed to list docker nodes")
+		return
+	}
+
+	hostnames := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		hostnames[node.ID] = node.Description.Hostname
+	}
+
+	byAddress := map[string]*swarmTask{}
+	for _, task := range tasks {
+		swarm := &swarmTask{
+			id:          task.ID,
+			containerID: task.Status.ContainerStatus.ContainerID,
+			node:        hostnames[task.NodeID],
+		}
+
+		// tasks of global services have no slot
+		if task.Slot != 0 {
+			swarm.slot = strconv.Itoa(task.Slot)
+		}
+
+		for _, attachment := range task.NetworksAttachments {
+			if !attachment.Network.Spec.Ingress {
+				continue
+			}
+
+			for _, address := range attachment.Addresses {
+				if ndx := strings.Index(address, "/"); ndx != -1 {
+					address = address[:ndx]
+				}
+
+				parsed := net.ParseIP(address)
+				if parsed == nil {
+					continue
+				}
+
+				byAddress[parsed.String()] = swarm
+			}
+		}
+	}
+
+	e.Lock()
+	e.byAddress = byAddress
+	e.Unlock()
+
+	e.logger.Debug().
+		Int("tasks", len(tasks)).
+		Msg("refreshed docker tasks")
+}
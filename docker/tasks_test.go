@@ -0,0 +1,201 @@
+package docker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mqliang/libipvs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (d *fakeDaemon) setTasks(tasks []Task, nodes ...Node) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.tasks, d.nodes = tasks, nodes
+}
+
+// newTask creates a swarm task attached to the ingress network
+// (and to an overlay network) with the given addresses.
+func newTask(id string, slot int, nodeID, ingressAddress, overlayAddress string) (task Task) {
+	task.ID = id
+	task.Slot = slot
+	task.NodeID = nodeID
+	task.Status.ContainerStatus.ContainerID = id + "-container"
+
+	task.NetworksAttachments = make([]struct {
+		Network struct {
+			ID   string
+			Spec struct {
+				Name    string
+				Ingress bool
+			}
+		}
+		Addresses []string
+	}, 2)
+
+	task.NetworksAttachments[0].Network.Spec.Name = "ingress"
+	task.NetworksAttachments[0].Network.Spec.Ingress = true
+	task.NetworksAttachments[0].Addresses = []string{ingressAddress}
+
+	task.NetworksAttachments[1].Network.Spec.Name = "overlay"
+	task.NetworksAttachments[1].Addresses = []string{overlayAddress}
+
+	return
+}
+
+func newNode(id, hostname string) (node Node) {
+	node.ID = id
+	node.Description.Hostname = hostname
+	return
+}
+
+func destination(address string) *libipvs.Destination {
+	return &libipvs.Destination{Address: net.ParseIP(address)}
+}
+
+func TestClientListTasks(t *testing.T) {
+	daemon := newFakeDaemon(t)
+	defer daemon.close()
+
+	daemon.setTasks(
+		[]Task{newTask("task-1", 1, "node-1", "10.255.0.7/16", "10.0.0.7/24")},
+		newNode("node-1", "worker-1"),
+	)
+
+	client := NewClient(daemon.socketPath)
+
+	tasks, err := client.ListTasks()
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	assert.Equal(t, "task-1", tasks[0].ID)
+	assert.Equal(t, "task-1-container", tasks[0].Status.ContainerStatus.ContainerID)
+	assert.True(t, tasks[0].NetworksAttachments[0].Network.Spec.Ingress)
+	assert.Equal(t, []string{"10.255.0.7/16"}, tasks[0].NetworksAttachments[0].Addresses)
+
+	nodes, err := client.ListNodes()
+	require.NoError(t, err)
+	require.Len(t, nodes, 1)
+	assert.Equal(t, "worker-1", nodes[0].Description.Hostname)
+}
+
+func TestTaskEnricher(t *testing.T) {
+	daemon := newFakeDaemon(t)
+	defer daemon.close()
+
+	daemon.eventTypes = []string{"service", "node", "container"}
+	daemon.setTasks(
+		[]Task{
+			newTask("task-1", 1, "node-1", "10.255.0.7/16", "10.0.0.7/24"),
+			newTask("task-2", 0, "node-2", "10.255.0.8/16", "10.0.0.8/24"),
+		},
+		newNode("node-1", "worker-1"),
+		newNode("node-2", "worker-2"),
+	)
+
+	enricher := NewTaskEnricher(TaskEnricherConfig{
+		Client: NewClient(daemon.socketPath),
+	})
+	assert.Equal(t, []string{"task_id", "task_slot", "container_id", "node"}, enricher.Labels())
+	assert.Equal(t, []string{"", "", "", ""}, enricher.LabelValues(destination("10.255.0.7")))
+
+	var (
+		stop = make(chan struct{})
+		done = make(chan struct{})
+	)
+
+	go func() {
+		enricher.Run(stop)
+		close(done)
+	}()
+
+	waitFor(t, func() bool {
+		return enricher.LabelValues(destination("10.255.0.7"))[0] != ""
+	})
+
+	assert.Equal(t,
+		[]string{"task-1", "1", "task-1-container", "worker-1"},
+		enricher.LabelValues(destination("10.255.0.7")))
+	assert.Equal(t,
+		[]string{"task-2", "", "task-2-container", "worker-2"},
+		enricher.LabelValues(destination("10.255.0.8")))
+
+	// only addresses on the ingress network are known
+	assert.Equal(t, []string{"", "", "", ""}, enricher.LabelValues(destination("10.0.0.7")))
+
+	// changes are picked up once docker reports them
+	daemon.setTasks(
+		[]Task{newTask("task-3", 1, "node-2", "10.255.0.9/16", "10.0.0.9/24")},
+		newNode("node-2", "worker-2"),
+	)
+	daemon.events <- Event{Type: "container", Action: "start"}
+
+	waitFor(t, func() bool {
+		return enricher.LabelValues(destination("10.255.0.9"))[0] != ""
+	})
+	assert.Equal(t, []string{"", "", "", ""}, enricher.LabelValues(destination("10.255.0.7")))
+
+	close(stop)
+	<-done
+}
+
+func TestTaskEnricherRefreshesPeriodically(t *testing.T) {
+	daemon := newFakeDaemon(t)
+	defer daemon.close()
+
+	daemon.eventTypes = []string{"service", "node", "container"}
+
+	enricher := NewTaskEnricher(TaskEnricherConfig{
+		Client:          NewClient(daemon.socketPath),
+		RefreshInterval: 10 * time.Millisecond,
+	})
+
+	var (
+		stop = make(chan struct{})
+		done = make(chan struct{})
+	)
+
+	go func() {
+		enricher.Run(stop)
+		close(done)
+	}()
+
+	daemon.setTasks(
+		[]Task{newTask("task-1", 1, "node-1", "10.255.0.7/16", "10.0.0.7/24")},
+		newNode("node-1", "worker-1"),
+	)
+	waitFor(t, func() bool {
+		return enricher.LabelValues(destination("10.255.0.7"))[0] != ""
+	})
+
+	close(stop)
+	<-done
+}
+
+func TestTaskEnricherKeepsCacheIfUnreachable(t *testing.T) {
+	daemon := newFakeDaemon(t)
+	defer daemon.close()
+
+	daemon.setTasks(
+		[]Task{newTask("task-1", 1, "node-1", "10.255.0.7/16", "10.0.0.7/24")},
+		newNode("node-1", "worker-1"),
+	)
+
+	enricher := NewTaskEnricher(TaskEnricherConfig{
+		Client: NewClient(daemon.socketPath),
+	})
+
+	enricher.refresh()
+	assert.Equal(t, "task-1", enricher.LabelValues(destination("10.255.0.7"))[0])
+
+	// tasks can't be listed (e.g., on a worker node)
+	daemon.setTasks(nil)
+	enricher.refresh()
+	assert.Equal(t, "task-1", enricher.LabelValues(destination("10.255.0.7"))[0])
+
+	daemon.close()
+	enricher.refresh()
+	assert.Equal(t, "task-1", enricher.LabelValues(destination("10.255.0.7"))[0])
+}
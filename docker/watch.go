@@ -0,0 +1,83 @@
+package docker
+
+import (
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// watchConfig configures how a cache of docker objects is
+// kept up to date (see watch).
+type watchConfig struct {
+	client *Client
+	logger zerolog.Logger
+
+	// types are the types of the events (e.g., "service")
+	// that trigger a refresh.
+	types []string
+
+	// refresh fills the cache.
+	refresh func()
+
+	// refreshInterval, when positive, makes the cache be
+	// refreshed periodically regardless of events.
+	refreshInterval time.Duration
+
+	// retryInterval is how long to wait before reconnecting
+	// to the events stream when it breaks.
+	retryInterval time.Duration
+}
+
+// watch calls `refresh` right away and then whenever docker
+// reports events of the configured types (and every
+// `refreshInterval`, if set) until `stop` is closed.
+//
+// Whenever the events stream breaks, it's reconnected to (and
+// the cache refreshed) after `retryInterval`.
+func watch(cfg watchConfig, stop <-chan struct{}) {
+	var (
+		events = make(chan Event)
+		ticks  <-chan time.Time
+	)
+
+	if cfg.refreshInterval > 0 {
+		ticker := time.NewTicker(cfg.refreshInterval)
+		defer ticker.Stop()
+
+		ticks = ticker.C
+	}
+
+	for {
+		cfg.refresh()
+
+		errs := make(chan error, 1)
+		go func() {
+			errs <- cfg.client.Events(cfg.types, events, stop)
+		}()
+
+	follow:
+		for {
+			select {
+			case <-events:
+				cfg.refresh()
+			case <-ticks:
+				cfg.refresh()
+			case err := <-errs:
+				if err == nil {
+					return
+				}
+
+				cfg.logger.Error().
+					Err(err).
+					Msg("failed to follow docker events")
+				break follow
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(cfg.retryInterval):
+		}
+	}
+}
@@ -37,11 +37,14 @@ type ExporterConfig struct {
 	// - /telemetry
 	TelemetryPath string
 
-	// Collector is an already instantiated Collector that
-	// implements the Prometheus collector interface so
-	// prometheus can ask it for metrics and metric descriptions
-	// to expose under the configured telemetry path.
-	Collector *collector.Collector
+	// Collectors are already instantiated Collectors (one per
+	// network namespace) that implement the Prometheus collector
+	// interface so prometheus can ask them for metrics and metric
+	// descriptions to expose under the configured telemetry path.
+	//
+	// It might be empty when collectors are registered as
+	// namespaces get discovered (see collector.Discovery).
+	Collectors []*collector.Collector
 }
 
 // Exporter is responsible for initiating the Prometheus HTTP
@@ -52,12 +55,12 @@ type ExporterConfig struct {
 type Exporter struct {
 	listenAddress string
 	telemetryPath string
-	collector     *collector.Collector
+	collectors    []*collector.Collector
 	logger        zerolog.Logger
 }
 
 // NewExporter instantiates an Exporter, validating the provided
-// configuration and registering the IPVS collector with the
+// configuration and registering the IPVS collectors with the
 // prometheus client.
 func NewExporter(cfg ExporterConfig) (exporter Exporter, err error) {
 	if cfg.ListenAddress == "" {
@@ -70,12 +73,7 @@ func NewExporter(cfg ExporterConfig) (exporter Exporter, err error) {
 		return
 	}
 
-	if cfg.Collector == nil {
-		err = errors.Errorf("Collector must be specified")
-		return
-	}
-
-	exporter.collector = cfg.Collector
+	exporter.collectors = cfg.Collectors
 	exporter.listenAddress = cfg.ListenAddress
 	exporter.telemetryPath = cfg.TelemetryPath
 	exporter.logger = zerolog.New(os.Stdout).
@@ -83,10 +81,12 @@ func NewExporter(cfg ExporterConfig) (exporter Exporter, err error) {
 		Str("from", "exporter").
 		Logger()
 
-	err = prometheus.Register(exporter.collector)
-	if err != nil {
-		err = errors.Wrapf(err, "failed to register ipvs collector")
-		return
+	for _, collector := range exporter.collectors {
+		err = prometheus.Register(collector)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to register ipvs collector")
+			return
+		}
 	}
 
 	return
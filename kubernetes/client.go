@@ -0,0 +1,283 @@
+// kubernetes defines a minimal client of the Kubernetes API (list
+// and watch of Services and EndpointSlices) and the enrichers that
+// make use of it to label the ipvs metrics of kube-proxy (IPVS mode)
+// with the Kubernetes Services and Pods behind them.
+package kubernetes
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// servicesPath is where Services of all namespaces are
+	// listed and watched.
+	servicesPath = "/api/v1/services"
+
+	// endpointSlicesPath is where EndpointSlices of all
+	// namespaces are listed and watched.
+	endpointSlicesPath = "/apis/discovery.k8s.io/v1/endpointslices"
+)
+
+// ObjectMeta is the metadata of a Kubernetes object, with only
+// the fields that matter here.
+type ObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	ResourceVersion string            `json:"resourceVersion"`
+	Labels          map[string]string `json:"labels"`
+}
+
+// Service is a Kubernetes Service, with only the fields that
+// matter here.
+type Service struct {
+	Metadata ObjectMeta `json:"metadata"`
+
+	Spec struct {
+		ClusterIP   string   `json:"clusterIP"`
+		ClusterIPs  []string `json:"clusterIPs"`
+		ExternalIPs []string `json:"externalIPs"`
+		Ports       []struct {
+			Protocol string `json:"protocol"`
+			Port     uint16 `json:"port"`
+			NodePort uint16 `json:"nodePort"`
+		} `json:"ports"`
+	} `json:"spec"`
+
+	Status struct {
+		LoadBalancer struct {
+			Ingress []struct {
+				IP string `json:"ip"`
+			} `json:"ingress"`
+		} `json:"loadBalancer"`
+	} `json:"status"`
+}
+
+// EndpointSlice is a Kubernetes EndpointSlice
+// (discovery.k8s.io/v1), with only the fields that matter here.
+type EndpointSlice struct {
+	Metadata ObjectMeta `json:"metadata"`
+
+	Endpoints []struct {
+		Addresses []string `json:"addresses"`
+		TargetRef *struct {
+			Kind      string `json:"kind"`
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"targetRef"`
+	} `json:"endpoints"`
+}
+
+// list is a list of Kubernetes objects as retrieved via a list
+// request.
+type list struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+
+	Items []json.RawMessage `json:"items"`
+}
+
+// WatchEvent is an event from a watch request.
+type WatchEvent struct {
+	// Type is one of ADDED, MODIFIED, DELETED, BOOKMARK
+	// or ERROR.
+	Type string `json:"type"`
+
+	// Object is the object that changed (or a Status, for
+	// ERROR events).
+	Object json.RawMessage `json:"object"`
+}
+
+// errResourceVersionGone indicates that a watch can't resume
+// from the given resource version anymore, requiring a new list.
+var errResourceVersionGone = errors.New("resource version too old")
+
+// Client talks to the Kubernetes API server.
+type Client struct {
+	credentials Credentials
+	http        *http.Client
+}
+
+// NewClient creates a Client that authenticates with the given
+// credentials.
+func NewClient(credentials Credentials) (client *Client) {
+	client = &Client{
+		credentials: credentials,
+		http: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: credentials.TLS,
+			},
+		},
+	}
+	return
+}
+
+// get performs a request against an API endpoint, checking
+// that it succeeded.
+func (c *Client) get(ctx context.Context, path string, query url.Values) (res *http.Response, err error) {
+	req, err := http.NewRequest(http.MethodGet,
+		c.credentials.Server+path+"?"+query.Encode(), nil)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"failed to create request to %s",
+			path)
+		return
+	}
+
+	token := c.credentials.Token
+	if c.credentials.Exec != nil {
+		token, err = c.credentials.Exec.Token()
+		if err != nil {
+			err = errors.Wrapf(err,
+				"failed to retrieve token for %s",
+				path)
+			return
+		}
+	}
+
+	switch {
+	case token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	case c.credentials.Username != "":
+		req.SetBasicAuth(c.credentials.Username, c.credentials.Password)
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	res, err = c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		err = errors.Wrapf(err,
+			"failed to request %s",
+			path)
+		return
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+
+		if res.StatusCode == http.StatusGone {
+			err = errResourceVersionGone
+			return
+		}
+
+		// the token of an exec plugin might have been
+		// revoked before it expired
+		if res.StatusCode == http.StatusUnauthorized && c.credentials.Exec != nil {
+			c.credentials.Exec.Expire()
+		}
+
+		err = errors.Errorf("request to %s failed with status %d",
+			path, res.StatusCode)
+		return
+	}
+
+	return
+}
+
+// List retrieves all of the objects at `path` (e.g.,
+// servicesPath) along with the resource version that a watch
+// can start from.
+func (c *Client) List(path string) (items []json.RawMessage, resourceVersion string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	res, err := c.get(ctx, path, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	var l list
+
+	err = json.NewDecoder(res.Body).Decode(&l)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"failed to decode list from %s",
+			path)
+		return
+	}
+
+	items, resourceVersion = l.Items, l.Metadata.ResourceVersion
+	return
+}
+
+// Watch calls `handle` with each of the changes to the objects
+// at `path` that happened after `resourceVersion` until either
+// the stream ends or `stop` is closed.
+//
+// It blocks, returning nil when the server ends the stream (or
+// `stop` is closed) and errResourceVersionGone when the watch
+// can't resume from `resourceVersion` anymore.
+func (c *Client) Watch(path, resourceVersion string, handle func(WatchEvent), stop <-chan struct{}) (err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	res, err := c.get(ctx, path, url.Values{
+		"watch":               {"1"},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+	})
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(res.Body))
+	for {
+		var event WatchEvent
+
+		err = decoder.Decode(&event)
+		if err != nil {
+			select {
+			case <-stop:
+				err = nil
+			default:
+				if err == io.EOF {
+					err = nil
+					break
+				}
+
+				err = errors.Wrapf(err,
+					"watch of %s broke",
+					path)
+			}
+			return
+		}
+
+		if event.Type == "ERROR" {
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+
+			json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				err = errResourceVersionGone
+				return
+			}
+
+			err = errors.Errorf("watch of %s failed: %s",
+				path, status.Message)
+			return
+		}
+
+		handle(event)
+	}
+}
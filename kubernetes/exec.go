@@ -0,0 +1,114 @@
+package kubernetes
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// execCredential is the ExecCredential that exec plugins print,
+// with only the fields that matter here.
+type execCredential struct {
+	Status struct {
+		Token               string    `json:"token"`
+		ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+	} `json:"status"`
+}
+
+// ExecPlugin retrieves bearer tokens by running a command (the
+// `exec` of a kubeconfig user), as kubectl does for, e.g., cloud
+// providers' clusters.
+//
+// Tokens are kept until they expire (or Expire is called), only
+// then running the command again.
+type ExecPlugin struct {
+	// APIVersion is the version of the ExecCredential that
+	// the command prints (e.g.,
+	// client.authentication.k8s.io/v1).
+	APIVersion string
+
+	// Command is the command to run along with its Args.
+	Command string
+	Args    []string
+
+	// Env holds the variables (as NAME=value) that the
+	// command runs with, in addition to the exporter's own.
+	Env []string
+
+	token  string
+	expiry time.Time
+	sync.Mutex
+}
+
+// Token retrieves a bearer token, running the command if there's
+// none that hasn't expired.
+func (p *ExecPlugin) Token() (token string, err error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.token != "" && (p.expiry.IsZero() || time.Now().Before(p.expiry)) {
+		token = p.token
+		return
+	}
+
+	info, err := json.Marshal(map[string]interface{}{
+		"apiVersion": p.APIVersion,
+		"kind":       "ExecCredential",
+		"spec":       map[string]interface{}{"interactive": false},
+	})
+	if err != nil {
+		return
+	}
+
+	var (
+		stdout, stderr bytes.Buffer
+		cmd            = exec.Command(p.Command, p.Args...)
+	)
+
+	cmd.Env = append(append(os.Environ(), p.Env...),
+		"KUBERNETES_EXEC_INFO="+string(info))
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		err = errors.Wrapf(err,
+			"exec plugin %s failed: %s",
+			p.Command, bytes.TrimSpace(stderr.Bytes()))
+		return
+	}
+
+	var credential execCredential
+
+	err = json.Unmarshal(stdout.Bytes(), &credential)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"failed to decode credential from exec plugin %s",
+			p.Command)
+		return
+	}
+
+	if credential.Status.Token == "" {
+		err = errors.Errorf("exec plugin %s provided no token (client certificates are not supported)",
+			p.Command)
+		return
+	}
+
+	p.token, p.expiry = credential.Status.Token, credential.Status.ExpirationTimestamp
+	token = p.token
+	return
+}
+
+// Expire discards the current token (e.g., once the API server
+// rejects it) so that the next call to Token runs the command
+// again.
+func (p *ExecPlugin) Expire() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.token = ""
+}
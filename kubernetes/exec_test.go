@@ -0,0 +1,100 @@
+package kubernetes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// execScript is an exec plugin that prints a credential with the
+// token in $TOKEN (expiring at $EXPIRY, if set), recording each
+// run (and the exec info it got) in $RUNS.
+const execScript = `#!/bin/sh
+echo "$KUBERNETES_EXEC_INFO" >> "$RUNS"
+[ -n "$TOKEN" ] || exit 1
+expiry=
+[ -z "$EXPIRY" ] || expiry=', "expirationTimestamp": "'"$EXPIRY"'"'
+echo '{"apiVersion": "client.authentication.k8s.io/v1", "kind": "ExecCredential",'
+echo ' "status": {"token": "'"$TOKEN"'"'"$expiry"'}}'
+`
+
+// writeExecScript writes execScript into `dir`, returning its
+// path.
+func writeExecScript(t *testing.T, dir string) (path string) {
+	path = filepath.Join(dir, "plugin.sh")
+	require.NoError(t, ioutil.WriteFile(path, []byte(execScript), 0700))
+	return
+}
+
+// countRuns retrieves how many times the plugin ran.
+func countRuns(t *testing.T, runs string) int {
+	content, err := ioutil.ReadFile(runs)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	require.NoError(t, err)
+
+	return strings.Count(string(content), "\n")
+}
+
+func TestExecPlugin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var (
+		runs   = filepath.Join(dir, "runs")
+		plugin = &ExecPlugin{
+			APIVersion: "client.authentication.k8s.io/v1",
+			Command:    writeExecScript(t, dir),
+			Env: []string{
+				"RUNS=" + runs,
+				"TOKEN=secret",
+				"EXPIRY=" + time.Now().Add(time.Hour).Format(time.RFC3339),
+			},
+		}
+	)
+
+	token, err := plugin.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "secret", token)
+
+	content, err := ioutil.ReadFile(runs)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `"kind":"ExecCredential"`)
+	assert.Contains(t, string(content), `"apiVersion":"client.authentication.k8s.io/v1"`)
+
+	// tokens are kept until they expire
+	token, err = plugin.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "secret", token)
+	assert.Equal(t, 1, countRuns(t, runs))
+
+	plugin.Expire()
+	_, err = plugin.Token()
+	require.NoError(t, err)
+	assert.Equal(t, 2, countRuns(t, runs))
+
+	plugin.Env[2] = "EXPIRY=" + time.Now().Add(-time.Minute).Format(time.RFC3339)
+	plugin.Expire()
+	_, err = plugin.Token()
+	require.NoError(t, err)
+	_, err = plugin.Token()
+	require.NoError(t, err)
+	assert.Equal(t, 4, countRuns(t, runs))
+
+	// failures and credentials without a token
+	plugin.Env[1] = "TOKEN="
+	_, err = plugin.Token()
+	assert.Error(t, err)
+
+	plugin.Command = filepath.Join(dir, "inexistent")
+	_, err = plugin.Token()
+	assert.Error(t, err)
+}
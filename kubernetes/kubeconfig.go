@@ -0,0 +1,292 @@
+package kubernetes
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// kubeconfig is a kubeconfig file (as used by kubectl) with only
+// the fields that matter here.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			Username              string `yaml:"username"`
+			Password              string `yaml:"password"`
+
+			Exec *struct {
+				APIVersion string   `yaml:"apiVersion"`
+				Command    string   `yaml:"command"`
+				Args       []string `yaml:"args"`
+				Env        []struct {
+					Name  string `yaml:"name"`
+					Value string `yaml:"value"`
+				} `yaml:"env"`
+			} `yaml:"exec"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+// Credentials hold what's needed to reach and authenticate
+// against the Kubernetes API server.
+type Credentials struct {
+	// Server is the URL of the API server (e.g.,
+	// https://10.0.0.1:6443).
+	Server string
+
+	// TLS configures the verification of the server and
+	// the client certificate (if any).
+	TLS *tls.Config
+
+	// Token is a bearer token (if any).
+	Token string
+
+	// Exec is the plugin that provides bearer tokens (if
+	// any), taking precedence over Token.
+	Exec *ExecPlugin
+
+	// Username and Password are used for basic
+	// authentication (if set).
+	Username string
+	Password string
+}
+
+// DefaultKubeconfigPath retrieves the path to the kubeconfig file
+// that kubectl would use by default: the first of the paths in
+// $KUBECONFIG or ~/.kube/config.
+func DefaultKubeconfigPath() string {
+	if paths := filepath.SplitList(os.Getenv("KUBECONFIG")); len(paths) > 0 {
+		return paths[0]
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".kube", "config")
+}
+
+// LoadKubeconfig retrieves the credentials of a context (the
+// current one, if `context` is empty) from the kubeconfig file
+// at `path`.
+//
+// Relative paths to certificates, keys, token files and exec
+// plugins are resolved against the directory of the kubeconfig
+// file.
+func LoadKubeconfig(path, context string) (credentials Credentials, err error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"failed to read kubeconfig %s",
+			path)
+		return
+	}
+
+	var cfg kubeconfig
+
+	// JSON being a subset of YAML, kubeconfigs written in
+	// either are decoded alike
+	err = yaml.Unmarshal(content, &cfg)
+	if err != nil {
+		err = errors.Wrapf(err,
+			"failed to parse kubeconfig %s",
+			path)
+		return
+	}
+
+	if context == "" {
+		context = cfg.CurrentContext
+	}
+
+	var clusterName, userName string
+	found := false
+	for _, c := range cfg.Contexts {
+		if c.Name == context {
+			clusterName, userName, found = c.Context.Cluster, c.Context.User, true
+			break
+		}
+	}
+
+	if !found {
+		err = errors.Errorf("context %q not found in kubeconfig %s",
+			context, path)
+		return
+	}
+
+	var (
+		dir     = filepath.Dir(path)
+		resolve = func(file string) string {
+			if file == "" || filepath.IsAbs(file) {
+				return file
+			}
+
+			return filepath.Join(dir, file)
+		}
+	)
+
+	found = false
+	credentials.TLS = &tls.Config{}
+	for _, c := range cfg.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+
+		found = true
+		credentials.Server = strings.TrimSuffix(c.Cluster.Server, "/")
+		credentials.TLS.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+
+		var ca []byte
+
+		ca, err = readData(c.Cluster.CertificateAuthorityData,
+			resolve(c.Cluster.CertificateAuthority))
+		if err != nil {
+			err = errors.Wrapf(err,
+				"failed to read certificate authority of cluster %s",
+				clusterName)
+			return
+		}
+
+		if len(ca) != 0 {
+			credentials.TLS.RootCAs = x509.NewCertPool()
+			if !credentials.TLS.RootCAs.AppendCertsFromPEM(ca) {
+				err = errors.Errorf("no certificates found in the certificate authority of cluster %s",
+					clusterName)
+				return
+			}
+		}
+		break
+	}
+
+	if !found || credentials.Server == "" {
+		err = errors.Errorf("cluster %q not found in kubeconfig %s",
+			clusterName, path)
+		return
+	}
+
+	for _, u := range cfg.Users {
+		if u.Name != userName {
+			continue
+		}
+
+		credentials.Token = u.User.Token
+		credentials.Username = u.User.Username
+		credentials.Password = u.User.Password
+
+		if credentials.Token == "" && u.User.TokenFile != "" {
+			var token []byte
+
+			token, err = ioutil.ReadFile(resolve(u.User.TokenFile))
+			if err != nil {
+				err = errors.Wrapf(err,
+					"failed to read token of user %s",
+					userName)
+				return
+			}
+
+			credentials.Token = strings.TrimSpace(string(token))
+		}
+
+		if exec := u.User.Exec; exec != nil {
+			command := exec.Command
+			if strings.ContainsRune(command, filepath.Separator) {
+				command = resolve(command)
+			}
+
+			credentials.Exec = &ExecPlugin{
+				APIVersion: exec.APIVersion,
+				Command:    command,
+				Args:       exec.Args,
+			}
+
+			for _, env := range exec.Env {
+				credentials.Exec.Env = append(credentials.Exec.Env,
+					env.Name+"="+env.Value)
+			}
+		}
+
+		var cert, key []byte
+
+		cert, err = readData(u.User.ClientCertificateData, resolve(u.User.ClientCertificate))
+		if err != nil {
+			err = errors.Wrapf(err,
+				"failed to read client certificate of user %s",
+				userName)
+			return
+		}
+
+		key, err = readData(u.User.ClientKeyData, resolve(u.User.ClientKey))
+		if err != nil {
+			err = errors.Wrapf(err,
+				"failed to read client key of user %s",
+				userName)
+			return
+		}
+
+		if len(cert) != 0 {
+			var pair tls.Certificate
+
+			pair, err = tls.X509KeyPair(cert, key)
+			if err != nil {
+				err = errors.Wrapf(err,
+					"malformed client certificate of user %s",
+					userName)
+				return
+			}
+
+			credentials.TLS.Certificates = []tls.Certificate{pair}
+		}
+		break
+	}
+
+	return
+}
+
+// readData retrieves the contents of either the base64-encoded
+// `data` or, if empty, the file at `path` (if any).
+func readData(data, path string) (content []byte, err error) {
+	if data != "" {
+		content, err = base64.StdEncoding.DecodeString(data)
+		return
+	}
+
+	if path != "" {
+		content, err = ioutil.ReadFile(path)
+	}
+
+	return
+}
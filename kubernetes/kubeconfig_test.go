@@ -0,0 +1,187 @@
+package kubernetes
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serverCA retrieves the certificate of the fake API server,
+// PEM-encoded.
+func serverCA(api *fakeAPIServer) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: api.server.Certificate().Raw,
+	})
+}
+
+// writeKubeconfig writes a kubeconfig (as kubectl would) that
+// points to the fake API server, returning its path.
+func writeKubeconfig(t *testing.T, api *fakeAPIServer) (path string) {
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	require.NoError(t, err)
+
+	path = filepath.Join(dir, "config")
+	require.NoError(t, ioutil.WriteFile(path, []byte(fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- cluster:
+    certificate-authority-data: %s
+    server: %s
+  name: test
+contexts:
+- context:
+    cluster: test
+    user: exporter
+  name: test
+current-context: test
+preferences: {}
+users:
+- name: exporter
+  user:
+    token: %s
+`, base64.StdEncoding.EncodeToString(serverCA(api)), api.server.URL, api.token)), 0600))
+
+	return
+}
+
+func TestLoadKubeconfig(t *testing.T) {
+	api := newFakeAPIServer(t)
+	defer api.close()
+
+	path := writeKubeconfig(t, api)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	credentials, err := LoadKubeconfig(path, "")
+	require.NoError(t, err)
+	assert.Equal(t, api.server.URL, credentials.Server)
+	assert.Equal(t, "secret", credentials.Token)
+	assert.NotNil(t, credentials.TLS.RootCAs)
+
+	items, resourceVersion, err := NewClient(credentials).List(servicesPath)
+	require.NoError(t, err)
+	assert.Empty(t, items)
+	assert.Equal(t, "1", resourceVersion)
+
+	_, err = LoadKubeconfig(path, "inexistent")
+	assert.Error(t, err)
+
+	_, err = LoadKubeconfig(filepath.Join(filepath.Dir(path), "inexistent"), "")
+	assert.Error(t, err)
+}
+
+func TestLoadKubeconfigRelativeFiles(t *testing.T) {
+	api := newFakeAPIServer(t)
+	defer api.close()
+
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ca.crt"), serverCA(api), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "token"), []byte("secret\n"), 0600))
+
+	// kubeconfigs can also be written in JSON
+	path := filepath.Join(dir, "config.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(fmt.Sprintf(`{
+		"clusters": [{"name": "test", "cluster": {"server": %q, "certificate-authority": "ca.crt"}}],
+		"users": [{"name": "exporter", "user": {"tokenFile": "token"}}],
+		"contexts": [
+			{"name": "other", "context": {"cluster": "other", "user": "other"}},
+			{"name": "test", "context": {"cluster": "test", "user": "exporter"}}
+		],
+		"current-context": "other"
+	}`, api.server.URL)), 0600))
+
+	_, err = LoadKubeconfig(path, "")
+	assert.Error(t, err, "cluster of the current context doesn't exist")
+
+	credentials, err := LoadKubeconfig(path, "test")
+	require.NoError(t, err)
+	assert.Equal(t, "secret", credentials.Token)
+
+	_, _, err = NewClient(credentials).List(endpointSlicesPath)
+	assert.NoError(t, err)
+
+	_, _, err = NewClient(Credentials{Server: api.server.URL}).List(endpointSlicesPath)
+	assert.Error(t, err, "server certificate isn't trusted")
+}
+
+func TestLoadKubeconfigExec(t *testing.T) {
+	api := newFakeAPIServer(t)
+	defer api.close()
+
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var (
+		runs = filepath.Join(dir, "runs")
+		path = filepath.Join(dir, "config")
+	)
+
+	writeExecScript(t, dir)
+	require.NoError(t, ioutil.WriteFile(path, []byte(fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- cluster:
+    certificate-authority-data: %s
+    server: %s
+  name: test
+contexts:
+- context:
+    cluster: test
+    user: exporter
+  name: test
+current-context: test
+users:
+- name: exporter
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1
+      command: ./plugin.sh
+      args: []
+      env:
+      - name: RUNS
+        value: %s
+      - name: TOKEN
+        value: secret
+      interactiveMode: Never
+`, base64.StdEncoding.EncodeToString(serverCA(api)), api.server.URL, runs)), 0600))
+
+	credentials, err := LoadKubeconfig(path, "")
+	require.NoError(t, err)
+	require.NotNil(t, credentials.Exec)
+	assert.Equal(t, filepath.Join(dir, "plugin.sh"), credentials.Exec.Command)
+
+	// the plugin only runs once there's a request to make
+	assert.Equal(t, 0, countRuns(t, runs))
+
+	client := NewClient(credentials)
+
+	_, _, err = client.List(servicesPath)
+	require.NoError(t, err)
+	_, _, err = client.List(servicesPath)
+	require.NoError(t, err)
+	assert.Equal(t, 1, countRuns(t, runs))
+
+	// tokens are retrieved again once rejected
+	api.Lock()
+	api.token = "rotated"
+	api.Unlock()
+
+	_, _, err = client.List(servicesPath)
+	assert.Error(t, err)
+	assert.Equal(t, 1, countRuns(t, runs))
+
+	_, _, err = client.List(servicesPath)
+	assert.Error(t, err)
+	assert.Equal(t, 2, countRuns(t, runs))
+}
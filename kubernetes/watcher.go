@@ -0,0 +1,436 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mqliang/libipvs"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+var (
+	// serviceLabels are the labels that the ServiceEnricher
+	// provides.
+	serviceLabels = []string{"kubernetes_namespace", "kubernetes_service"}
+
+	// podLabels are the labels that the PodEnricher provides.
+	podLabels = []string{"pod"}
+)
+
+// WatcherConfig provides the necessary configuration for
+// initializing a Watcher.
+type WatcherConfig struct {
+	// Client is the client of the Kubernetes API server.
+	Client *Client
+
+	// RetryInterval is how long to wait before listing the
+	// objects again after failing to list or watch them.
+	RetryInterval time.Duration
+}
+
+// serviceRef identifies a Kubernetes Service.
+type serviceRef struct {
+	namespace string
+	name      string
+}
+
+// index allows the virtual servers and real servers that
+// kube-proxy creates to be looked up.
+type index struct {
+	// byAddress indexes services by "protocol|address|port"
+	// for each cluster, external and load balancer IP.
+	byAddress map[string]*serviceRef
+
+	// byNodePort indexes services by "protocol|port" for
+	// each node port, which kube-proxy binds to every node
+	// address.
+	byNodePort map[string]*serviceRef
+
+	// pods indexes the names of the pods by their addresses.
+	pods map[string]string
+}
+
+// Watcher keeps a cache of the Kubernetes Services and
+// EndpointSlices of all namespaces by watching them, allowing
+// the enrichers (see ServiceEnricher and PodEnricher) to label
+// the virtual and real servers that kube-proxy (in IPVS mode)
+// creates.
+type Watcher struct {
+	logger zerolog.Logger
+	cfg    WatcherConfig
+
+	services       map[string]*Service
+	endpointSlices map[string]*EndpointSlice
+
+	// idx is rebuilt from the cache on the first lookup
+	// after a change (when dirty).
+	idx   *index
+	dirty bool
+	sync.Mutex
+}
+
+// NewWatcher initializes a Watcher.
+//
+// The cache is only filled once Run is called.
+func NewWatcher(cfg WatcherConfig) (watcher *Watcher, err error) {
+	if cfg.Client == nil {
+		err = errors.Errorf("a client must be specified")
+		return
+	}
+
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = 5 * time.Second
+	}
+
+	watcher = &Watcher{
+		cfg:            cfg,
+		services:       map[string]*Service{},
+		endpointSlices: map[string]*EndpointSlice{},
+		dirty:          true,
+		logger: zerolog.New(os.Stdout).
+			With().
+			Str("from", "kubernetes").
+			Logger(),
+	}
+	return
+}
+
+// Run fills the cache and keeps it up to date by watching
+// Services and EndpointSlices until `stop` is closed.
+//
+// Whenever listing or watching fails, the objects are listed
+// again after `RetryInterval`.
+func (w *Watcher) Run(stop <-chan struct{}) {
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		w.follow(servicesPath, w.decodeService, stop)
+	}()
+	go func() {
+		defer wg.Done()
+		w.follow(endpointSlicesPath, w.decodeEndpointSlice, stop)
+	}()
+
+	wg.Wait()
+}
+
+// decodeService decodes a Service, returning the function that
+// stores it (or removes it) from the cache.
+func (w *Watcher) decodeService(raw json.RawMessage) (meta ObjectMeta, store func(deleted bool), err error) {
+	var service Service
+
+	err = json.Unmarshal(raw, &service)
+	if err != nil {
+		return
+	}
+
+	meta = service.Metadata
+	store = func(deleted bool) {
+		key := meta.Namespace + "/" + meta.Name
+		if deleted {
+			delete(w.services, key)
+			return
+		}
+
+		w.services[key] = &service
+	}
+	return
+}
+
+// decodeEndpointSlice decodes an EndpointSlice, returning the
+// function that stores it (or removes it) from the cache.
+func (w *Watcher) decodeEndpointSlice(raw json.RawMessage) (meta ObjectMeta, store func(deleted bool), err error) {
+	var slice EndpointSlice
+
+	err = json.Unmarshal(raw, &slice)
+	if err != nil {
+		return
+	}
+
+	meta = slice.Metadata
+	store = func(deleted bool) {
+		key := meta.Namespace + "/" + meta.Name
+		if deleted {
+			delete(w.endpointSlices, key)
+			return
+		}
+
+		w.endpointSlices[key] = &slice
+	}
+	return
+}
+
+// follow lists the objects at `path` and then watches them,
+// applying the changes to the cache until `stop` is closed.
+func (w *Watcher) follow(
+	path string,
+	decode func(json.RawMessage) (ObjectMeta, func(deleted bool), error),
+	stop <-chan struct{},
+) {
+	for {
+		err := w.listAndWatch(path, decode, stop)
+		if err == nil {
+			return
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if err == errResourceVersionGone {
+			w.logger.Debug().
+				Str("path", path).
+				Msg("watch expired - listing again")
+			continue
+		}
+
+		w.logger.Error().
+			Err(err).
+			Str("path", path).
+			Msg("failed to follow kubernetes objects")
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(w.cfg.RetryInterval):
+		}
+	}
+}
+
+// listAndWatch replaces the cached objects of a kind by those
+// listed at `path` and then applies the changes that follow,
+// resuming the watch whenever the server ends it.
+//
+// It only returns nil once `stop` is closed.
+func (w *Watcher) listAndWatch(
+	path string,
+	decode func(json.RawMessage) (ObjectMeta, func(deleted bool), error),
+	stop <-chan struct{},
+) (err error) {
+	items, resourceVersion, err := w.cfg.Client.List(path)
+	if err != nil {
+		return
+	}
+
+	stores := make([]func(deleted bool), 0, len(items))
+	for _, item := range items {
+		var store func(deleted bool)
+
+		_, store, err = decode(item)
+		if err != nil {
+			err = errors.Wrapf(err,
+				"failed to decode object from %s",
+				path)
+			return
+		}
+
+		stores = append(stores, store)
+	}
+
+	w.Lock()
+	switch path {
+	case servicesPath:
+		w.services = map[string]*Service{}
+	case endpointSlicesPath:
+		w.endpointSlices = map[string]*EndpointSlice{}
+	}
+	for _, store := range stores {
+		store(false)
+	}
+	w.dirty = true
+	w.Unlock()
+
+	w.logger.Debug().
+		Str("path", path).
+		Int("objects", len(items)).
+		Msg("listed kubernetes objects")
+
+	for {
+		err = w.cfg.Client.Watch(path, resourceVersion, func(event WatchEvent) {
+			meta, store, err := decode(event.Object)
+			if err != nil {
+				w.logger.Error().
+					Err(err).
+					Str("path", path).
+					Msg("failed to decode watch event")
+				return
+			}
+
+			resourceVersion = meta.ResourceVersion
+			if event.Type == "BOOKMARK" {
+				return
+			}
+
+			w.Lock()
+			store(event.Type == "DELETED")
+			w.dirty = true
+			w.Unlock()
+		}, stop)
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+}
+
+// index retrieves the index of the cache, rebuilding it if the
+// cache changed since it was last built.
+func (w *Watcher) index() *index {
+	w.Lock()
+	defer w.Unlock()
+
+	if !w.dirty {
+		return w.idx
+	}
+
+	idx := &index{
+		byAddress:  map[string]*serviceRef{},
+		byNodePort: map[string]*serviceRef{},
+		pods:       map[string]string{},
+	}
+
+	for _, service := range w.services {
+		ref := &serviceRef{
+			namespace: service.Metadata.Namespace,
+			name:      service.Metadata.Name,
+		}
+
+		addresses := append([]string{}, service.Spec.ClusterIPs...)
+		if len(addresses) == 0 {
+			addresses = append(addresses, service.Spec.ClusterIP)
+		}
+		addresses = append(addresses, service.Spec.ExternalIPs...)
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			addresses = append(addresses, ingress.IP)
+		}
+
+		for _, port := range service.Spec.Ports {
+			protocol := strings.ToLower(port.Protocol)
+			if protocol == "" {
+				protocol = "tcp"
+			}
+
+			if port.NodePort != 0 {
+				idx.byNodePort[protocol+"|"+strconv.Itoa(int(port.NodePort))] = ref
+			}
+
+			for _, address := range addresses {
+				parsed := net.ParseIP(address)
+				if parsed == nil {
+					// headless services ("None") have no
+					// virtual servers.
+					continue
+				}
+
+				idx.byAddress[protocol+"|"+parsed.String()+"|"+strconv.Itoa(int(port.Port))] = ref
+			}
+		}
+	}
+
+	for _, slice := range w.endpointSlices {
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.TargetRef == nil || endpoint.TargetRef.Kind != "Pod" {
+				continue
+			}
+
+			for _, address := range endpoint.Addresses {
+				parsed := net.ParseIP(address)
+				if parsed == nil {
+					continue
+				}
+
+				idx.pods[parsed.String()] = endpoint.TargetRef.Name
+			}
+		}
+	}
+
+	w.idx, w.dirty = idx, false
+	return idx
+}
+
+// ServiceEnricher retrieves an enricher that labels the virtual
+// servers with the Kubernetes Service that they belong to.
+func (w *Watcher) ServiceEnricher() *ServiceEnricher {
+	return &ServiceEnricher{watcher: w}
+}
+
+// PodEnricher retrieves an enricher that labels the real
+// servers with the Kubernetes Pod behind them.
+func (w *Watcher) PodEnricher() *PodEnricher {
+	return &PodEnricher{watcher: w}
+}
+
+// ServiceEnricher labels the ipvs services that kube-proxy
+// creates with the namespace and name of the Kubernetes Service
+// that they belong to.
+//
+// Services are matched by their cluster, external and load
+// balancer IPs and ports or, failing that, by their node ports.
+type ServiceEnricher struct {
+	watcher *Watcher
+}
+
+// Labels retrieves the names of the labels that the enricher
+// provides (`kubernetes_namespace` and `kubernetes_service`).
+func (e *ServiceEnricher) Labels() []string {
+	return serviceLabels
+}
+
+// LabelValues retrieves the namespace and name of the Kubernetes
+// Service that an ipvs service belongs to, if known.
+func (e *ServiceEnricher) LabelValues(service *libipvs.Service, destinationPort uint16, destinationAddress net.IP) []string {
+	if service.FWMark != 0 {
+		return []string{"", ""}
+	}
+
+	var (
+		idx      = e.watcher.index()
+		protocol = service.Protocol.String()
+		port     = strconv.Itoa(int(service.Port))
+	)
+
+	ref, ok := idx.byAddress[protocol+"|"+service.Address.String()+"|"+port]
+	if !ok {
+		ref, ok = idx.byNodePort[protocol+"|"+port]
+	}
+
+	if !ok {
+		return []string{"", ""}
+	}
+
+	return []string{ref.namespace, ref.name}
+}
+
+// PodEnricher labels the ipvs destinations that kube-proxy
+// creates with the name of the Kubernetes Pod behind them, as
+// found in the EndpointSlices.
+type PodEnricher struct {
+	watcher *Watcher
+}
+
+// Labels retrieves the names of the labels that the enricher
+// provides (`pod`).
+func (e *PodEnricher) Labels() []string {
+	return podLabels
+}
+
+// LabelValues retrieves the name of the Pod behind a real server
+// address, if known.
+func (e *PodEnricher) LabelValues(destination *libipvs.Destination) []string {
+	return []string{e.watcher.index().pods[destination.Address.String()]}
+}
@@ -0,0 +1,335 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mqliang/libipvs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// object is a Kubernetes object as served by the fake API
+// server.
+type object map[string]interface{}
+
+// fakeAPIServer serves the Services and EndpointSlices of a
+// Kubernetes API server over TLS, requiring a bearer token.
+type fakeAPIServer struct {
+	server *httptest.Server
+	token  string
+
+	objects map[string][]object
+	events  map[string]chan WatchEvent
+
+	// lists counts the list requests by path.
+	lists map[string]int
+
+	// expired makes the next watch of a path fail with
+	// "410 Gone".
+	expired map[string]bool
+	sync.Mutex
+}
+
+func newFakeAPIServer(t *testing.T) (api *fakeAPIServer) {
+	api = &fakeAPIServer{
+		token: "secret",
+		objects: map[string][]object{
+			servicesPath:       nil,
+			endpointSlicesPath: nil,
+		},
+		events: map[string]chan WatchEvent{
+			servicesPath:       make(chan WatchEvent),
+			endpointSlicesPath: make(chan WatchEvent),
+		},
+		lists:   map[string]int{},
+		expired: map[string]bool{},
+	}
+
+	api.server = httptest.NewTLSServer(http.HandlerFunc(api.serve))
+	return
+}
+
+func (a *fakeAPIServer) serve(w http.ResponseWriter, r *http.Request) {
+	a.Lock()
+	token := a.token
+	a.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer "+token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	events, ok := a.events[r.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Query().Get("watch") == "" {
+		a.Lock()
+		defer a.Unlock()
+
+		a.lists[r.URL.Path]++
+		json.NewEncoder(w).Encode(object{
+			"metadata": object{"resourceVersion": "1"},
+			"items":    a.objects[r.URL.Path],
+		})
+		return
+	}
+
+	if r.URL.Query().Get("resourceVersion") == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	a.Lock()
+	expired := a.expired[r.URL.Path]
+	a.expired[r.URL.Path] = false
+	a.Unlock()
+
+	if expired {
+		json.NewEncoder(w).Encode(object{
+			"type":   "ERROR",
+			"object": object{"kind": "Status", "code": http.StatusGone},
+		})
+		return
+	}
+
+	for {
+		select {
+		case event := <-events:
+			json.NewEncoder(w).Encode(event)
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (a *fakeAPIServer) setObjects(path string, objects ...object) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.objects[path] = objects
+}
+
+func (a *fakeAPIServer) listCount(path string) int {
+	a.Lock()
+	defer a.Unlock()
+
+	return a.lists[path]
+}
+
+// send sends a watch event about `obj` to the watchers of `path`.
+func (a *fakeAPIServer) send(t *testing.T, path, eventType string, obj object) {
+	raw, err := json.Marshal(obj)
+	require.NoError(t, err)
+
+	a.events[path] <- WatchEvent{Type: eventType, Object: raw}
+}
+
+func (a *fakeAPIServer) close() {
+	a.server.CloseClientConnections()
+	a.server.Close()
+}
+
+func newK8sService(namespace, name, clusterIP string, port, nodePort int) object {
+	return object{
+		"metadata": object{"namespace": namespace, "name": name, "resourceVersion": "2"},
+		"spec": object{
+			"clusterIP":  clusterIP,
+			"clusterIPs": []string{clusterIP},
+			"ports": []object{
+				{"protocol": "TCP", "port": port, "nodePort": nodePort},
+			},
+		},
+	}
+}
+
+func newEndpointSlice(namespace, name string, pods map[string]string) object {
+	var endpoints []object
+	for address, pod := range pods {
+		endpoints = append(endpoints, object{
+			"addresses": []string{address},
+			"targetRef": object{"kind": "Pod", "namespace": namespace, "name": pod},
+		})
+	}
+
+	return object{
+		"metadata":  object{"namespace": namespace, "name": name, "resourceVersion": "3"},
+		"endpoints": endpoints,
+	}
+}
+
+func virtualServer(address string, port uint16) *libipvs.Service {
+	return &libipvs.Service{
+		AddressFamily: syscall.AF_INET,
+		Protocol:      syscall.IPPROTO_TCP,
+		Address:       net.ParseIP(address),
+		Port:          port,
+	}
+}
+
+func realServer(address string) *libipvs.Destination {
+	return &libipvs.Destination{Address: net.ParseIP(address)}
+}
+
+// waitFor waits up to a second for `condition` to hold.
+func waitFor(t *testing.T, condition func() bool) {
+	for deadline := time.Now().Add(time.Second); !condition(); {
+		require.True(t, time.Now().Before(deadline), "condition never met")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestWatcher(t *testing.T, api *fakeAPIServer) (watcher *Watcher) {
+	path := writeKubeconfig(t, api)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	credentials, err := LoadKubeconfig(path, "")
+	require.NoError(t, err)
+
+	watcher, err = NewWatcher(WatcherConfig{
+		Client:        NewClient(credentials),
+		RetryInterval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	return
+}
+
+func TestWatcher(t *testing.T) {
+	api := newFakeAPIServer(t)
+	defer api.close()
+
+	api.setObjects(servicesPath,
+		newK8sService("default", "web", "10.96.0.10", 80, 30080),
+		newK8sService("default", "db", "None", 5432, 0),
+	)
+	api.setObjects(endpointSlicesPath,
+		newEndpointSlice("default", "web-abcde", map[string]string{
+			"10.244.1.5": "web-7d4b9-x2x8k",
+		}),
+	)
+
+	var (
+		watcher  = newTestWatcher(t, api)
+		services = watcher.ServiceEnricher()
+		pods     = watcher.PodEnricher()
+		stop     = make(chan struct{})
+		done     = make(chan struct{})
+	)
+
+	assert.Equal(t, []string{"kubernetes_namespace", "kubernetes_service"}, services.Labels())
+	assert.Equal(t, []string{"pod"}, pods.Labels())
+	assert.Equal(t, []string{"", ""}, services.LabelValues(virtualServer("10.96.0.10", 80), 0, nil))
+
+	go func() {
+		watcher.Run(stop)
+		close(done)
+	}()
+
+	waitFor(t, func() bool {
+		return pods.LabelValues(realServer("10.244.1.5"))[0] != "" &&
+			services.LabelValues(virtualServer("10.96.0.10", 80), 0, nil)[0] != ""
+	})
+
+	assert.Equal(t, []string{"default", "web"}, services.LabelValues(virtualServer("10.96.0.10", 80), 0, nil))
+	assert.Equal(t, []string{"default", "web"}, services.LabelValues(virtualServer("192.168.0.7", 30080), 0, nil))
+	assert.Equal(t, []string{"", ""}, services.LabelValues(virtualServer("10.96.0.10", 81), 0, nil))
+	assert.Equal(t, []string{"web-7d4b9-x2x8k"}, pods.LabelValues(realServer("10.244.1.5")))
+	assert.Equal(t, []string{""}, pods.LabelValues(realServer("10.244.1.6")))
+
+	// changes are picked up as they're watched
+	api.send(t, servicesPath, "ADDED", newK8sService("kube-system", "kube-dns", "10.96.0.53", 53, 0))
+	api.send(t, servicesPath, "DELETED", newK8sService("default", "web", "10.96.0.10", 80, 30080))
+	api.send(t, endpointSlicesPath, "MODIFIED", newEndpointSlice("default", "web-abcde", map[string]string{
+		"10.244.1.6": "web-7d4b9-qq2lm",
+	}))
+
+	waitFor(t, func() bool {
+		return pods.LabelValues(realServer("10.244.1.6"))[0] != ""
+	})
+	assert.Equal(t, []string{""}, pods.LabelValues(realServer("10.244.1.5")))
+	assert.Equal(t, []string{"kube-system", "kube-dns"}, services.LabelValues(virtualServer("10.96.0.53", 53), 0, nil))
+	assert.Equal(t, []string{"", ""}, services.LabelValues(virtualServer("10.96.0.10", 80), 0, nil))
+
+	close(stop)
+	<-done
+}
+
+func TestWatcherRelistsWhenWatchExpires(t *testing.T) {
+	api := newFakeAPIServer(t)
+	defer api.close()
+
+	api.expired[servicesPath] = true
+
+	var (
+		watcher  = newTestWatcher(t, api)
+		services = watcher.ServiceEnricher()
+		stop     = make(chan struct{})
+		done     = make(chan struct{})
+	)
+
+	go func() {
+		watcher.Run(stop)
+		close(done)
+	}()
+
+	// the first watch expires right away, making the services
+	// be listed again.
+	waitFor(t, func() bool {
+		return api.listCount(servicesPath) >= 2
+	})
+
+	api.setObjects(servicesPath, newK8sService("default", "web", "10.96.0.10", 80, 0))
+	waitFor(t, func() bool {
+		api.server.CloseClientConnections()
+		return services.LabelValues(virtualServer("10.96.0.10", 80), 0, nil)[0] != ""
+	})
+
+	close(stop)
+	<-done
+}
+
+func TestWatcherUnauthorized(t *testing.T) {
+	api := newFakeAPIServer(t)
+	defer api.close()
+
+	watcher := newTestWatcher(t, api)
+	api.Lock()
+	api.token = "other"
+	api.Unlock()
+
+	api.setObjects(servicesPath, newK8sService("default", "web", "10.96.0.10", 80, 0))
+
+	var (
+		stop = make(chan struct{})
+		done = make(chan struct{})
+	)
+
+	go func() {
+		watcher.Run(stop)
+		close(done)
+	}()
+
+	// services keep being unknown while the requests fail
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{"", ""},
+		watcher.ServiceEnricher().LabelValues(virtualServer("10.96.0.10", 80), 0, nil))
+
+	close(stop)
+	<-done
+}
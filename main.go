@@ -2,26 +2,67 @@ package main
 
 import (
 	"os"
+	"time"
 
 	"github.com/alexflint/go-arg"
 	"github.com/cirocosta/ingress_ipvs_exporter/collector"
+	"github.com/cirocosta/ingress_ipvs_exporter/docker"
 	"github.com/cirocosta/ingress_ipvs_exporter/exporter"
+	"github.com/cirocosta/ingress_ipvs_exporter/kubernetes"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 )
 
+const (
+	// modeSwarm collects the ipvs services that docker swarm
+	// creates (fwmark-based, in the ingress sandbox).
+	modeSwarm = "swarm"
+
+	// modeKubeProxy collects the ipvs services that kube-proxy
+	// (in IPVS mode) creates in the host network namespace.
+	modeKubeProxy = "kube-proxy"
+)
+
 type config struct {
-	ListenAddress string `arg:"--listen-address,help:address to set the http server to listen to"`
-	TelemetryPath string `arg:"--telemetry-path,help:endpoint to receive scrape requests from prometheus"`
-	NamespacePath string `arg:"--namespace-path,help:absolute path to the network namespace where ipv is configured"`
+	Mode            string        `arg:"--mode,help:kind of ipvs services to collect (swarm or kube-proxy)"`
+	ListenAddress   string        `arg:"--listen-address,help:address to set the http server to listen to"`
+	TelemetryPath   string        `arg:"--telemetry-path,help:endpoint to receive scrape requests from prometheus"`
+	NamespacePaths  []string      `arg:"--namespace-path,separate,help:absolute path (or glob) to a network namespace where ipvs is configured (repeatable)"`
+	ConnectionTable bool          `arg:"--connection-table,help:inspect the connection table to report connections by state"`
+	Source          string        `arg:"--source,help:where to gather ipvs information from (netlink or procfs)"`
+	Include         []string      `arg:"--include,separate,help:only collect what matches all of these filters (e.g. port=30000-30100, fwmark=260, protocol=tcp, destination=10.255.0.0/16) (repeatable)"`
+	Exclude         []string      `arg:"--exclude,separate,help:leave out what matches any of these filters (repeatable)"`
+	MaxServices     int           `arg:"--max-services,help:maximum number of services reported per scrape (0 for no limit)"`
+	MaxDestinations int           `arg:"--max-destinations-per-service,help:maximum number of destinations reported per service, rolling up the rest (0 for no limit)"`
+	MetricSchema    string        `arg:"--metric-schema,help:how metrics are named (legacy or v2, which follows the prometheus naming conventions)"`
+	MetricPrefix    string        `arg:"--metric-prefix,help:prefix of the names of all metrics"`
+	RefreshInterval time.Duration `arg:"--refresh-interval,help:refresh ipvs information in the background at this interval instead of on every scrape"`
+	Discover        bool          `arg:"--discover,help:discover the network namespaces with ipvs services in the discovery directory (ignores --namespace-path)"`
+	DiscoveryDir    string        `arg:"--discovery-directory,help:directory where network namespaces are discovered"`
+	ResyncInterval  time.Duration `arg:"--resync-interval,help:interval at which the discovery directory is checked regardless of changes"`
+	DockerEnricher  bool          `arg:"--docker-enricher,help:label services with the docker swarm service and stack they belong to"`
+	DockerTasks     bool          `arg:"--docker-tasks,help:label destinations with the docker swarm task, container and node behind them (requires a manager node)"`
+	DockerSocket    string        `arg:"--docker-socket,help:path to the unix socket of the docker daemon"`
+	Kubeconfig      string        `arg:"--kubeconfig,help:path to the kubeconfig with the credentials to watch kubernetes services (kube-proxy mode)"`
+	KubeContext     string        `arg:"--kube-context,help:context of the kubeconfig to use (defaults to the current one)"`
 }
 
 var (
 	args = &config{
-		ListenAddress: ":9100",
-		TelemetryPath: "/metrics",
-		NamespacePath: "/var/run/docker/netns/ingress_sbox",
+		Mode:           modeSwarm,
+		MetricSchema:   collector.MetricSchemaLegacy,
+		MetricPrefix:   collector.DefaultMetricPrefix,
+		ListenAddress:  ":9100",
+		TelemetryPath:  "/metrics",
+		Source:         collector.SourceNetlink,
+		DiscoveryDir:   collector.DefaultDiscoveryDirectory,
+		ResyncInterval: 30 * time.Second,
+		DockerSocket:   docker.DefaultSocketPath,
 	}
 	logger = zerolog.New(os.Stdout)
+
+	defaultNamespacePath = "/var/run/docker/netns/ingress_sbox"
 )
 
 func must(err error) {
@@ -35,18 +76,130 @@ func must(err error) {
 	os.Exit(1)
 }
 
+// createCollectors creates a collector for each of the namespaces
+// specified via `--namespace-path`, skipping those that fail.
+func createCollectors(cfg collector.CollectorConfig) (collectors []*collector.Collector) {
+	if len(args.NamespacePaths) == 0 {
+		args.NamespacePaths = []string{defaultNamespacePath}
+
+		// kube-proxy sets ipvs up in the host network
+		// namespace (the exporter's own).
+		if args.Mode == modeKubeProxy {
+			args.NamespacePaths = []string{""}
+		}
+	}
+
+	namespacePaths, err := collector.ExpandNamespacePaths(args.NamespacePaths)
+	must(err)
+
+	for _, namespacePath := range namespacePaths {
+		cfg.NamespacePath = namespacePath
+
+		c, err := collector.NewCollector(cfg)
+		if err != nil {
+			logger.Error().
+				Err(err).
+				Str("namespace", namespacePath).
+				Msg("failed to create collector - skipping namespace")
+			continue
+		}
+
+		go c.Poll(nil)
+		collectors = append(collectors, &c)
+	}
+
+	return
+}
+
 func main() {
 	arg.MustParse(args)
 
-	collector, err := collector.NewCollector(collector.CollectorConfig{
-		NamespacePath: args.NamespacePath,
-	})
+	collectorConfig := collector.CollectorConfig{
+		ConnectionTable: args.ConnectionTable,
+		Source:          args.Source,
+		RefreshInterval: args.RefreshInterval,
+		MetricSchema:    args.MetricSchema,
+		MetricPrefix:    args.MetricPrefix,
+
+		MaxServices:               args.MaxServices,
+		MaxDestinationsPerService: args.MaxDestinations,
+	}
+
+	var err error
+
+	collectorConfig.Include, err = collector.ParseFilter(args.Include)
+	must(err)
+
+	collectorConfig.Exclude, err = collector.ParseFilter(args.Exclude)
 	must(err)
 
+	switch args.Mode {
+	case modeSwarm:
+	case modeKubeProxy:
+		if args.DockerEnricher || args.DockerTasks || args.Discover {
+			must(errors.Errorf("docker flags can't be used in %s mode", modeKubeProxy))
+		}
+
+		if args.Kubeconfig == "" {
+			args.Kubeconfig = kubernetes.DefaultKubeconfigPath()
+		}
+
+		credentials, err := kubernetes.LoadKubeconfig(args.Kubeconfig, args.KubeContext)
+		must(err)
+
+		watcher, err := kubernetes.NewWatcher(kubernetes.WatcherConfig{
+			Client: kubernetes.NewClient(credentials),
+		})
+		must(err)
+
+		go watcher.Run(nil)
+		collectorConfig.SkipMappings = true
+		collectorConfig.ServiceEnricher = watcher.ServiceEnricher()
+		collectorConfig.DestinationEnricher = watcher.PodEnricher()
+	default:
+		must(errors.Errorf("unknown mode %s", args.Mode))
+	}
+
+	if args.DockerEnricher {
+		enricher := docker.NewServiceEnricher(docker.ServiceEnricherConfig{
+			Client: docker.NewClient(args.DockerSocket),
+		})
+
+		go enricher.Run(nil)
+		collectorConfig.ServiceEnricher = enricher
+	}
+
+	if args.DockerTasks {
+		enricher := docker.NewTaskEnricher(docker.TaskEnricherConfig{
+			Client: docker.NewClient(args.DockerSocket),
+		})
+
+		go enricher.Run(nil)
+		collectorConfig.DestinationEnricher = enricher
+	}
+
+	var collectors []*collector.Collector
+	if args.Discover {
+		discovery, err := collector.NewDiscovery(collector.DiscoveryConfig{
+			Directory:      args.DiscoveryDir,
+			Collector:      collectorConfig,
+			Registerer:     prometheus.DefaultRegisterer,
+			ResyncInterval: args.ResyncInterval,
+		})
+		must(err)
+
+		go discovery.Run(nil)
+	} else {
+		collectors = createCollectors(collectorConfig)
+		if len(collectors) == 0 {
+			must(errors.Errorf("no network namespace could be collected"))
+		}
+	}
+
 	exporter, err := exporter.NewExporter(exporter.ExporterConfig{
 		ListenAddress: args.ListenAddress,
 		TelemetryPath: args.TelemetryPath,
-		Collector:     &collector,
+		Collectors:    collectors,
 	})
 	must(err)
 
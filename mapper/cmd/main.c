@@ -1,5 +1,39 @@
 #include "../mapper.h"
 
+#include <arpa/inet.h>
+
+static void
+print_mapping(const char* family, const m_mark_mapping_t* mapping)
+{
+	if (!mapping->is_mark_rule) {
+		return;
+	}
+
+	char destination[INET6_ADDRSTRLEN] = "";
+
+	if (mapping->destination_length) {
+		inet_ntop(mapping->destination_length == 4 ? AF_INET : AF_INET6,
+		          mapping->destination, destination,
+		          sizeof(destination));
+	}
+
+	printf("family=%s,mark=%u,mask=%u,protocol=%u,destination=%s,ports=",
+	       family,
+	       mapping->firewall_mark,
+	       mapping->firewall_mark_mask,
+	       mapping->protocol,
+	       destination);
+
+	for (unsigned int i = 0; i < mapping->port_ranges_length; i++) {
+		printf(i ? ",%u" : "%u", mapping->port_ranges[i].from);
+		if (mapping->port_ranges[i].to != mapping->port_ranges[i].from) {
+			printf("-%u", mapping->port_ranges[i].to);
+		}
+	}
+
+	printf("\n");
+}
+
 int
 main(void)
 {
@@ -12,12 +46,31 @@ main(void)
 		exit(1);
 	}
 
-	m_mark_mappings_t* mappings = m_get_mark_mappings();
+	m_mark_mappings_t* mappings = NULL;
+
+	err = m_get_mark_mappings(&mappings);
+	if (err != M_OK) {
+		fprintf(stderr,
+		        "failed to retrieve ipv4 mappings (%d): %s\n",
+		        err,
+		        strerror(errno));
+		exit(1);
+	}
+
+	for (unsigned int i = 0; mappings && i < mappings->length; i++) {
+		print_mapping("ipv4", mappings->data[i]);
+	}
+
+	m_destroy_mark_mappings(mappings);
+
+	// ip6tables is optional
+	err = m_get_mark_mappings6(&mappings);
+	if (err != M_OK) {
+		mappings = NULL;
+	}
 
-	for (unsigned int i = 0; i < mappings->length; i++) {
-		printf("mark=%d,port=%d\n",
-		       mappings->data[i]->firewall_mark,
-		       mappings->data[i]->destination_port);
+	for (unsigned int i = 0; mappings && i < mappings->length; i++) {
+		print_mapping("ipv6", mappings->data[i]);
 	}
 
 	m_destroy_mark_mappings(mappings);
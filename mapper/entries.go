@@ -0,0 +1,457 @@
+package mapper
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// tableName is the table where docker swarm marks the
+	// packets.
+	tableName = "mangle"
+
+	// hookPreRouting is the hook of the PREROUTING chain
+	// (NF_INET_PRE_ROUTING) and numHooks the number of hooks
+	// of a table (NF_INET_NUMHOOKS).
+	hookPreRouting = 0
+	numHooks       = 5
+
+	// tableInfoSize is the size of `struct ipt_getinfo` (or
+	// `struct ip6t_getinfo`).
+	tableInfoSize = 84
+
+	// xtHeaderSize is the size of the header of matches and
+	// targets (`struct xt_entry_match` and `struct
+	// xt_entry_target`) that precedes their data, where the
+	// name of the extension starts at xtNameOffset (taking up
+	// to xtNameSize bytes) followed by its revision.
+	xtHeaderSize = 32
+	xtNameOffset = 2
+	xtNameSize   = 29
+
+	// invProto is the flag of the inverted protocol
+	// (XT_INV_PROTO) in the `invflags` of an entry and
+	// ip6tFlagProto the flag that tells that ip6tables
+	// entries match the protocol (IP6T_F_PROTO).
+	invProto      = 0x40
+	ip6tFlagProto = 0x01
+
+	// invDstIP is the flag of the inverted destination
+	// address (IPT_INV_DSTIP and IP6T_INV_DSTIP).
+	invDstIP = 0x10
+)
+
+// markTargetName and markTargetRevision identify the MARK target
+// that sets marks as `--set-xmark` does, whose data (`struct
+// xt_mark_tginfo2`) holds the mark and the mask (markTargetSize).
+const (
+	markTargetName     = "MARK"
+	markTargetRevision = 2
+	markTargetSize     = 8
+)
+
+// constants from `linux/netfilter/xt_tcpudp.h`,
+// `linux/netfilter/xt_sctp.h` and
+// `linux/netfilter/xt_multiport.h`.
+const (
+	xtTCPSize       = 12
+	xtTCPInvFlags   = 11
+	xtTCPInvDstPort = 0x02
+
+	xtUDPSize       = 10
+	xtUDPInvFlags   = 8
+	xtUDPInvDstPort = 0x02
+
+	xtSCTPSize      = 292
+	xtSCTPFlags     = 284
+	xtSCTPInvFlags  = 288
+	xtSCTPDestPorts = 0x02
+
+	xtMultiportSize        = 32
+	xtMultiportV1Size      = 48
+	xtMultiportMaxPorts    = 15
+	xtMultiportDestination = 1
+	xtMultiportEither      = 2
+)
+
+// entryLayout describes where the fields that matter to the
+// mappings are in the entries (rules) of a table.
+type entryLayout struct {
+	// size is the size of the entry that precedes its
+	// matches (`sizeof(struct ipt_entry)`).
+	size int
+
+	// ipSize is the size of the `ip` (or `ipv6`) field that
+	// the entry starts with, which holds what it matches
+	// (along with its matches).
+	ipSize int
+
+	// targetOffset is the offset of the `target_offset`
+	// field, which `next_offset` follows.
+	targetOffset int
+
+	// dstOffset and dstMaskOffset are the offsets of the
+	// destination address (`dst`) and of its mask (`dmsk`),
+	// which are addrSize bytes long.
+	dstOffset     int
+	dstMaskOffset int
+	addrSize      int
+
+	// protoOffset is the offset of the `proto` field, while
+	// flagsOffset and invFlagsOffset are those of `flags`
+	// and `invflags`.
+	protoOffset    int
+	flagsOffset    int
+	invFlagsOffset int
+}
+
+var (
+	// layouts holds the layout of `struct ipt_entry` and
+	// `struct ip6t_entry` by address family.
+	layouts = map[Family]entryLayout{
+		IPv4: {size: 112, ipSize: 84, dstOffset: 4, dstMaskOffset: 12, addrSize: 4, targetOffset: 88, protoOffset: 80, flagsOffset: 82, invFlagsOffset: 83},
+		IPv6: {size: 168, ipSize: 136, dstOffset: 16, dstMaskOffset: 48, addrSize: 16, targetOffset: 140, protoOffset: 128, flagsOffset: 131, invFlagsOffset: 132},
+	}
+
+	// nativeEndian is the byte order of the structures that
+	// the kernel hands over.
+	nativeEndian binary.ByteOrder = binary.LittleEndian
+)
+
+func init() {
+	var probe uint16 = 1
+	if *(*byte)(unsafe.Pointer(&probe)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// tableInfo holds the information about a table that
+// IPT_SO_GET_INFO (or IP6T_SO_GET_INFO) retrieves.
+type tableInfo struct {
+	validHooks uint32
+
+	// hookEntry and underflow hold, for each of the hooks,
+	// the offsets of the first rule of the chain and of its
+	// policy.
+	hookEntry [numHooks]uint32
+	underflow [numHooks]uint32
+
+	numEntries uint32
+	size       uint32
+}
+
+// parseTableInfo parses a `struct ipt_getinfo`.
+func parseTableInfo(b []byte) (info tableInfo, err error) {
+	if len(b) < tableInfoSize {
+		err = errors.Errorf("table info too short (%d bytes)", len(b))
+		return
+	}
+
+	info.validHooks = nativeEndian.Uint32(b[32:])
+	for hook := 0; hook < numHooks; hook++ {
+		info.hookEntry[hook] = nativeEndian.Uint32(b[36+4*hook:])
+		info.underflow[hook] = nativeEndian.Uint32(b[56+4*hook:])
+	}
+	info.numEntries = nativeEndian.Uint32(b[76:])
+	info.size = nativeEndian.Uint32(b[80:])
+
+	return
+}
+
+// hasHook indicates whether the table has the built-in chain of
+// a hook (e.g., hookPreRouting).
+func (i *tableInfo) hasHook(hook uint) bool {
+	return i.validHooks&(1<<hook) != 0
+}
+
+// parseMappings retrieves the mappings of `fwmark -> protocol
+// and destination ports` from the rules of the PREROUTING chain
+// in `entries` (as retrieved by IPT_SO_GET_ENTRIES or
+// IP6T_SO_GET_ENTRIES), applying the marks that its rules set
+// in order (see applyMarkRules).
+//
+// A nil map is retrieved if the chain has no rules that set a
+// mark.
+func parseMappings(family Family, info tableInfo, entries []byte) (res map[uint32][]Mapping, err error) {
+	rules, err := parseRules(family, info, entries)
+	if err != nil {
+		return
+	}
+
+	res = applyMarkRules(rules)
+	return
+}
+
+// parseRules retrieves the rules of the PREROUTING chain in
+// `entries` that set a mark (with the MARK target) the same way
+// that the C implementation does:
+//
+// - the protocol is the one of the rule or, if it has none, the
+// one of its tcp, udp or sctp match;
+// - the destination is the one of the rule if it's a single
+// address (not inverted);
+// - the ports are those of the first match (tcp, udp, sctp or
+// multiport) that restricts the destination ports;
+// - the mark and mask are those of the target (`struct
+// xt_mark_tginfo2`); and
+// - the criteria are hashed from the `ip` field of the entry and
+// its matches.
+//
+// Rules with other targets (e.g., ACCEPT, CONNMARK or LOG) are
+// skipped.
+func parseRules(family Family, info tableInfo, entries []byte) (rules []markRule, err error) {
+	layout, ok := layouts[family]
+	if !ok {
+		err = errors.Errorf("unknown family %d", family)
+		return
+	}
+
+	var (
+		start = int(info.hookEntry[hookPreRouting])
+		end   = int(info.underflow[hookPreRouting])
+	)
+
+	if end > len(entries) {
+		err = errors.Errorf("chain ends past the table (%d > %d)", end, len(entries))
+		return
+	}
+
+	for offset := start; offset < end; {
+		var (
+			entry  = entries[offset:end]
+			rule   markRule
+			isMark bool
+			length int
+		)
+
+		rule, isMark, length, err = parseEntry(family, layout, entry)
+		if err != nil {
+			err = errors.Wrapf(err, "malformed rule at offset %d", offset)
+			return
+		}
+
+		if isMark {
+			rules = append(rules, rule)
+		}
+
+		offset += length
+	}
+
+	return
+}
+
+// parseEntry retrieves the mark rule of an entry (`isMark` being
+// false if its target is not MARK) as well as the length of the
+// entry (`next_offset`).
+func parseEntry(family Family, layout entryLayout, entry []byte) (rule markRule, isMark bool, length int, err error) {
+	if len(entry) < layout.size {
+		err = errors.Errorf("rule too short (%d bytes)", len(entry))
+		return
+	}
+
+	var (
+		targetOffset = int(nativeEndian.Uint16(entry[layout.targetOffset:]))
+		nextOffset   = int(nativeEndian.Uint16(entry[layout.targetOffset+2:]))
+	)
+
+	if targetOffset < layout.size || targetOffset+xtHeaderSize > nextOffset ||
+		nextOffset > len(entry) {
+		err = errors.Errorf("bad offsets (target %d, next %d)", targetOffset, nextOffset)
+		return
+	}
+
+	length = nextOffset
+
+	var (
+		target     = entry[targetOffset:nextOffset]
+		targetName = cString(target[xtNameOffset : xtNameOffset+xtNameSize])
+		targetData = target[xtHeaderSize:]
+	)
+
+	// only the revision 2 of MARK (`--set-xmark`, which all
+	// of the other options translate to) is still around
+	if targetName != markTargetName || target[xtHeaderSize-1] != markTargetRevision {
+		return
+	}
+
+	if len(targetData) < markTargetSize {
+		err = errors.Errorf("MARK target too short (%d bytes)", len(targetData))
+		return
+	}
+
+	isMark = true
+	rule.mark = nativeEndian.Uint32(targetData)
+	rule.mask = nativeEndian.Uint32(targetData[4:])
+	rule.criteria = hashCriteria(hashCriteria(fnvOffset, entry[:layout.ipSize]),
+		entry[layout.size:targetOffset])
+
+	// ip6tables only matches the protocol if told to
+	if entry[layout.invFlagsOffset]&invProto == 0 &&
+		(family != IPv6 || entry[layout.flagsOffset]&ip6tFlagProto != 0) {
+		rule.mapping.Protocol = nativeEndian.Uint16(entry[layout.protoOffset:])
+	}
+
+	if entry[layout.invFlagsOffset]&invDstIP == 0 &&
+		isFullMask(entry[layout.dstMaskOffset:layout.dstMaskOffset+layout.addrSize]) {
+		rule.mapping.Destination = append(net.IP{},
+			entry[layout.dstOffset:layout.dstOffset+layout.addrSize]...)
+	}
+
+	for offset, found := layout.size, false; offset < targetOffset && !found; {
+		matchSize := int(nativeEndian.Uint16(entry[offset:]))
+		if matchSize < xtHeaderSize || offset+matchSize > targetOffset {
+			err = errors.Errorf("bad match size %d at offset %d", matchSize, offset)
+			return
+		}
+
+		var (
+			header = entry[offset : offset+xtHeaderSize]
+			name   = cString(header[xtNameOffset : xtNameOffset+xtNameSize])
+			data   = entry[offset+xtHeaderSize : offset+matchSize]
+		)
+
+		found, err = decodeMatch(name, header[xtHeaderSize-1], data, &rule.mapping)
+		if err != nil {
+			err = errors.Wrapf(err, "malformed %s match at offset %d", name, offset)
+			return
+		}
+
+		offset += matchSize
+	}
+
+	return
+}
+
+// isFullMask indicates whether all the bits of a mask are set.
+func isFullMask(mask []byte) bool {
+	for _, b := range mask {
+		if b != 0xFF {
+			return false
+		}
+	}
+
+	return true
+}
+
+// decodeMatch updates `mapping` with the protocol and the
+// destination ports that a match restricts given its name (tcp,
+// udp, sctp or multiport - others are ignored), revision and
+// data.
+//
+// `found` indicates whether the match restricts the destination
+// ports, in which case they're appended to the mapping.
+func decodeMatch(name string, revision uint8, data []byte, mapping *Mapping) (found bool, err error) {
+	var (
+		protocol uint16
+		from, to uint16
+	)
+
+	switch name {
+	case "tcp":
+		if len(data) < xtTCPSize {
+			err = errors.Errorf("data too short (%d bytes)", len(data))
+			return
+		}
+
+		protocol = syscall.IPPROTO_TCP
+		from, to = nativeEndian.Uint16(data[4:]), nativeEndian.Uint16(data[6:])
+		found = data[xtTCPInvFlags]&xtTCPInvDstPort == 0
+	case "udp":
+		if len(data) < xtUDPSize {
+			err = errors.Errorf("data too short (%d bytes)", len(data))
+			return
+		}
+
+		protocol = syscall.IPPROTO_UDP
+		from, to = nativeEndian.Uint16(data[4:]), nativeEndian.Uint16(data[6:])
+		found = data[xtUDPInvFlags]&xtUDPInvDstPort == 0
+	case "sctp":
+		if len(data) < xtSCTPSize {
+			err = errors.Errorf("data too short (%d bytes)", len(data))
+			return
+		}
+
+		// the destination ports come first
+		protocol = syscall.IPPROTO_SCTP
+		from, to = nativeEndian.Uint16(data[0:]), nativeEndian.Uint16(data[2:])
+		found = nativeEndian.Uint32(data[xtSCTPFlags:])&xtSCTPDestPorts != 0 &&
+			nativeEndian.Uint32(data[xtSCTPInvFlags:])&xtSCTPDestPorts == 0
+	case "multiport":
+		found, err = decodeMultiport(revision, data, mapping)
+		return
+	default:
+		return
+	}
+
+	if mapping.Protocol == 0 {
+		mapping.Protocol = protocol
+	}
+
+	// matching any port doesn't restrict them
+	found = found && (from != 0 || to != 0xFFFF)
+	if found {
+		mapping.Ports = append(mapping.Ports, PortRange{From: from, To: to})
+	}
+
+	return
+}
+
+// decodeMultiport appends to `mapping` the destination ports of
+// a multiport match (`struct xt_multiport` or, for revision 1,
+// `struct xt_multiport_v1`, which supports ranges and
+// inversion).
+func decodeMultiport(revision uint8, data []byte, mapping *Mapping) (found bool, err error) {
+	size := xtMultiportSize
+	if revision >= 1 {
+		size = xtMultiportV1Size
+	}
+
+	if len(data) < size {
+		err = errors.Errorf("data too short (%d bytes)", len(data))
+		return
+	}
+
+	var (
+		flags = data[0]
+		count = int(data[1])
+	)
+
+	if count > xtMultiportMaxPorts {
+		err = errors.Errorf("too many ports (%d)", count)
+		return
+	}
+
+	if flags != xtMultiportDestination && flags != xtMultiportEither {
+		return
+	}
+
+	// pflags tells which ports start a range, with the port
+	// that follows ending it
+	var pflags []byte
+	if revision >= 1 {
+		if data[xtMultiportV1Size-1] != 0 {
+			return
+		}
+
+		pflags = data[2+2*xtMultiportMaxPorts:]
+	}
+
+	found = count > 0
+	for i := 0; i < count; i++ {
+		port := nativeEndian.Uint16(data[2+2*i:])
+		portRange := PortRange{From: port, To: port}
+
+		if pflags != nil && pflags[i] != 0 && i+1 < count {
+			i++
+			portRange.To = nativeEndian.Uint16(data[2+2*i:])
+		}
+
+		mapping.Ports = append(mapping.Ports, portRange)
+	}
+
+	return
+}
@@ -0,0 +1,315 @@
+package mapper
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loadCapture loads a mangle table dumped by testdata/capture.c
+// along with the rules that the C implementation extracted from
+// it.
+func loadCapture(t *testing.T, name string) (info tableInfo, entries []byte, expected []markRule) {
+	if nativeEndian != binary.LittleEndian {
+		t.Skip("captures are little-endian")
+	}
+
+	content, err := ioutil.ReadFile("testdata/" + name + ".bin")
+	require.NoError(t, err)
+
+	info, err = parseTableInfo(content)
+	require.NoError(t, err)
+
+	entries = content[tableInfoSize:]
+	require.Len(t, entries, int(info.size))
+
+	golden, err := os.Open("testdata/" + name + ".golden")
+	require.NoError(t, err)
+	defer golden.Close()
+
+	for scanner := bufio.NewScanner(golden); scanner.Scan(); {
+		var (
+			rule   markRule
+			fields = strings.SplitN(scanner.Text(), ",ports=", 2)
+		)
+
+		require.Len(t, fields, 2, scanner.Text())
+
+		// the destination (if any) precedes the ports
+		head := strings.SplitN(fields[0], ",destination=", 2)
+		require.Len(t, head, 2, scanner.Text())
+
+		_, err = fmt.Sscanf(head[0], "mark=%d,mask=%d,criteria=%x,protocol=%d",
+			&rule.mark, &rule.mask, &rule.criteria, &rule.mapping.Protocol)
+		require.NoError(t, err, scanner.Text())
+
+		if head[1] != "" {
+			rule.mapping.Destination = net.ParseIP(head[1])
+			if ipv4 := rule.mapping.Destination.To4(); ipv4 != nil {
+				rule.mapping.Destination = ipv4
+			}
+		}
+
+		rule.mapping.Ports = parsePorts(t, fields[1])
+		expected = append(expected, rule)
+	}
+
+	return
+}
+
+// parsePorts parses a list of ports and ranges (e.g.
+// `80,8000-8080`).
+func parsePorts(t *testing.T, value string) (res []PortRange) {
+	if value == "" {
+		return
+	}
+
+	for _, field := range strings.Split(value, ",") {
+		var (
+			from, to uint16
+			n        int
+		)
+
+		n, _ = fmt.Sscanf(field, "%d-%d", &from, &to)
+		require.NotZero(t, n, field)
+		if n == 1 {
+			to = from
+		}
+
+		res = append(res, PortRange{From: from, To: to})
+	}
+
+	return
+}
+
+func TestParseMappings(t *testing.T) {
+	var (
+		tcp = func(from, to uint16) Mapping {
+			return Mapping{Protocol: syscall.IPPROTO_TCP, Ports: []PortRange{{from, to}}}
+		}
+		common = map[uint32][]Mapping{
+			0x100: {tcp(30000, 30000)},
+			0x101: {tcp(30001, 30001), {Protocol: syscall.IPPROTO_UDP, Ports: []PortRange{{30001, 30001}}}},
+			0x103: {{Protocol: syscall.IPPROTO_SCTP, Ports: []PortRange{{30002, 30002}}}},
+			0x104: {tcp(30010, 30019)},
+			0x105: {{Protocol: syscall.IPPROTO_TCP, Ports: []PortRange{{80, 80}, {443, 443}, {8000, 8080}}}},
+			0x106: {{Protocol: syscall.IPPROTO_TCP}},
+
+			// --set-xmark 0x107 followed by --or-mark 0x8
+			0x10f: {tcp(30020, 30020)},
+
+			// --set-mark 0x200/0xff00
+			0x200: {tcp(30021, 30021)},
+		}
+		ipv4 = map[uint32][]Mapping{
+			0x102: {{Protocol: syscall.IPPROTO_TCP, Destination: net.IPv4(10, 0, 0, 2).To4()}},
+		}
+		ipv6 = map[uint32][]Mapping{
+			0x102: {{Protocol: syscall.IPPROTO_TCP, Destination: net.ParseIP("fd00::a00:2")}},
+		}
+	)
+
+	for mark, mappings := range common {
+		ipv4[mark], ipv6[mark] = mappings, mappings
+	}
+
+	for _, tc := range []struct {
+		name     string
+		family   Family
+		expected map[uint32][]Mapping
+	}{
+		{"mangle_ipv4", IPv4, ipv4},
+		{"mangle_ipv6", IPv6, ipv6},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			info, entries, expected := loadCapture(t, tc.name)
+
+			assert.True(t, info.hasHook(hookPreRouting))
+
+			rules, err := parseRules(tc.family, info, entries)
+			require.NoError(t, err)
+			assert.Equal(t, expected, rules)
+
+			res, err := parseMappings(tc.family, info, entries)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, res)
+		})
+	}
+}
+
+func TestParseMappingsEmptyChain(t *testing.T) {
+	info, entries, _ := loadCapture(t, "mangle_ipv4")
+
+	// the INPUT chain has no rules but the policy
+	info.hookEntry[hookPreRouting] = info.hookEntry[1]
+	info.underflow[hookPreRouting] = info.underflow[1]
+
+	res, err := parseMappings(IPv4, info, entries)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+}
+
+func TestParseMappingsMalformed(t *testing.T) {
+	info, entries, _ := loadCapture(t, "mangle_ipv4")
+	layout := layouts[IPv4]
+
+	var testCases = []struct {
+		desc   string
+		mangle func(info *tableInfo, entries []byte) []byte
+	}{
+		{
+			desc: "truncated table",
+			mangle: func(info *tableInfo, entries []byte) []byte {
+				return entries[:info.underflow[hookPreRouting]-1]
+			},
+		},
+		{
+			desc: "zero-sized match",
+			mangle: func(info *tableInfo, entries []byte) []byte {
+				nativeEndian.PutUint16(entries[layout.size:], 0)
+				return entries
+			},
+		},
+		{
+			desc: "target past the rule",
+			mangle: func(info *tableInfo, entries []byte) []byte {
+				nativeEndian.PutUint16(entries[layout.targetOffset:], 0xFFFF)
+				return entries
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var (
+				mangledInfo    = info
+				mangledEntries = append([]byte{}, entries...)
+			)
+
+			mangledEntries = tc.mangle(&mangledInfo, mangledEntries)
+
+			_, err := parseMappings(IPv4, mangledInfo, mangledEntries)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParseTableInfoTooShort(t *testing.T) {
+	_, err := parseTableInfo(make([]byte, tableInfoSize-1))
+	assert.Error(t, err)
+}
+
+func TestDecodeMatch(t *testing.T) {
+	var (
+		ports = func(size, offset int, from, to uint16) []byte {
+			data := make([]byte, size)
+			nativeEndian.PutUint16(data[offset:], from)
+			nativeEndian.PutUint16(data[offset+2:], to)
+			return data
+		}
+		multiport = func(size int, flags byte, ports ...uint16) []byte {
+			data := make([]byte, size)
+			data[0], data[1] = flags, byte(len(ports))
+			for i, port := range ports {
+				nativeEndian.PutUint16(data[2+2*i:], port)
+			}
+			return data
+		}
+		with = func(data []byte, offset int, value byte) []byte {
+			data[offset] = value
+			return data
+		}
+		testCases = []struct {
+			desc     string
+			name     string
+			revision uint8
+			data     []byte
+			found    bool
+			expected Mapping
+		}{
+			{
+				desc:     "tcp",
+				name:     "tcp",
+				data:     ports(xtTCPSize, 4, 80, 80),
+				found:    true,
+				expected: Mapping{Protocol: syscall.IPPROTO_TCP, Ports: []PortRange{{80, 80}}},
+			},
+			{
+				desc:     "tcp with inverted ports",
+				name:     "tcp",
+				data:     with(ports(xtTCPSize, 4, 80, 80), xtTCPInvFlags, xtTCPInvDstPort),
+				expected: Mapping{Protocol: syscall.IPPROTO_TCP},
+			},
+			{
+				desc:     "udp with any port",
+				name:     "udp",
+				data:     ports(xtUDPSize, 4, 0, 0xFFFF),
+				expected: Mapping{Protocol: syscall.IPPROTO_UDP},
+			},
+			{
+				desc:     "sctp",
+				name:     "sctp",
+				data:     with(ports(xtSCTPSize, 0, 3868, 3869), xtSCTPFlags, xtSCTPDestPorts),
+				found:    true,
+				expected: Mapping{Protocol: syscall.IPPROTO_SCTP, Ports: []PortRange{{3868, 3869}}},
+			},
+			{
+				desc:     "sctp without destination ports",
+				name:     "sctp",
+				data:     ports(xtSCTPSize, 0, 3868, 3868),
+				expected: Mapping{Protocol: syscall.IPPROTO_SCTP},
+			},
+			{
+				desc:     "multiport",
+				name:     "multiport",
+				data:     multiport(xtMultiportSize, xtMultiportEither, 80, 443),
+				found:    true,
+				expected: Mapping{Ports: []PortRange{{80, 80}, {443, 443}}},
+			},
+			{
+				desc:     "multiport with source ports",
+				name:     "multiport",
+				data:     multiport(xtMultiportSize, 0, 80, 443),
+				expected: Mapping{},
+			},
+			{
+				desc:     "inverted multiport",
+				name:     "multiport",
+				revision: 1,
+				data:     with(multiport(xtMultiportV1Size, xtMultiportDestination, 80), xtMultiportV1Size-1, 1),
+				expected: Mapping{},
+			},
+			{
+				desc:     "unknown match",
+				name:     "conntrack",
+				data:     ports(xtTCPSize, 4, 80, 80),
+				expected: Mapping{},
+			},
+		}
+	)
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var mapping Mapping
+
+			found, err := decodeMatch(tc.name, tc.revision, tc.data, &mapping)
+			require.NoError(t, err)
+			assert.Equal(t, tc.found, found)
+			assert.Equal(t, tc.expected, mapping)
+		})
+	}
+
+	for _, name := range []string{"tcp", "udp", "sctp", "multiport"} {
+		_, err := decodeMatch(name, 1, make([]byte, 8), &Mapping{})
+		assert.Error(t, err, name)
+	}
+}
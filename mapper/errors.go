@@ -0,0 +1,26 @@
+package mapper
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Errors that GetMappings reports (wrapped with the details of
+// the failure - see errors.Cause).
+var (
+	// ErrTableUnavailable indicates that the mangle table
+	// couldn't be retrieved, e.g., because the iptables lock
+	// is being held or the kernel module is not loaded.
+	ErrTableUnavailable = errors.New("mangle table unavailable")
+
+	// ErrChainNotFound indicates that the mangle table has no
+	// PREROUTING chain to look for the mappings in.
+	ErrChainNotFound = errors.New("chain PREROUTING not found")
+
+	// ErrMalformedTable indicates that the rules of the table
+	// couldn't be made sense of.
+	ErrMalformedTable = errors.New("malformed mangle table")
+
+	// ErrOutOfMemory indicates that the memory for the
+	// mappings couldn't be allocated.
+	ErrOutOfMemory = errors.New("out of memory")
+)
@@ -1,11 +1,14 @@
+//go:build cgo && !purego
+// +build cgo,!purego
+
 #include "./mapper.h"
 
-struct xtables_globals iptables_globals = { 0 };
+#include <libiptc/libiptc.h>
+#include <linux/netfilter/xt_multiport.h>
+#include <linux/netfilter/xt_sctp.h>
+#include <linux/netfilter/xt_tcpudp.h>
 
-struct xt_mark_tginfo2 {
-	__u32 mark;
-	__u32 mask;
-};
+struct xtables_globals iptables_globals = { 0 };
 
 m_mark_mapping_t*
 m_get_mark_mapping_at(m_mark_mappings_t* m, __u16 pos)
@@ -20,34 +23,29 @@ m_get_mark_mapping_at(m_mark_mappings_t* m, __u16 pos)
 m_mark_mappings_t*
 m_new_mark_mappings(__u16 length)
 {
-	m_mark_mappings_t* m = malloc(sizeof *m);
+	m_mark_mappings_t* m = calloc(1, sizeof *m);
 	if (m == NULL) {
-		goto ERR_ALOC;
+		return NULL;
 	}
 
-	m->data = malloc(length * sizeof(*m->data));
+	m->length = length;
+	m->data   = calloc(length, sizeof(*m->data));
 	if (m->data == NULL) {
 		goto ERR_ALOC;
 	}
 
 	for (unsigned int i = 0; i < length; i++) {
-		m->data[i] = malloc(sizeof *m->data[i]);
+		m->data[i] = calloc(1, sizeof *m->data[i]);
 		if (m->data[i] == NULL) {
 			goto ERR_ALOC;
 		}
 	}
 
-	m->length = length;
-
 	return m;
 
 ERR_ALOC:
-	perror("malloc");
-	fprintf(stderr,
-	        "failed to allocate enough memory for %d "
-	        "mark mappings\n",
-	        length);
-	exit(1);
+	m_destroy_mark_mappings(m);
+	return NULL;
 }
 
 void
@@ -57,7 +55,7 @@ m_destroy_mark_mappings(m_mark_mappings_t* m)
 		return;
 	}
 
-	for (int i = 0; i < m->length; i++) {
+	for (int i = 0; m->data && i < m->length; i++) {
 		if (m->data[i] == NULL) {
 			continue;
 		}
@@ -72,38 +70,197 @@ m_destroy_mark_mappings(m_mark_mappings_t* m)
 	free(m);
 }
 
+/**
+ * _m_add_port_range appends a range of destination ports
+ * to the mapping.
+ */
+static void
+_m_add_port_range(m_mark_mapping_t* mapping, __u16 from, __u16 to)
+{
+	if (mapping->port_ranges_length >= M_MAX_PORT_RANGES) {
+		return;
+	}
+
+	mapping->port_ranges[mapping->port_ranges_length].from = from;
+	mapping->port_ranges[mapping->port_ranges_length].to   = to;
+	mapping->port_ranges_length++;
+}
+
 int
-_m_get_mark_mapping_from_rule(const struct ipt_entry* rule,
-                              m_mark_mapping_t*       mapping)
+_m_get_ports_from_match(const struct xt_entry_match* match,
+                        m_mark_mapping_t*            mapping)
+{
+	const char* name     = match->u.user.name;
+	__u16       protocol = 0;
+	__u16       from = 0, to = 0xFFFF;
+	int         found    = 0;
+
+	if (!strcmp(name, "tcp")) {
+		const struct xt_tcp* info = (const void*)match->data;
+
+		protocol = IPPROTO_TCP;
+		from     = info->dpts[0];
+		to       = info->dpts[1];
+		found    = !(info->invflags & XT_TCP_INV_DSTPT);
+	} else if (!strcmp(name, "udp")) {
+		const struct xt_udp* info = (const void*)match->data;
+
+		protocol = IPPROTO_UDP;
+		from     = info->dpts[0];
+		to       = info->dpts[1];
+		found    = !(info->invflags & XT_UDP_INV_DSTPT);
+	} else if (!strcmp(name, "sctp")) {
+		const struct xt_sctp_info* info = (const void*)match->data;
+
+		protocol = IPPROTO_SCTP;
+		from     = info->dpts[0];
+		to       = info->dpts[1];
+		found    = (info->flags & XT_SCTP_DEST_PORTS) &&
+		        !(info->invflags & XT_SCTP_DEST_PORTS);
+	} else if (!strcmp(name, "multiport")) {
+		// both revisions share the layout of the ports,
+		// with revision 1 adding ranges and inversion
+		const struct xt_multiport_v1* info = (const void*)match->data;
+
+		if ((info->flags != XT_MULTIPORT_DESTINATION &&
+		     info->flags != XT_MULTIPORT_EITHER) ||
+		    info->count > XT_MULTI_PORTS ||
+		    (match->u.user.revision >= 1 && info->invert)) {
+			return 0;
+		}
+
+		for (unsigned int i = 0; i < info->count; i++) {
+			from = to = info->ports[i];
+
+			if (match->u.user.revision >= 1 && info->pflags[i] &&
+			    i + 1 < info->count) {
+				to = info->ports[++i];
+			}
+
+			_m_add_port_range(mapping, from, to);
+		}
+
+		return info->count > 0;
+	} else {
+		return 0;
+	}
+
+	if (!mapping->protocol) {
+		mapping->protocol = protocol;
+	}
+
+	// matching any port doesn't restrict them
+	if (!found || (from == 0 && to == 0xFFFF)) {
+		return 0;
+	}
+
+	_m_add_port_range(mapping, from, to);
+	return 1;
+}
+
+void
+_m_set_destination(m_mark_mapping_t* mapping,
+                   const void*       address,
+                   const void*       mask,
+                   size_t            length,
+                   int               inverted)
+{
+	const __u8* mask_bytes = mask;
+
+	if (!mapping->is_mark_rule || inverted) {
+		return;
+	}
+
+	for (size_t i = 0; i < length; i++) {
+		if (mask_bytes[i] != 0xFF) {
+			return;
+		}
+	}
+
+	memcpy(mapping->destination, address, length);
+	mapping->destination_length = length;
+}
+
+__u64
+_m_hash_criteria(__u64 hash, const void* data, size_t size)
+{
+	const __u8* bytes = data;
+
+	for (size_t i = 0; i < size; i++) {
+		hash ^= bytes[i];
+		hash *= M_FNV_PRIME;
+	}
+
+	return hash;
+}
+
+int
+_m_get_mark_mapping_from_matches(const void*                   rule,
+                                 size_t                        entry_size,
+                                 size_t                        ip_size,
+                                 __u16                         protocol,
+                                 __u16                         target_offset,
+                                 const struct xt_entry_target* rule_target,
+                                 m_mark_mapping_t*             mapping)
 {
-	const struct xt_entry_target* rule_target;
-	const struct xt_tcp*          tcp_info;
 	const struct xt_mark_tginfo2* mark_info;
 
-	rule_target = ipt_get_target((struct ipt_entry*)rule);
-	if (!rule->target_offset) {
+	if (!target_offset ||
+	    strcmp(rule_target->u.user.name, M_MARK_TARGET) ||
+	    rule_target->u.user.revision != M_MARK_TARGET_REVISION) {
 		return 0;
 	}
 
+	mapping->is_mark_rule = 1;
+	mapping->protocol     = protocol;
+
 	struct xt_entry_match* match = { 0 };
-	for (unsigned int __i = sizeof(struct ipt_entry);
-	     __i < rule->target_offset;
+	for (unsigned int __i = entry_size; __i < target_offset;
 	     __i += match->u.match_size) {
 		match = (void*)rule + __i;
 
-		tcp_info = (struct xt_tcp*)match->data;
-
-		if (tcp_info->dpts[0] != 0 || tcp_info->dpts[1] != 0xFFFF) {
-			mapping->destination_port = tcp_info->dpts[0];
+		if (_m_get_ports_from_match(match, mapping)) {
 			break;
 		}
 	}
 
-	mark_info              = (const void*)rule_target->data;
-	mapping->firewall_mark = mark_info->mark;
+	mark_info                   = (const void*)rule_target->data;
+	mapping->firewall_mark      = mark_info->mark;
+	mapping->firewall_mark_mask = mark_info->mask;
+	mapping->criteria           = _m_hash_criteria(
+	  _m_hash_criteria(M_FNV_OFFSET, rule, ip_size),
+	  rule + entry_size,
+	  target_offset - entry_size);
 	return 0;
 }
 
+int
+_m_get_mark_mapping_from_rule(const struct ipt_entry* rule,
+                              m_mark_mapping_t*       mapping)
+{
+	__u16 protocol = 0;
+
+	if (!(rule->ip.invflags & XT_INV_PROTO)) {
+		protocol = rule->ip.proto;
+	}
+
+	int err = _m_get_mark_mapping_from_matches(
+	  rule,
+	  sizeof(struct ipt_entry),
+	  sizeof(struct ipt_ip),
+	  protocol,
+	  rule->target_offset,
+	  ipt_get_target((struct ipt_entry*)rule),
+	  mapping);
+
+	_m_set_destination(mapping,
+	                   &rule->ip.dst,
+	                   &rule->ip.dmsk,
+	                   sizeof(rule->ip.dst),
+	                   rule->ip.invflags & IPT_INV_DSTIP);
+	return err;
+}
+
 int
 m_init()
 {
@@ -137,30 +294,26 @@ _m_chain_exists(struct xtc_handle* handle)
 	return -1;
 }
 
-m_mark_mappings_t*
-m_get_mark_mappings()
+int
+m_get_mark_mappings(m_mark_mappings_t** mappings)
 {
 	struct xtc_handle*      handle;
 	const struct ipt_entry* rule;
 	unsigned int            rule_count = 0;
-	m_mark_mappings_t*      mappings   = NULL;
+
+	*mappings = NULL;
 
 	// take a snapshot of the iptables rules at the
 	// current point in time
 	handle = iptc_init(M_TABLE);
 	if (!handle) {
-		fprintf(stderr,
-		        "failed to initialize table handle: %s\n",
-		        iptc_strerror(errno));
-		exit(errno);
+		return M_ERR_TABLE_UNAVAILABLE;
 	}
 
 	// check if chain exists
 	if (_m_chain_exists(handle) == -1) {
-		fprintf(stderr,
-		        "expected chain " M_CHAIN
-		        " to look for fwmark mappings doesn't exist\n");
-		exit(1);
+		iptc_free(handle);
+		return M_ERR_CHAIN_NOT_FOUND;
 	}
 
 	// count the number of rules
@@ -172,20 +325,25 @@ m_get_mark_mappings()
 
 	// nothing to do if there are no rules
 	if (rule_count == 0) {
-		return mappings;
+		iptc_free(handle);
+		return M_OK;
 	}
 
 	// create the mappings holder
-	mappings = m_new_mark_mappings(rule_count);
+	*mappings = m_new_mark_mappings(rule_count);
+	if (*mappings == NULL) {
+		iptc_free(handle);
+		return M_ERR_NO_MEMORY;
+	}
 
 	// populate the array with the mappings
 	rule = iptc_first_rule(M_CHAIN, handle);
 	for (unsigned int i = 0; i < rule_count; i++) {
-		_m_get_mark_mapping_from_rule(rule, mappings->data[i]);
+		_m_get_mark_mapping_from_rule(rule, (*mappings)->data[i]);
 		rule = iptc_next_rule(rule, handle);
 	}
 
 	iptc_free(handle);
 
-	return mappings;
+	return M_OK;
 }
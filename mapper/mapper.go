@@ -1,62 +1,132 @@
 // mapper defines the necessary methods for inspecting iptables
 // and retrieving `fwmark <--> destination_port` tuples from the
 // mangle table.
+//
+// The mappings come from both the iptables mangle table and,
+// where the rules live in nftables (native or iptables-nft),
+// the nftables ruleset (see GetMappings).
+//
+// The iptables tables are read either through libiptc (cgo) or,
+// when cgo is disabled or the `purego` build tag is set, by
+// decoding what the kernel hands over via getsockopt.
 package mapper
 
-// #cgo LDFLAGS: -lip4tc -lxtables
-// #include "./mapper.h"
 import (
-	"C"
+	"net"
+	"syscall"
 )
 
-import (
-	"os"
+// Family identifies the address family of the table
+// (iptables or ip6tables) that a set of mappings comes
+// from.
+type Family uint16
+
+const (
+	// IPv4 identifies mappings from iptables.
+	IPv4 Family = syscall.AF_INET
 
-	"github.com/pkg/errors"
-	"github.com/rs/zerolog/log"
+	// IPv6 identifies mappings from ip6tables.
+	IPv6 Family = syscall.AF_INET6
 )
 
-// init initializes the internal iptables global variables.
-//
-// ps.: it doesn't need to be network namespace-aware as it
-// doesn't touch any networking subsystem.
-func init() {
-	errno := C.m_init()
-	if errno != 0 {
-		log.Fatal().Msg("mapper's init failed")
-		os.Exit(int(errno))
-	}
+// PortRange is an inclusive range of destination ports.
+type PortRange struct {
+	From uint16
+	To   uint16
 }
 
-// GetMappings retrieves a map that represents how fwmark
-// entries are related to destination ports in the mangle
-// iptables table (in the current network namespace).
-func GetMappings() (res map[uint32]uint16, err error) {
-	mappings := C.m_get_mark_mappings()
-	if mappings == nil {
-		return
+// Mapping describes the packets that a rule marks with a fwmark:
+// those of a transport protocol with one of a set of destination
+// ports.
+type Mapping struct {
+	// Protocol is the transport protocol (syscall.IPPROTO_TCP,
+	// IPPROTO_UDP or IPPROTO_SCTP), zero if the rule doesn't
+	// restrict it.
+	Protocol uint16
+
+	// Ports are the destination ports, empty if the rule
+	// doesn't restrict them.
+	Ports []PortRange
+
+	// Destination is the destination address (4 bytes long
+	// for IPv4), nil if the rule doesn't restrict it to a
+	// single address (e.g., the virtual IP of a docker swarm
+	// service).
+	Destination net.IP
+}
+
+// Port returns the first destination port of the mapping (zero
+// if it has none).
+func (m Mapping) Port() uint16 {
+	if len(m.Ports) == 0 {
+		return 0
 	}
 
-	defer C.m_destroy_mark_mappings(mappings)
+	return m.Ports[0].From
+}
+
+// GetMappings retrieves, for each address family, a map that
+// represents how fwmark entries are related to destination ports
+// (in the current network namespace): for each fwmark, the
+// mappings of all the rules that set it (in the order of the
+// rules).
+//
+// The mappings of the nftables ruleset (native or iptables-nft)
+// and of the iptables mangle table are merged, the former going
+// first. As the mangle table might not even exist where the
+// rules live in nftables, failing to retrieve it is only
+// reported when nftables has no mappings.
+//
+// Failures to retrieve the mappings from the mangle table have
+// one of the Err* variables as their cause (see errors.Cause).
+func GetMappings() (res map[Family]map[uint32][]Mapping, err error) {
+	nftables, nftErr := getNftablesMappings()
+	if nftErr != nil {
+		nftables = nil
+	}
 
-	if mappings.length == 0 {
+	xtables, err := getXtablesMappings()
+	if err != nil {
+		if hasMappings(nftables) {
+			res, err = nftables, nil
+		}
 		return
 	}
 
-	res = make(map[uint32]uint16)
+	res = mergeMappings(nftables, xtables)
+	return
+}
 
-	var i C.ushort = 0
-	for ; i < mappings.length; i++ {
-		mapping := C.m_get_mark_mapping_at(mappings, i)
-		if mapping == nil {
-			err = errors.Errorf("couldn't retrieve fwmark "+
-				"mapping at position %d",
-				i)
-			return
+// hasMappings indicates whether any family has mappings.
+func hasMappings(mappings map[Family]map[uint32][]Mapping) bool {
+	for _, familyMappings := range mappings {
+		if len(familyMappings) > 0 {
+			return true
 		}
+	}
 
-		res[uint32(mapping.firewall_mark)] =
-			uint16(mapping.destination_port)
+	return false
+}
+
+// mergeMappings retrieves the mappings of both `first` and
+// `second`, those of the former going first for each fwmark.
+func mergeMappings(first, second map[Family]map[uint32][]Mapping) (res map[Family]map[uint32][]Mapping) {
+	res = make(map[Family]map[uint32][]Mapping)
+
+	for _, mappings := range []map[Family]map[uint32][]Mapping{first, second} {
+		for family, familyMappings := range mappings {
+			if len(familyMappings) == 0 {
+				continue
+			}
+
+			if res[family] == nil {
+				res[family] = make(map[uint32][]Mapping)
+			}
+
+			for mark, markMappings := range familyMappings {
+				res[family][mark] = append(res[family][mark], markMappings...)
+			}
+		}
 	}
 
 	return
@@ -4,7 +4,6 @@
 #include <dlfcn.h>
 #include <fcntl.h>
 #include <getopt.h>
-#include <libiptc/libiptc.h>
 #include <stdio.h>
 #include <stdlib.h>
 #include <string.h>
@@ -32,13 +31,79 @@
 // looking for the mark definitions.
 #define M_TABLE "mangle"
 
+// M_MARK_TARGET and M_MARK_TARGET_REVISION identify the
+// target of the rules that set marks (`--set-xmark`, which
+// all of the other options of MARK translate to).
+#define M_MARK_TARGET "MARK"
+#define M_MARK_TARGET_REVISION 2
+
+// M_FNV_OFFSET and M_FNV_PRIME are the parameters of the
+// hash of the criteria of the rules (see m_mark_mapping_t).
+#define M_FNV_OFFSET 14695981039346656037ULL
+#define M_FNV_PRIME 1099511628211ULL
+
+// M_OK and the M_ERR_* constants are the results of the
+// methods that retrieve mappings, which the Go side turns
+// into the corresponding errors.
+#define M_OK 0
+#define M_ERR_TABLE_UNAVAILABLE 1
+#define M_ERR_CHAIN_NOT_FOUND 2
+#define M_ERR_NO_MEMORY 3
+
+/**
+ * xt_mark_tginfo2 is the data of the MARK target
+ * (revision 2) as defined in `linux/netfilter/xt_mark.h`.
+ */
+struct xt_mark_tginfo2 {
+	__u32 mark;
+	__u32 mask;
+};
+
+// M_MAX_PORT_RANGES defines the maximum number of ranges
+// of destination ports that a mapping holds (as many as
+// the ports of a multiport match).
+#define M_MAX_PORT_RANGES 15
+
 /**
- * m_mark_mapping_t unites both destination_port and
- * firewall_mark as retrieved from iptables rules.
+ * m_port_range_t is an inclusive range of destination
+ * ports.
+ */
+typedef struct port_range {
+	__u16 from;
+	__u16 to;
+} m_port_range_t;
+
+/**
+ * m_mark_mapping_t unites the protocol and destination
+ * ports of a rule with the firewall_mark that it sets as
+ * retrieved from iptables rules.
+ *
+ * `protocol` is zero if the rule doesn't restrict it, as
+ * is `port_ranges_length` if the rule doesn't restrict the
+ * destination ports and `destination_length` if it doesn't
+ * restrict the destination to a single address (4 bytes
+ * long for IPv4, 16 for IPv6).
+ *
+ * The mark is set as `--set-xmark` does: the bits in
+ * `firewall_mark_mask` are cleared and those in
+ * `firewall_mark` flipped. `is_mark_rule` is zero (with
+ * nothing else filled) if the rule has another target.
+ *
+ * `criteria` identifies what the rule matches: the 64-bit
+ * FNV-1a hash of what precedes its target (see
+ * _m_hash_criteria), such that rules with the same criteria
+ * act on the same packets.
  */
 typedef struct mark_mapping {
-	__u16 destination_port;
-	__u32 firewall_mark;
+	__u8           is_mark_rule;
+	__u16          protocol;
+	__u8           port_ranges_length;
+	m_port_range_t port_ranges[M_MAX_PORT_RANGES];
+	__u8           destination_length;
+	__u8           destination[16];
+	__u32          firewall_mark;
+	__u32          firewall_mark_mask;
+	__u64          criteria;
 } m_mark_mapping_t;
 
 /**
@@ -61,6 +126,8 @@ m_get_mark_mapping_at(m_mark_mappings_t* m, __u16 pos);
  * struct that holds an array of mark_mapping instances
  * with an additional `length` field to auxiliate in
  * iterations and destruction.
+ *
+ * NULL is returned if the memory can't be allocated.
  */
 m_mark_mappings_t*
 m_new_mark_mappings(__u16 length);
@@ -75,16 +142,85 @@ void
 m_destroy_mark_mappings(m_mark_mappings_t* m);
 
 /**
- * m_get_mark_mappings retrieves a m_mark_mappings_t instance
- * that contains all the fwmark mappings as seens by iptables
- * in the current namespace.
+ * m_get_mark_mappings retrieves into `mappings` a
+ * m_mark_mappings_t instance that contains all the fwmark
+ * mappings as seens by iptables in the current namespace
+ * (NULL if there are no rules).
+ *
+ * M_OK is returned on success or one of the M_ERR_*
+ * constants otherwise, in which case `errno` tells why the
+ * table couldn't be retrieved (M_ERR_TABLE_UNAVAILABLE).
  *
  * note.: during the retrieval, allocations are performed. Don't
  * forget to free the `m_mark_mappings_t` structure after using
  * it.
  */
-m_mark_mappings_t*
-m_get_mark_mappings();
+int
+m_get_mark_mappings(m_mark_mappings_t** mappings);
+
+/**
+ * m_get_mark_mappings6 is the IPv6 counterpart of
+ * m_get_mark_mappings, looking for fwmark mappings in
+ * the ip6tables mangle table of the current namespace.
+ */
+int
+m_get_mark_mappings6(m_mark_mappings_t** mappings);
+
+/**
+ * _m_get_ports_from_match is an internal method that fills
+ * `mapping` with the protocol and destination ports of a
+ * match according to its name (tcp, udp, sctp or multiport -
+ * others are ignored).
+ *
+ * 1 is returned if the match restricts the destination
+ * ports, 0 otherwise.
+ */
+int
+_m_get_ports_from_match(const struct xt_entry_match* match,
+                        m_mark_mapping_t*            mapping);
+
+/**
+ * _m_set_destination is an internal method that sets the
+ * destination of `mapping` to the `length` bytes of `address`
+ * if the rule is a mark rule restricting the destination to
+ * that single address - all of the bits of `mask` being set
+ * and the address not being inverted.
+ */
+void
+_m_set_destination(m_mark_mapping_t* mapping,
+                   const void*       address,
+                   const void*       mask,
+                   size_t            length,
+                   int               inverted);
+
+/**
+ * _m_hash_criteria is an internal method that updates the
+ * criteria hash `hash` (M_FNV_OFFSET to start with) with
+ * `size` bytes from `data`.
+ */
+__u64
+_m_hash_criteria(__u64 hash, const void* data, size_t size);
+
+/**
+ * _m_get_mark_mapping_from_matches is an internal method
+ * that fills `mapping` with the protocol of a rule (zero
+ * if it has none), the destination ports found in its
+ * matches and the mark set by its target - if it's MARK.
+ *
+ * It's shared between the IPv4 and IPv6 implementations,
+ * which only differ in the size of the entry that precedes
+ * the matches (`entry_size`), in that of the field that it
+ * starts with (`ip_size`) and in where the protocol of the
+ * rule comes from.
+ */
+int
+_m_get_mark_mapping_from_matches(const void*                   rule,
+                                 size_t                        entry_size,
+                                 size_t                        ip_size,
+                                 __u16                         protocol,
+                                 __u16                         target_offset,
+                                 const struct xt_entry_target* rule_target,
+                                 m_mark_mapping_t*             mapping);
 
 /**
  * m_init takes care of initializing the internal global
@@ -0,0 +1,108 @@
+//go:build cgo && !purego
+// +build cgo,!purego
+
+#include "./mapper.h"
+
+#include <libiptc/libip6tc.h>
+
+int
+_m_get_mark_mapping_from_rule6(const struct ip6t_entry* rule,
+                               m_mark_mapping_t*        mapping)
+{
+	__u16 protocol = 0;
+
+	// ip6tables only matches the protocol if told to
+	if ((rule->ipv6.flags & IP6T_F_PROTO) &&
+	    !(rule->ipv6.invflags & XT_INV_PROTO)) {
+		protocol = rule->ipv6.proto;
+	}
+
+	int err = _m_get_mark_mapping_from_matches(
+	  rule,
+	  sizeof(struct ip6t_entry),
+	  sizeof(struct ip6t_ip6),
+	  protocol,
+	  rule->target_offset,
+	  ip6t_get_target((struct ip6t_entry*)rule),
+	  mapping);
+
+	_m_set_destination(mapping,
+	                   &rule->ipv6.dst,
+	                   &rule->ipv6.dmsk,
+	                   sizeof(rule->ipv6.dst),
+	                   rule->ipv6.invflags & IP6T_INV_DSTIP);
+	return err;
+}
+
+/**
+ * _m_chain_exists6 is an internal method that verifies whether
+ * the desired chain exists in the current ip6tables table.
+ */
+int
+_m_chain_exists6(struct xtc_handle* handle)
+{
+	const char* chain = NULL;
+
+	for (chain = ip6tc_first_chain(handle); chain;
+	     chain = ip6tc_next_chain(handle)) {
+		if (!strcmp(chain, M_CHAIN)) {
+			return 0;
+		}
+	}
+
+	return -1;
+}
+
+int
+m_get_mark_mappings6(m_mark_mappings_t** mappings)
+{
+	struct xtc_handle*       handle;
+	const struct ip6t_entry* rule;
+	unsigned int             rule_count = 0;
+
+	*mappings = NULL;
+
+	// take a snapshot of the ip6tables rules at the
+	// current point in time
+	handle = ip6tc_init(M_TABLE);
+	if (!handle) {
+		return M_ERR_TABLE_UNAVAILABLE;
+	}
+
+	// check if chain exists
+	if (_m_chain_exists6(handle) == -1) {
+		ip6tc_free(handle);
+		return M_ERR_CHAIN_NOT_FOUND;
+	}
+
+	// count the number of rules
+	rule = ip6tc_first_rule(M_CHAIN, handle);
+	while (rule) {
+		rule_count += 1;
+		rule = ip6tc_next_rule(rule, handle);
+	}
+
+	// nothing to do if there are no rules
+	if (rule_count == 0) {
+		ip6tc_free(handle);
+		return M_OK;
+	}
+
+	// create the mappings holder
+	*mappings = m_new_mark_mappings(rule_count);
+	if (*mappings == NULL) {
+		ip6tc_free(handle);
+		return M_ERR_NO_MEMORY;
+	}
+
+	// populate the array with the mappings
+	rule = ip6tc_first_rule(M_CHAIN, handle);
+	for (unsigned int i = 0; i < rule_count; i++) {
+		_m_get_mark_mapping_from_rule6(rule, (*mappings)->data[i]);
+		rule = ip6tc_next_rule(rule, handle);
+	}
+
+	ip6tc_free(handle);
+
+	return M_OK;
+}
@@ -0,0 +1,162 @@
+//go:build cgo && !purego
+// +build cgo,!purego
+
+package mapper
+
+// #cgo LDFLAGS: -lip4tc -lip6tc -lxtables
+// #include "./mapper.h"
+import (
+	"C"
+)
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// initErr holds the failure (if any) of the initialization of
+// the internal iptables global variables, reported by every
+// retrieval of mappings.
+var initErr error
+
+// init initializes the internal iptables global variables.
+//
+// ps.: it doesn't need to be network namespace-aware as it
+// doesn't touch any networking subsystem.
+func init() {
+	code := C.m_init()
+	if code != 0 {
+		initErr = errors.Wrapf(ErrTableUnavailable,
+			"failed to initialize xtables (%d)", int(code))
+	}
+}
+
+// getXtablesMappings retrieves, for each address family, a map
+// that represents how fwmark entries are related to destination
+// ports in the mangle table (in the current network namespace).
+//
+// IPv6 mappings are only retrieved if ip6tables is available.
+func getXtablesMappings() (res map[Family]map[uint32][]Mapping, err error) {
+	if initErr != nil {
+		err = initErr
+		return
+	}
+
+	var mappings *C.m_mark_mappings_t
+
+	code, errno := C.m_get_mark_mappings(&mappings)
+	err = toError(code, errno)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to retrieve ipv4 mappings")
+		return
+	}
+
+	res = make(map[Family]map[uint32][]Mapping)
+
+	res[IPv4], err = toMap(mappings)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to retrieve ipv4 mappings")
+		return
+	}
+
+	code, errno = C.m_get_mark_mappings6(&mappings)
+	err = toError(code, errno)
+	switch errors.Cause(err) {
+	case nil:
+	case ErrTableUnavailable, ErrChainNotFound:
+		// the ip6_tables module might not even be loaded
+		err = nil
+		return
+	default:
+		err = errors.Wrapf(err, "failed to retrieve ipv6 mappings")
+		return
+	}
+
+	res[IPv6], err = toMap(mappings)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to retrieve ipv6 mappings")
+		return
+	}
+
+	return
+}
+
+// toError converts the result of the retrieval of mappings on
+// the C side (along with the errno it left) to an error.
+func toError(code C.int, errno error) (err error) {
+	switch code {
+	case C.M_OK:
+	case C.M_ERR_TABLE_UNAVAILABLE:
+		if errno == nil {
+			errno = syscall.EINVAL
+		}
+		err = errors.Wrapf(ErrTableUnavailable, "failed to initialize table handle (%s)", errno)
+	case C.M_ERR_CHAIN_NOT_FOUND:
+		err = ErrChainNotFound
+	case C.M_ERR_NO_MEMORY:
+		err = ErrOutOfMemory
+	default:
+		err = errors.Errorf("unexpected result %d", int(code))
+	}
+
+	return
+}
+
+// toMap converts the mappings retrieved from the C side
+// to a map of `fwmark -> mappings` (see applyMarkRules),
+// freeing the memory allocated for them.
+func toMap(mappings *C.m_mark_mappings_t) (res map[uint32][]Mapping, err error) {
+	if mappings == nil {
+		return
+	}
+
+	defer C.m_destroy_mark_mappings(mappings)
+
+	var rules []markRule
+
+	var i C.ushort = 0
+	for ; i < mappings.length; i++ {
+		mapping := C.m_get_mark_mapping_at(mappings, i)
+		if mapping == nil {
+			err = errors.Wrapf(ErrMalformedTable,
+				"couldn't retrieve fwmark mapping at position %d",
+				i)
+			return
+		}
+
+		if mapping.is_mark_rule == 0 {
+			continue
+		}
+
+		rules = append(rules, toMarkRule(mapping))
+	}
+
+	res = applyMarkRules(rules)
+	return
+}
+
+// toMarkRule converts a mapping retrieved from the C side.
+func toMarkRule(mapping *C.m_mark_mapping_t) (res markRule) {
+	res.mapping.Protocol = uint16(mapping.protocol)
+	res.mark = uint32(mapping.firewall_mark)
+	res.mask = uint32(mapping.firewall_mark_mask)
+	res.criteria = uint64(mapping.criteria)
+
+	if length := int(mapping.destination_length); length > 0 {
+		res.mapping.Destination = make(net.IP, length)
+		for i := range res.mapping.Destination {
+			res.mapping.Destination[i] = byte(mapping.destination[i])
+		}
+	}
+
+	for i := 0; i < int(mapping.port_ranges_length); i++ {
+		res.mapping.Ports = append(res.mapping.Ports, PortRange{
+			From: uint16(mapping.port_ranges[i].from),
+			To:   uint16(mapping.port_ranges[i].to),
+		})
+	}
+
+	return
+}
@@ -0,0 +1,140 @@
+//go:build !cgo || purego
+// +build !cgo purego
+
+package mapper
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// soGetInfo and soGetEntries are the socket options that
+	// retrieve the information and the entries of a table
+	// (IPT_SO_GET_INFO and IPT_SO_GET_ENTRIES, the same as
+	// their IP6T_ counterparts).
+	soGetInfo    = 64
+	soGetEntries = 65
+
+	// getEntriesHeaderSize is the size of `struct
+	// ipt_get_entries` (or `struct ip6t_get_entries`) that
+	// precedes the entries.
+	getEntriesHeaderSize = 40
+
+	// getEntriesAttempts is the number of times that the
+	// entries are asked for given that the table might change
+	// between retrieving its size and its entries.
+	getEntriesAttempts = 3
+)
+
+// getXtablesMappings retrieves, for each address family, a map
+// that represents how fwmark entries are related to destination
+// ports in the mangle table (in the current network namespace).
+//
+// IPv6 mappings are only retrieved if ip6tables is available.
+func getXtablesMappings() (res map[Family]map[uint32][]Mapping, err error) {
+	res = make(map[Family]map[uint32][]Mapping)
+
+	info, entries, err := readTable(IPv4)
+	if err != nil {
+		err = errors.Wrapf(ErrTableUnavailable, "failed to read ipv4 mangle table (%s)", err)
+		return
+	}
+
+	if !info.hasHook(hookPreRouting) {
+		err = errors.Wrapf(ErrChainNotFound, "failed to retrieve ipv4 mappings")
+		return
+	}
+
+	res[IPv4], err = parseMappings(IPv4, info, entries)
+	if err != nil {
+		err = errors.Wrapf(ErrMalformedTable, "failed to retrieve ipv4 mappings (%s)", err)
+		return
+	}
+
+	info, entries, err = readTable(IPv6)
+	if err != nil || !info.hasHook(hookPreRouting) {
+		// the ip6_tables module might not even be loaded
+		err = nil
+		return
+	}
+
+	res[IPv6], err = parseMappings(IPv6, info, entries)
+	if err != nil {
+		err = errors.Wrapf(ErrMalformedTable, "failed to retrieve ipv6 mappings (%s)", err)
+		return
+	}
+
+	return
+}
+
+// readTable retrieves the information and the entries of the
+// mangle table of an address family via getsockopt on a raw
+// socket.
+func readTable(family Family) (info tableInfo, entries []byte, err error) {
+	level := syscall.IPPROTO_IP
+	if family == IPv6 {
+		level = syscall.IPPROTO_IPV6
+	}
+
+	fd, err := syscall.Socket(int(family), syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to create raw socket")
+		return
+	}
+	defer syscall.Close(fd)
+
+	for attempt := 0; attempt < getEntriesAttempts; attempt++ {
+		buf := make([]byte, tableInfoSize)
+		copy(buf, tableName)
+
+		err = getsockopt(fd, level, soGetInfo, buf)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to retrieve table info")
+			return
+		}
+
+		info, err = parseTableInfo(buf)
+		if err != nil {
+			return
+		}
+
+		buf = make([]byte, getEntriesHeaderSize+int(info.size))
+		copy(buf, tableName)
+		nativeEndian.PutUint32(buf[32:], info.size)
+
+		err = getsockopt(fd, level, soGetEntries, buf)
+		if err == syscall.EAGAIN {
+			// the table changed in the meantime
+			continue
+		}
+		if err != nil {
+			err = errors.Wrapf(err, "failed to retrieve table entries")
+			return
+		}
+
+		entries = buf[getEntriesHeaderSize:]
+		return
+	}
+
+	err = errors.Wrapf(err, "table kept changing while being retrieved")
+	return
+}
+
+// getsockopt retrieves the socket option `opt` into `buf`, which
+// carries the arguments of the option as well.
+func getsockopt(fd, level, opt int, buf []byte) (err error) {
+	size := uint32(len(buf))
+
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT,
+		uintptr(fd), uintptr(level), uintptr(opt),
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		err = errno
+		return
+	}
+
+	return
+}
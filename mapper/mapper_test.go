@@ -0,0 +1,36 @@
+package mapper
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeMappings(t *testing.T) {
+	var (
+		tcp = func(port uint16) Mapping {
+			return Mapping{Protocol: syscall.IPPROTO_TCP, Ports: []PortRange{{port, port}}}
+		}
+		nftables = map[Family]map[uint32][]Mapping{
+			IPv4: {0x100: {tcp(80)}},
+			IPv6: {},
+		}
+		xtables = map[Family]map[uint32][]Mapping{
+			IPv4: {0x100: {tcp(8080)}, 0x101: {tcp(443)}},
+			IPv6: {0x102: {tcp(53)}},
+		}
+	)
+
+	assert.Equal(t, map[Family]map[uint32][]Mapping{
+		IPv4: {0x100: {tcp(80), tcp(8080)}, 0x101: {tcp(443)}},
+		IPv6: {0x102: {tcp(53)}},
+	}, mergeMappings(nftables, xtables))
+
+	assert.Equal(t, map[Family]map[uint32][]Mapping{
+		IPv6: {0x102: {tcp(53)}},
+	}, mergeMappings(nil, map[Family]map[uint32][]Mapping{
+		IPv4: {},
+		IPv6: {0x102: {tcp(53)}},
+	}))
+}
@@ -0,0 +1,81 @@
+package mapper
+
+// markRule describes a rule that sets a mark (the MARK target,
+// `meta mark set` in nftables): the packets that it matches and
+// how it changes their mark, as `--set-xmark mark/mask` does -
+// the bits in `mask` are cleared and those in `mark` flipped.
+type markRule struct {
+	mapping Mapping
+	mark    uint32
+	mask    uint32
+
+	// criteria identifies what the rule matches (a hash of
+	// its matches), such that rules with the same criteria
+	// act on the same packets.
+	criteria uint64
+}
+
+// apply retrieves the mark of a packet after the rule given the
+// mark that it had.
+func (r *markRule) apply(previous uint32) uint32 {
+	return (previous &^ r.mask) ^ r.mark
+}
+
+// fnvOffset and fnvPrime are the parameters of the 64-bit
+// FNV-1a hash that the criteria of the rules are computed with
+// (on both the Go and the C side).
+const (
+	fnvOffset uint64 = 14695981039346656037
+	fnvPrime  uint64 = 1099511628211
+)
+
+// hashCriteria updates the criteria hash `h` (fnvOffset to
+// start with) with the bytes in `b`.
+func hashCriteria(h uint64, b []byte) uint64 {
+	for _, c := range b {
+		h ^= uint64(c)
+		h *= fnvPrime
+	}
+
+	return h
+}
+
+// applyMarkRules retrieves the mappings of `fwmark -> mappings`
+// that result from the rules of a chain (in order).
+//
+// Rules with the same criteria act on the mark that the previous
+// ones left, starting from no mark at all, such that, e.g.,
+// `--or-mark` adds to the mark set before. Packets left without
+// a mark are not mapped.
+func applyMarkRules(rules []markRule) (res map[uint32][]Mapping) {
+	var (
+		marks    = map[uint64]uint32{}
+		mappings []Mapping
+		criteria []uint64
+	)
+
+	for _, rule := range rules {
+		previous, seen := marks[rule.criteria]
+		if !seen {
+			mappings = append(mappings, rule.mapping)
+			criteria = append(criteria, rule.criteria)
+		}
+
+		marks[rule.criteria] = rule.apply(previous)
+	}
+
+	for i, mapping := range mappings {
+		mark := marks[criteria[i]]
+		if mark == 0 {
+			continue
+		}
+
+		if res == nil {
+			res = make(map[uint32][]Mapping)
+		}
+
+		res[mark] = append(res[mark], mapping)
+	}
+
+	return
+}
@@ -0,0 +1,78 @@
+package mapper
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyMarkRules(t *testing.T) {
+	var (
+		tcp = func(port uint16) Mapping {
+			return Mapping{Protocol: syscall.IPPROTO_TCP, Ports: []PortRange{{port, port}}}
+		}
+		set = func(port uint16, mark, mask uint32) markRule {
+			return markRule{mapping: tcp(port), mark: mark, mask: mask, criteria: uint64(port)}
+		}
+		testCases = []struct {
+			desc     string
+			rules    []markRule
+			expected map[uint32][]Mapping
+		}{
+			{
+				desc:     "no rules",
+				expected: nil,
+			},
+			{
+				desc:     "set",
+				rules:    []markRule{set(80, 0x100, 0xFFFFFFFF), set(443, 0x100, 0xFFFFFFFF)},
+				expected: map[uint32][]Mapping{0x100: {tcp(80), tcp(443)}},
+			},
+			{
+				desc:     "set overridden",
+				rules:    []markRule{set(80, 0x100, 0xFFFFFFFF), set(80, 0x200, 0xFFFFFFFF)},
+				expected: map[uint32][]Mapping{0x200: {tcp(80)}},
+			},
+			{
+				desc:     "or",
+				rules:    []markRule{set(80, 0x100, 0xFFFFFFFF), set(80, 0x8, 0x8)},
+				expected: map[uint32][]Mapping{0x108: {tcp(80)}},
+			},
+			{
+				desc:     "and",
+				rules:    []markRule{set(80, 0x1FF, 0xFFFFFFFF), set(80, 0, 0xFF)},
+				expected: map[uint32][]Mapping{0x100: {tcp(80)}},
+			},
+			{
+				desc:     "xor",
+				rules:    []markRule{set(80, 0x101, 0xFFFFFFFF), set(80, 0x1, 0)},
+				expected: map[uint32][]Mapping{0x100: {tcp(80)}},
+			},
+			{
+				desc:     "mask without a previous mark",
+				rules:    []markRule{set(80, 0x200, 0xFF00)},
+				expected: map[uint32][]Mapping{0x200: {tcp(80)}},
+			},
+			{
+				desc:     "cleared",
+				rules:    []markRule{set(80, 0x100, 0xFFFFFFFF), set(80, 0, 0xFFFFFFFF), set(443, 0x100, 0xFFFFFFFF)},
+				expected: map[uint32][]Mapping{0x100: {tcp(443)}},
+			},
+			{
+				desc: "same mapping with other criteria",
+				rules: []markRule{
+					set(80, 0x100, 0xFFFFFFFF),
+					{mapping: tcp(80), mark: 0x200, mask: 0xFFFFFFFF, criteria: 1},
+				},
+				expected: map[uint32][]Mapping{0x100: {tcp(80)}, 0x200: {tcp(80)}},
+			},
+		}
+	)
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.expected, applyMarkRules(tc.rules))
+		})
+	}
+}
@@ -0,0 +1,843 @@
+package mapper
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"sort"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// constants from `linux/netfilter/nfnetlink.h` and
+// `linux/netfilter/nf_tables.h`.
+const (
+	netlinkNetfilter = 12
+
+	nfnlSubsysNftables = 10
+	nftMsgNewChain     = 3
+	nftMsgGetChain     = 4
+	nftMsgNewRule      = 6
+	nftMsgGetRule      = 7
+
+	nfprotoUnspec = 0
+	nfprotoInet   = 1
+	nfprotoIPv4   = 2
+	nfprotoIPv6   = 10
+
+	nftaChainTable = 1
+	nftaChainName  = 3
+	nftaChainHook  = 4
+
+	nftaHookHooknum  = 1
+	nftaHookPriority = 2
+
+	nfInetPreRouting = 0
+
+	nftaRuleTable       = 1
+	nftaRuleChain       = 2
+	nftaRuleExpressions = 4
+	nftaListElem        = 1
+	nftaExprName        = 1
+	nftaExprData        = 2
+	nftaDataValue       = 1
+	nftaDataVerdict     = 2
+
+	nftaVerdictCode  = 1
+	nftaVerdictChain = 2
+
+	nftJump = -3
+	nftGoto = -4
+
+	nftaPayloadDreg   = 1
+	nftaPayloadBase   = 2
+	nftaPayloadOffset = 3
+	nftaPayloadLen    = 4
+
+	nftPayloadNetworkHeader   = 1
+	nftPayloadTransportHeader = 2
+
+	nftaCmpSreg = 1
+	nftaCmpOp   = 2
+	nftaCmpData = 3
+
+	nftCmpEq  = 0
+	nftCmpLte = 3
+	nftCmpGte = 5
+
+	nftaRangeSreg     = 1
+	nftaRangeOp       = 2
+	nftaRangeFromData = 3
+	nftaRangeToData   = 4
+
+	nftRangeEq = 0
+
+	nftaImmediateDreg = 1
+	nftaImmediateData = 2
+
+	nftaMetaDreg = 1
+	nftaMetaKey  = 2
+	nftaMetaSreg = 3
+
+	nftMetaMark    = 3
+	nftMetaL4Proto = 16
+
+	nftaBitwiseSreg = 1
+	nftaBitwiseDreg = 2
+	nftaBitwiseMask = 4
+	nftaBitwiseXor  = 5
+	nftaBitwiseOp   = 6
+
+	nftBitwiseMaskXor = 0
+
+	// nftaMatchName and nftaMatchInfo (as well as the target
+	// counterparts, which share the values) are the attributes
+	// of the expressions that iptables-nft uses for the
+	// extensions that it can't translate.
+	nftaMatchName = 1
+	nftaMatchRev  = 2
+	nftaMatchInfo = 3
+
+	// nlaTypeMask strips the flags (nested, byte order) from
+	// the type of an attribute.
+	nlaTypeMask = 0x3fff
+)
+
+// nlAttr is a netlink attribute.
+type nlAttr struct {
+	typ   uint16
+	value []byte
+}
+
+// parseAttrs parses the netlink attributes in `b`.
+func parseAttrs(b []byte) (attrs []nlAttr, err error) {
+	for len(b) > 0 {
+		if len(b) < syscall.SizeofRtAttr {
+			err = errors.Errorf("attribute header too short (%d bytes)", len(b))
+			return
+		}
+
+		length := int(nativeEndian.Uint16(b))
+		if length < syscall.SizeofRtAttr || length > len(b) {
+			err = errors.Errorf("bad attribute length %d", length)
+			return
+		}
+
+		attrs = append(attrs, nlAttr{
+			typ:   nativeEndian.Uint16(b[2:]) & nlaTypeMask,
+			value: b[syscall.SizeofRtAttr:length],
+		})
+
+		aligned := (length + syscall.NLA_ALIGNTO - 1) &^ (syscall.NLA_ALIGNTO - 1)
+		if aligned > len(b) {
+			aligned = len(b)
+		}
+		b = b[aligned:]
+	}
+
+	return
+}
+
+// attrsByType indexes the attributes in `b` by their types.
+func attrsByType(b []byte) (res map[uint16][]byte, err error) {
+	attrs, err := parseAttrs(b)
+	if err != nil {
+		return
+	}
+
+	res = make(map[uint16][]byte, len(attrs))
+	for _, attr := range attrs {
+		res[attr.typ] = attr.value
+	}
+
+	return
+}
+
+// beUint32 decodes a 32-bit attribute in network byte order
+// (zero if it's missing).
+func beUint32(b []byte) uint32 {
+	if len(b) < 4 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(b)
+}
+
+// dataValue retrieves the value of a `NFTA_DATA_*` attribute.
+func dataValue(b []byte) (value []byte, err error) {
+	attrs, err := attrsByType(b)
+	if err != nil {
+		return
+	}
+
+	value = attrs[nftaDataValue]
+	return
+}
+
+// registerContent identifies what the expressions of a rule
+// loaded into a register.
+type registerContent int
+
+const (
+	registerValue registerContent = iota
+	registerDestinationPort
+	registerProtocol
+	registerDestinationAddress
+	registerMark
+)
+
+// register holds what the expressions of a rule loaded into a
+// register: either the destination port of the transport
+// header, the protocol or the destination address (to be
+// compared against), an immediate value or the mark of the
+// packet.
+//
+// The mark may have gone through `bitwise` expressions, which
+// `mark` and `mask` describe the same way as markRule does (a
+// plain load leaving them zeroed).
+type register struct {
+	content registerContent
+	value   []byte
+
+	mark, mask uint32
+}
+
+// protocolOffsets holds the offset of the protocol in the
+// network header by the family of the tables (`inet` tables use
+// `meta l4proto` instead).
+var protocolOffsets = map[byte]uint32{
+	nfprotoIPv4: 9,
+	nfprotoIPv6: 6,
+}
+
+// destinationOffsets holds the offset of the destination address
+// in the network header by its length (`ip daddr` and `ip6
+// daddr`).
+var destinationOffsets = map[uint32]uint32{
+	4:  16,
+	16: 24,
+}
+
+// parseRule retrieves the protocol, the destination address and
+// ports and how the mark is set by a rule (of a table of `family`) given
+// its expressions, covering both native nftables rules (`tcp
+// dport N meta mark set M`, with ports compared for equality or
+// against a range, and marks possibly combined with the previous
+// one as in `meta mark set mark or M`) and those that
+// iptables-nft creates with the tcp, udp, sctp or multiport
+// matches and the `MARK` target (other targets being skipped).
+//
+// The criteria of the rule are hashed from the expressions that
+// don't take part in setting the mark (see setsMark).
+//
+// `ok` is false if the rule doesn't set a mark. Rules that set
+// one without matching ports are kept (with no ports), as they
+// are from the iptables mangle table.
+func parseRule(family byte, expressions []byte) (rule markRule, ok bool, err error) {
+	elems, err := parseAttrs(expressions)
+	if err != nil {
+		return
+	}
+
+	var (
+		regs     = map[uint32]register{}
+		hasPorts bool
+		hasMark  bool
+		mapping  = &rule.mapping
+
+		// lowest and highest hold the bounds of a range
+		// of ports compared in two steps (`>=` and `<=`)
+		lowest, highest []byte
+	)
+
+	rule.criteria = fnvOffset
+
+	for _, elem := range elems {
+		if elem.typ != nftaListElem {
+			continue
+		}
+
+		var expr, data map[uint16][]byte
+
+		expr, err = attrsByType(elem.value)
+		if err != nil {
+			return
+		}
+
+		data, err = attrsByType(expr[nftaExprData])
+		if err != nil {
+			return
+		}
+
+		name := cString(expr[nftaExprName])
+		if !setsMark(name, data) {
+			rule.criteria = hashCriteria(rule.criteria, elem.value)
+		}
+
+		switch name {
+		case "payload":
+			var (
+				content = registerValue
+				base    = beUint32(data[nftaPayloadBase])
+				offset  = beUint32(data[nftaPayloadOffset])
+				length  = beUint32(data[nftaPayloadLen])
+			)
+
+			if protocolOffset, known := protocolOffsets[family]; known &&
+				base == nftPayloadNetworkHeader && offset == protocolOffset && length == 1 {
+				content = registerProtocol
+			}
+
+			if base == nftPayloadTransportHeader && offset == 2 && length == 2 {
+				content = registerDestinationPort
+			}
+
+			if destinationOffset, known := destinationOffsets[length]; known &&
+				base == nftPayloadNetworkHeader && offset == destinationOffset {
+				content = registerDestinationAddress
+			}
+
+			regs[beUint32(data[nftaPayloadDreg])] = register{content: content}
+		case "cmp":
+			var value []byte
+
+			value, err = dataValue(data[nftaCmpData])
+			if err != nil {
+				return
+			}
+
+			switch regs[beUint32(data[nftaCmpSreg])].content {
+			case registerProtocol:
+				if beUint32(data[nftaCmpOp]) == nftCmpEq && len(value) == 1 &&
+					mapping.Protocol == 0 {
+					mapping.Protocol = uint16(value[0])
+				}
+			case registerDestinationAddress:
+				if beUint32(data[nftaCmpOp]) == nftCmpEq && mapping.Destination == nil {
+					mapping.Destination = append(net.IP{}, value...)
+				}
+			case registerDestinationPort:
+				if len(value) != 2 || hasPorts {
+					continue
+				}
+
+				switch beUint32(data[nftaCmpOp]) {
+				case nftCmpEq:
+					lowest, highest = value, value
+				case nftCmpGte:
+					lowest = value
+				case nftCmpLte:
+					highest = value
+				}
+
+				if lowest != nil && highest != nil {
+					mapping.Ports = append(mapping.Ports, PortRange{
+						From: binary.BigEndian.Uint16(lowest),
+						To:   binary.BigEndian.Uint16(highest),
+					})
+					hasPorts = true
+				}
+			}
+		case "range":
+			if beUint32(data[nftaRangeOp]) != nftRangeEq || hasPorts ||
+				regs[beUint32(data[nftaRangeSreg])].content != registerDestinationPort {
+				continue
+			}
+
+			var from, to []byte
+
+			from, err = dataValue(data[nftaRangeFromData])
+			if err != nil {
+				return
+			}
+
+			to, err = dataValue(data[nftaRangeToData])
+			if err != nil {
+				return
+			}
+
+			if len(from) == 2 && len(to) == 2 {
+				mapping.Ports = append(mapping.Ports, PortRange{
+					From: binary.BigEndian.Uint16(from),
+					To:   binary.BigEndian.Uint16(to),
+				})
+				hasPorts = true
+			}
+		case "immediate":
+			var value []byte
+
+			value, err = dataValue(data[nftaImmediateData])
+			if err != nil {
+				return
+			}
+
+			regs[beUint32(data[nftaImmediateDreg])] = register{value: value}
+		case "bitwise":
+			// `(reg & mask) ^ xor`, as `mark and/or/xor M`
+			// compiles to
+			var (
+				reg       = regs[beUint32(data[nftaBitwiseSreg])]
+				mask, xor []byte
+			)
+
+			mask, err = dataValue(data[nftaBitwiseMask])
+			if err != nil {
+				return
+			}
+
+			xor, err = dataValue(data[nftaBitwiseXor])
+			if err != nil {
+				return
+			}
+
+			result := register{}
+			if reg.content == registerMark && len(mask) == 4 && len(xor) == 4 &&
+				beUint32(data[nftaBitwiseOp]) == nftBitwiseMaskXor {
+				var (
+					m = nativeEndian.Uint32(mask)
+					x = nativeEndian.Uint32(xor)
+				)
+
+				result = register{
+					content: registerMark,
+					mark:    reg.mark&m ^ x,
+					mask:    reg.mask | ^m,
+				}
+			}
+
+			regs[beUint32(data[nftaBitwiseDreg])] = result
+		case "meta":
+			if dreg, isLoad := data[nftaMetaDreg]; isLoad {
+				content := registerValue
+				switch beUint32(data[nftaMetaKey]) {
+				case nftMetaL4Proto:
+					content = registerProtocol
+				case nftMetaMark:
+					content = registerMark
+				}
+
+				regs[beUint32(dreg)] = register{content: content}
+				continue
+			}
+
+			sreg, isSet := data[nftaMetaSreg]
+			if !isSet || beUint32(data[nftaMetaKey]) != nftMetaMark {
+				continue
+			}
+
+			reg := regs[beUint32(sreg)]
+			switch {
+			case reg.content == registerMark:
+				rule.mark, rule.mask, hasMark = reg.mark, reg.mask, true
+			case len(reg.value) == 4:
+				rule.mark, rule.mask, hasMark = nativeEndian.Uint32(reg.value), 0xFFFFFFFF, true
+			}
+		case "match":
+			if hasPorts {
+				continue
+			}
+
+			var (
+				match    = cString(data[nftaMatchName])
+				revision = uint8(beUint32(data[nftaMatchRev]))
+			)
+
+			hasPorts, err = decodeMatch(match, revision, data[nftaMatchInfo], mapping)
+			if err != nil {
+				err = errors.Wrapf(err, "malformed %s match", match)
+				return
+			}
+		case "target":
+			info := data[nftaMatchInfo]
+			if cString(data[nftaMatchName]) != markTargetName ||
+				beUint32(data[nftaMatchRev]) != markTargetRevision ||
+				len(info) < markTargetSize {
+				continue
+			}
+
+			rule.mark, rule.mask, hasMark = nativeEndian.Uint32(info), nativeEndian.Uint32(info[4:]), true
+		}
+	}
+
+	ok = hasMark
+	return
+}
+
+// setsMark indicates whether an expression (given its name and
+// data) takes part in setting the mark - or, as counters do,
+// doesn't restrict the packets that a rule matches either.
+func setsMark(name string, data map[uint16][]byte) bool {
+	switch name {
+	case "immediate", "bitwise", "target", "counter":
+		return true
+	case "meta":
+		_, isSet := data[nftaMetaSreg]
+		return isSet || beUint32(data[nftaMetaKey]) == nftMetaMark
+	}
+
+	return false
+}
+
+// cString converts a NUL-terminated string attribute.
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+
+	return string(b)
+}
+
+// ruleJump retrieves the chain that a rule jumps (or goes) to
+// given its expressions, if any.
+func ruleJump(expressions []byte) (chain string, err error) {
+	elems, err := parseAttrs(expressions)
+	if err != nil {
+		return
+	}
+
+	for _, elem := range elems {
+		if elem.typ != nftaListElem {
+			continue
+		}
+
+		var expr, data, value, verdict map[uint16][]byte
+
+		expr, err = attrsByType(elem.value)
+		if err != nil {
+			return
+		}
+
+		if cString(expr[nftaExprName]) != "immediate" {
+			continue
+		}
+
+		data, err = attrsByType(expr[nftaExprData])
+		if err != nil {
+			return
+		}
+
+		// verdicts go to register zero
+		if beUint32(data[nftaImmediateDreg]) != 0 {
+			continue
+		}
+
+		value, err = attrsByType(data[nftaImmediateData])
+		if err != nil {
+			return
+		}
+
+		verdict, err = attrsByType(value[nftaDataVerdict])
+		if err != nil {
+			return
+		}
+
+		switch int32(beUint32(verdict[nftaVerdictCode])) {
+		case nftJump, nftGoto:
+			chain = cString(verdict[nftaVerdictChain])
+			return
+		}
+	}
+
+	return
+}
+
+// chainKey identifies a chain by the family and name of its
+// table and its own name.
+type chainKey struct {
+	family byte
+	table  string
+	name   string
+}
+
+// chainRule holds what matters about a rule of a chain: the mark
+// that it sets (if it does) and the chain that it jumps to (if
+// any).
+type chainRule struct {
+	rule   markRule
+	isMark bool
+	jump   string
+}
+
+// baseChain is a chain attached to the prerouting hook.
+type baseChain struct {
+	key      chainKey
+	priority int32
+}
+
+// walkChain appends the mark rules of a chain to `rules`, those
+// of the chains that it jumps (or goes) to taking the place of
+// the jumps. Chains already being walked (loops) are skipped.
+func walkChain(chains map[chainKey][]chainRule, key chainKey,
+	walking map[chainKey]bool, rules []markRule) []markRule {
+	if walking[key] {
+		return rules
+	}
+
+	walking[key] = true
+	defer delete(walking, key)
+
+	for _, rule := range chains[key] {
+		if rule.isMark {
+			rules = append(rules, rule.rule)
+		}
+
+		if rule.jump != "" {
+			rules = walkChain(chains, chainKey{
+				family: key.family,
+				table:  key.table,
+				name:   rule.jump,
+			}, walking, rules)
+		}
+	}
+
+	return rules
+}
+
+// parseRuleMessages retrieves the mappings from the chains and
+// rules dumped by NFT_MSG_GETCHAIN and NFT_MSG_GETRULE, by the
+// family of the tables that they are in (rules in `inet` tables
+// count for both).
+//
+// Only the rules that packets go through on the prerouting hook
+// count: those of the chains attached to it (in the order of
+// their priorities) and of the chains that these jump to. The
+// marks that they set are applied in that order (see
+// applyMarkRules).
+func parseRuleMessages(msgs []syscall.NetlinkMessage) (res map[Family]map[uint32][]Mapping, err error) {
+	var (
+		chains = map[chainKey][]chainRule{}
+		bases  []baseChain
+		rules  = map[Family][]markRule{}
+	)
+
+	res = make(map[Family]map[uint32][]Mapping)
+
+	for _, msg := range msgs {
+		var (
+			isChain = msg.Header.Type == nfnlSubsysNftables<<8|nftMsgNewChain
+			isRule  = msg.Header.Type == nfnlSubsysNftables<<8|nftMsgNewRule
+		)
+
+		if !isChain && !isRule {
+			continue
+		}
+
+		// struct nfgenmsg precedes the attributes
+		if len(msg.Data) < 4 {
+			err = errors.Errorf("message too short (%d bytes)", len(msg.Data))
+			return
+		}
+
+		switch msg.Data[0] {
+		case nfprotoIPv4, nfprotoIPv6, nfprotoInet:
+		default:
+			continue
+		}
+
+		var attrs map[uint16][]byte
+
+		attrs, err = attrsByType(msg.Data[4:])
+		if err != nil {
+			return
+		}
+
+		if isChain {
+			hook, isBase := attrs[nftaChainHook]
+			if !isBase {
+				continue
+			}
+
+			var hookAttrs map[uint16][]byte
+
+			hookAttrs, err = attrsByType(hook)
+			if err != nil {
+				return
+			}
+
+			if beUint32(hookAttrs[nftaHookHooknum]) != nfInetPreRouting {
+				continue
+			}
+
+			bases = append(bases, baseChain{
+				key: chainKey{
+					family: msg.Data[0],
+					table:  cString(attrs[nftaChainTable]),
+					name:   cString(attrs[nftaChainName]),
+				},
+				priority: int32(beUint32(hookAttrs[nftaHookPriority])),
+			})
+			continue
+		}
+
+		var rule chainRule
+
+		rule.rule, rule.isMark, err = parseRule(msg.Data[0], attrs[nftaRuleExpressions])
+		if err != nil {
+			return
+		}
+
+		rule.jump, err = ruleJump(attrs[nftaRuleExpressions])
+		if err != nil {
+			return
+		}
+
+		if !rule.isMark && rule.jump == "" {
+			continue
+		}
+
+		key := chainKey{
+			family: msg.Data[0],
+			table:  cString(attrs[nftaRuleTable]),
+			name:   cString(attrs[nftaRuleChain]),
+		}
+		chains[key] = append(chains[key], rule)
+	}
+
+	sort.SliceStable(bases, func(i, j int) bool {
+		return bases[i].priority < bases[j].priority
+	})
+
+	for _, base := range bases {
+		var families []Family
+		switch base.key.family {
+		case nfprotoIPv4:
+			families = []Family{IPv4}
+		case nfprotoIPv6:
+			families = []Family{IPv6}
+		case nfprotoInet:
+			families = []Family{IPv4, IPv6}
+		}
+
+		for _, rule := range walkChain(chains, base.key, map[chainKey]bool{}, nil) {
+			for _, family := range families {
+				// rules of `inet` tables with a
+				// destination only match one of the
+				// families
+				if rule.mapping.Destination != nil &&
+					(len(rule.mapping.Destination) == net.IPv4len) != (family == IPv4) {
+					continue
+				}
+
+				rules[family] = append(rules[family], rule)
+			}
+		}
+	}
+
+	for family, familyRules := range rules {
+		if mappings := applyMarkRules(familyRules); mappings != nil {
+			res[family] = mappings
+		}
+	}
+
+	return
+}
+
+// getNftablesMappings retrieves the mappings from the chains and
+// rules of all nftables tables (in the current network
+// namespace) via netlink.
+func getNftablesMappings() (res map[Family]map[uint32][]Mapping, err error) {
+	chains, err := dump(nftMsgGetChain)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to dump nftables chains")
+		return
+	}
+
+	rules, err := dump(nftMsgGetRule)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to dump nftables rules")
+		return
+	}
+
+	res, err = parseRuleMessages(append(chains, rules...))
+	if err != nil {
+		err = errors.Wrapf(err, "failed to parse nftables rules")
+		return
+	}
+
+	return
+}
+
+// dump retrieves the objects (NFT_MSG_GETCHAIN or
+// NFT_MSG_GETRULE as `msgType`) of all tables of all families.
+func dump(msgType uint16) (msgs []syscall.NetlinkMessage, err error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK,
+		syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, netlinkNetfilter)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to create netlink socket")
+		return
+	}
+	defer syscall.Close(fd)
+
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		err = errors.Wrapf(err, "failed to bind netlink socket")
+		return
+	}
+
+	var (
+		seq = uint32(os.Getpid())
+		req = make([]byte, syscall.NLMSG_HDRLEN+4)
+	)
+
+	nativeEndian.PutUint32(req[0:], uint32(len(req)))
+	nativeEndian.PutUint16(req[4:], nfnlSubsysNftables<<8|msgType)
+	nativeEndian.PutUint16(req[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+	nativeEndian.PutUint32(req[8:], seq)
+	req[syscall.NLMSG_HDRLEN] = nfprotoUnspec
+
+	err = syscall.Sendto(fd, req, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		err = errors.Wrapf(err, "failed to send request")
+		return
+	}
+
+	buf := make([]byte, os.Getpagesize()*8)
+	for {
+		var (
+			n     int
+			batch []syscall.NetlinkMessage
+		)
+
+		n, _, err = syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to receive response")
+			return
+		}
+
+		batch, err = syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			err = errors.Wrapf(err, "failed to parse response")
+			return
+		}
+
+		for _, msg := range batch {
+			if msg.Header.Seq != seq {
+				continue
+			}
+
+			switch msg.Header.Type {
+			case syscall.NLMSG_DONE:
+				return
+			case syscall.NLMSG_ERROR:
+				if len(msg.Data) < 4 {
+					err = errors.Errorf("truncated netlink error")
+					return
+				}
+
+				if errno := int32(nativeEndian.Uint32(msg.Data)); errno != 0 {
+					err = syscall.Errno(-errno)
+					return
+				}
+
+				return
+			}
+
+			// the buffer gets reused
+			msg.Data = append([]byte{}, msg.Data...)
+			msgs = append(msgs, msg)
+		}
+	}
+}
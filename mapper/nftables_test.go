@@ -0,0 +1,490 @@
+package mapper
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netns"
+)
+
+// attr encodes a netlink attribute.
+func attr(typ uint16, value []byte) (res []byte) {
+	length := syscall.SizeofRtAttr + len(value)
+
+	res = make([]byte, (length+syscall.NLA_ALIGNTO-1)&^(syscall.NLA_ALIGNTO-1))
+	nativeEndian.PutUint16(res, uint16(length))
+	nativeEndian.PutUint16(res[2:], typ)
+	copy(res[syscall.SizeofRtAttr:], value)
+	return
+}
+
+// nested encodes a netlink attribute that nests others.
+func nested(typ uint16, attrs ...[]byte) []byte {
+	var value []byte
+	for _, a := range attrs {
+		value = append(value, a...)
+	}
+
+	return attr(typ|syscall.NLA_F_NESTED, value)
+}
+
+func be32(v uint32) (res []byte) {
+	res = make([]byte, 4)
+	binary.BigEndian.PutUint32(res, v)
+	return
+}
+
+func str(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// expr encodes an expression of a rule.
+func expr(name string, data ...[]byte) []byte {
+	return nested(nftaListElem,
+		attr(nftaExprName, str(name)),
+		nested(nftaExprData, data...))
+}
+
+// dportExprs encodes `tcp dport <port>` (as loaded into
+// register 1).
+func dportExprs(port uint16) [][]byte {
+	value := make([]byte, 2)
+	binary.BigEndian.PutUint16(value, port)
+
+	return [][]byte{
+		expr("payload",
+			attr(nftaPayloadDreg, be32(1)),
+			attr(nftaPayloadBase, be32(nftPayloadTransportHeader)),
+			attr(nftaPayloadOffset, be32(2)),
+			attr(nftaPayloadLen, be32(2))),
+		expr("cmp",
+			attr(nftaCmpSreg, be32(1)),
+			attr(nftaCmpOp, be32(nftCmpEq)),
+			nested(nftaCmpData, attr(nftaDataValue, value))),
+	}
+}
+
+// rangeExprs encodes `tcp dport <from>-<to>` (as loaded into
+// register 1), either with a range expression or by comparing
+// against both bounds.
+func rangeExprs(from, to uint16, compare bool) [][]byte {
+	fromValue, toValue := make([]byte, 2), make([]byte, 2)
+	binary.BigEndian.PutUint16(fromValue, from)
+	binary.BigEndian.PutUint16(toValue, to)
+
+	exprs := [][]byte{
+		expr("payload",
+			attr(nftaPayloadDreg, be32(1)),
+			attr(nftaPayloadBase, be32(nftPayloadTransportHeader)),
+			attr(nftaPayloadOffset, be32(2)),
+			attr(nftaPayloadLen, be32(2))),
+	}
+
+	if compare {
+		return append(exprs,
+			expr("cmp",
+				attr(nftaCmpSreg, be32(1)),
+				attr(nftaCmpOp, be32(nftCmpGte)),
+				nested(nftaCmpData, attr(nftaDataValue, fromValue))),
+			expr("cmp",
+				attr(nftaCmpSreg, be32(1)),
+				attr(nftaCmpOp, be32(nftCmpLte)),
+				nested(nftaCmpData, attr(nftaDataValue, toValue))))
+	}
+
+	return append(exprs, expr("range",
+		attr(nftaRangeSreg, be32(1)),
+		attr(nftaRangeOp, be32(nftRangeEq)),
+		nested(nftaRangeFromData, attr(nftaDataValue, fromValue)),
+		nested(nftaRangeToData, attr(nftaDataValue, toValue))))
+}
+
+// l4protoExprs encodes `meta l4proto <protocol>` (as loaded
+// into register 1) or, if `offset` is not zero, the comparison
+// of the protocol in the network header at that offset (`ip
+// protocol` or `ip6 nexthdr`).
+func l4protoExprs(protocol byte, offset uint32) [][]byte {
+	load := expr("meta",
+		attr(nftaMetaKey, be32(nftMetaL4Proto)),
+		attr(nftaMetaDreg, be32(1)))
+	if offset != 0 {
+		load = expr("payload",
+			attr(nftaPayloadDreg, be32(1)),
+			attr(nftaPayloadBase, be32(nftPayloadNetworkHeader)),
+			attr(nftaPayloadOffset, be32(offset)),
+			attr(nftaPayloadLen, be32(1)))
+	}
+
+	return [][]byte{
+		load,
+		expr("cmp",
+			attr(nftaCmpSreg, be32(1)),
+			attr(nftaCmpOp, be32(nftCmpEq)),
+			nested(nftaCmpData, attr(nftaDataValue, []byte{protocol}))),
+	}
+}
+
+// daddrExprs encodes `ip daddr <address>` (or `ip6 daddr`, as
+// loaded into register 1).
+func daddrExprs(address net.IP) [][]byte {
+	if ipv4 := address.To4(); ipv4 != nil {
+		address = ipv4
+	}
+
+	return [][]byte{
+		expr("payload",
+			attr(nftaPayloadDreg, be32(1)),
+			attr(nftaPayloadBase, be32(nftPayloadNetworkHeader)),
+			attr(nftaPayloadOffset, be32(destinationOffsets[uint32(len(address))])),
+			attr(nftaPayloadLen, be32(uint32(len(address))))),
+		expr("cmp",
+			attr(nftaCmpSreg, be32(1)),
+			attr(nftaCmpOp, be32(nftCmpEq)),
+			nested(nftaCmpData, attr(nftaDataValue, address))),
+	}
+}
+
+// markExprs encodes `meta mark set <mark>` (as loaded into
+// register 1).
+func markExprs(mark uint32) [][]byte {
+	value := make([]byte, 4)
+	nativeEndian.PutUint32(value, mark)
+
+	return [][]byte{
+		expr("immediate",
+			attr(nftaImmediateDreg, be32(1)),
+			nested(nftaImmediateData, attr(nftaDataValue, value))),
+		expr("meta",
+			attr(nftaMetaKey, be32(nftMetaMark)),
+			attr(nftaMetaSreg, be32(1))),
+	}
+}
+
+// bitwiseMarkExprs encodes `meta mark set mark and <mask> xor
+// <xor>` (as loaded into register 1), which `or`, `and` and `xor`
+// compile to.
+func bitwiseMarkExprs(mask, xor uint32) [][]byte {
+	maskValue, xorValue := make([]byte, 4), make([]byte, 4)
+	nativeEndian.PutUint32(maskValue, mask)
+	nativeEndian.PutUint32(xorValue, xor)
+
+	return [][]byte{
+		expr("meta",
+			attr(nftaMetaKey, be32(nftMetaMark)),
+			attr(nftaMetaDreg, be32(1))),
+		expr("bitwise",
+			attr(nftaBitwiseSreg, be32(1)),
+			attr(nftaBitwiseDreg, be32(1)),
+			attr(3, be32(4)),
+			nested(nftaBitwiseMask, attr(nftaDataValue, maskValue)),
+			nested(nftaBitwiseXor, attr(nftaDataValue, xorValue))),
+		expr("meta",
+			attr(nftaMetaKey, be32(nftMetaMark)),
+			attr(nftaMetaSreg, be32(1))),
+	}
+}
+
+// targetExprs encodes an iptables-nft target with the given
+// name, revision and info.
+func targetExprs(name string, revision uint32, info []byte) [][]byte {
+	return [][]byte{expr("target",
+		attr(nftaMatchName, str(name)),
+		attr(nftaMatchRev, be32(revision)),
+		attr(nftaMatchInfo, info))}
+}
+
+// compatExprs encodes `-m tcp --dport <port> -j MARK --set-xmark
+// <mark>/0xffffffff` as iptables-nft does.
+func compatExprs(port uint16, mark uint32) [][]byte {
+	var (
+		tcp  = make([]byte, 12)
+		info = make([]byte, 8)
+	)
+
+	nativeEndian.PutUint16(tcp[2:], 0xFFFF)
+	nativeEndian.PutUint16(tcp[4:], port)
+	nativeEndian.PutUint16(tcp[6:], port)
+	nativeEndian.PutUint32(info, mark)
+	nativeEndian.PutUint32(info[4:], 0xFFFFFFFF)
+
+	return [][]byte{
+		expr("match",
+			attr(nftaMatchName, str("tcp")),
+			attr(nftaMatchRev, be32(0)),
+			attr(nftaMatchInfo, tcp)),
+		expr("target",
+			attr(nftaMatchName, str("MARK")),
+			attr(2, be32(2)),
+			attr(nftaMatchInfo, info)),
+	}
+}
+
+// jumpExprs encodes `jump <chain>`.
+func jumpExprs(chain string) [][]byte {
+	code := int32(nftJump)
+
+	return [][]byte{expr("immediate",
+		attr(nftaImmediateDreg, be32(0)),
+		nested(nftaImmediateData, nested(nftaDataVerdict,
+			attr(nftaVerdictCode, be32(uint32(code))),
+			attr(nftaVerdictChain, str(chain)))))}
+}
+
+// baseChainMessage encodes a chain of the table `table` attached
+// to a hook, as dumped by NFT_MSG_GETCHAIN.
+func baseChainMessage(family byte, chain string, hooknum uint32, priority int32) syscall.NetlinkMessage {
+	data := append([]byte{family, 0, 0, 0},
+		attr(nftaChainTable, str("table"))...)
+	data = append(data, attr(nftaChainName, str(chain))...)
+	data = append(data, nested(nftaChainHook,
+		attr(nftaHookHooknum, be32(hooknum)),
+		attr(nftaHookPriority, be32(uint32(priority))))...)
+
+	return syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: nfnlSubsysNftables<<8 | nftMsgNewChain},
+		Data:   data,
+	}
+}
+
+// chainRuleMessage encodes a rule of the chain `chain` of the
+// table `table`, as dumped by NFT_MSG_GETRULE.
+func chainRuleMessage(family byte, chain string, exprs ...[][]byte) syscall.NetlinkMessage {
+	var flattened [][]byte
+	for _, e := range exprs {
+		flattened = append(flattened, e...)
+	}
+
+	data := append([]byte{family, 0, 0, 0},
+		attr(nftaRuleTable, str("table"))...)
+	data = append(data, attr(nftaRuleChain, str(chain))...)
+	data = append(data, nested(nftaRuleExpressions, flattened...)...)
+
+	return syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: nfnlSubsysNftables<<8 | nftMsgNewRule},
+		Data:   data,
+	}
+}
+
+// ruleMessage encodes a rule of the prerouting chain `chain`.
+func ruleMessage(family byte, exprs ...[][]byte) syscall.NetlinkMessage {
+	return chainRuleMessage(family, "chain", exprs...)
+}
+
+// multiportExprs encodes `-p udp -m multiport --dports
+// 80,8000:8080 -j MARK --set-xmark <mark>/0xffffffff` as
+// iptables-nft does.
+func multiportExprs(mark uint32) [][]byte {
+	var (
+		multiport = make([]byte, xtMultiportV1Size)
+		info      = make([]byte, 8)
+	)
+
+	multiport[0], multiport[1] = xtMultiportDestination, 3
+	nativeEndian.PutUint16(multiport[2:], 80)
+	nativeEndian.PutUint16(multiport[4:], 8000)
+	nativeEndian.PutUint16(multiport[6:], 8080)
+	multiport[2+2*xtMultiportMaxPorts+1] = 1
+	nativeEndian.PutUint32(info, mark)
+	nativeEndian.PutUint32(info[4:], 0xFFFFFFFF)
+
+	return append(l4protoExprs(syscall.IPPROTO_UDP, 0),
+		expr("match",
+			attr(nftaMatchName, str("multiport")),
+			attr(nftaMatchRev, be32(1)),
+			attr(nftaMatchInfo, multiport)),
+		expr("target",
+			attr(nftaMatchName, str("MARK")),
+			attr(2, be32(2)),
+			attr(nftaMatchInfo, info)))
+}
+
+func TestParseRuleMessages(t *testing.T) {
+	var (
+		accept = [][]byte{expr("immediate",
+			attr(nftaImmediateDreg, be32(0)),
+			nested(nftaImmediateData, nested(2, attr(1, be32(1)))))}
+		msgs = []syscall.NetlinkMessage{
+			baseChainMessage(nfprotoIPv4, "chain", nfInetPreRouting, -150),
+			baseChainMessage(nfprotoIPv6, "chain", nfInetPreRouting, -150),
+			baseChainMessage(nfprotoInet, "chain", nfInetPreRouting, -150),
+			baseChainMessage(7, "chain", nfInetPreRouting, -150),
+
+			ruleMessage(nfprotoIPv4, l4protoExprs(syscall.IPPROTO_TCP, 9), dportExprs(30000), markExprs(0x100)),
+			ruleMessage(nfprotoIPv4, compatExprs(30001, 0x101)),
+			ruleMessage(nfprotoIPv6, l4protoExprs(syscall.IPPROTO_TCP, 6), dportExprs(30002), markExprs(0x102)),
+			ruleMessage(nfprotoInet, l4protoExprs(syscall.IPPROTO_TCP, 0), dportExprs(30003), markExprs(0x103)),
+
+			// the same mark for udp
+			ruleMessage(nfprotoInet, l4protoExprs(syscall.IPPROTO_UDP, 0), dportExprs(30003), markExprs(0x103)),
+
+			// ranges and multiport
+			ruleMessage(nfprotoIPv4, rangeExprs(30010, 30019, false), markExprs(0x104)),
+			ruleMessage(nfprotoIPv4, rangeExprs(30020, 30029, true), markExprs(0x105)),
+			ruleMessage(nfprotoIPv4, multiportExprs(0x106)),
+
+			// no mark or unrelated families
+			ruleMessage(nfprotoIPv4, dportExprs(22), accept),
+			ruleMessage(7, dportExprs(30005), markExprs(0x108)),
+
+			// no port, as iptables keeps them
+			ruleMessage(nfprotoIPv4, markExprs(0x107)),
+			ruleMessage(nfprotoIPv4, l4protoExprs(syscall.IPPROTO_UDP, 9), markExprs(0x10A)),
+
+			// the port register gets overwritten before
+			// being compared
+			ruleMessage(nfprotoIPv4, dportExprs(30006)[:1], markExprs(0x109), dportExprs(30006)[1:]),
+
+			// marks combined with the previous one: or,
+			// xor and cleared with and
+			ruleMessage(nfprotoIPv4, dportExprs(30007), markExprs(0x110)),
+			ruleMessage(nfprotoIPv4, dportExprs(30007), bitwiseMarkExprs(^uint32(0x1), 0x1)),
+			ruleMessage(nfprotoIPv4, dportExprs(30007), bitwiseMarkExprs(0xFFFFFFFF, 0x100)),
+			ruleMessage(nfprotoIPv4, dportExprs(30008), markExprs(0x112)),
+			ruleMessage(nfprotoIPv4, dportExprs(30008), bitwiseMarkExprs(0, 0)),
+
+			// destination addresses, which only count
+			// for their family in `inet` tables
+			ruleMessage(nfprotoInet, daddrExprs(net.ParseIP("10.0.0.2")), dportExprs(30030), markExprs(0x120)),
+			ruleMessage(nfprotoInet, daddrExprs(net.ParseIP("fd00::2")), dportExprs(30030), markExprs(0x120)),
+
+			// other targets and revisions of MARK
+			ruleMessage(nfprotoIPv4, dportExprs(30009), targetExprs("CONNMARK", 1, make([]byte, 16))),
+			ruleMessage(nfprotoIPv4, dportExprs(30009), targetExprs("MARK", 1, []byte{0x13, 0x1, 0, 0})),
+
+			// chains that packets don't go through on the
+			// prerouting hook: attached to another hook or
+			// not jumped to
+			baseChainMessage(nfprotoIPv4, "output", 3, -150),
+			chainRuleMessage(nfprotoIPv4, "output", dportExprs(30040), markExprs(0x130)),
+			chainRuleMessage(nfprotoIPv4, "orphan", dportExprs(30040), markExprs(0x131)),
+
+			// chains jumped to (looping back) take the
+			// place of the jump
+			ruleMessage(nfprotoIPv4, jumpExprs("web")),
+			chainRuleMessage(nfprotoIPv4, "web", dportExprs(30041), markExprs(0x132)),
+			chainRuleMessage(nfprotoIPv4, "web", jumpExprs("chain")),
+
+			// chains of a higher priority go later, no
+			// matter the order in which they're dumped
+			ruleMessage(nfprotoIPv4, dportExprs(30042), bitwiseMarkExprs(^uint32(0x1), 0x1)),
+			chainRuleMessage(nfprotoIPv4, "early", dportExprs(30042), markExprs(0x140)),
+			baseChainMessage(nfprotoIPv4, "early", nfInetPreRouting, -300),
+		}
+		tcp = func(from, to uint16) Mapping {
+			return Mapping{Protocol: syscall.IPPROTO_TCP, Ports: []PortRange{{from, to}}}
+		}
+	)
+
+	res, err := parseRuleMessages(msgs)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[Family]map[uint32][]Mapping{
+		IPv4: {
+			0x100: {tcp(30000, 30000)},
+			0x101: {tcp(30001, 30001)},
+			0x103: {
+				tcp(30003, 30003),
+				{Protocol: syscall.IPPROTO_UDP, Ports: []PortRange{{30003, 30003}}},
+			},
+			0x104: {{Ports: []PortRange{{30010, 30019}}}},
+			0x105: {{Ports: []PortRange{{30020, 30029}}}},
+			0x106: {{Protocol: syscall.IPPROTO_UDP, Ports: []PortRange{{80, 80}, {8000, 8080}}}},
+			0x107: {{}},
+			0x109: {{}},
+			0x10A: {{Protocol: syscall.IPPROTO_UDP}},
+			0x011: {{Ports: []PortRange{{30007, 30007}}}},
+			0x120: {{Ports: []PortRange{{30030, 30030}}, Destination: net.IPv4(10, 0, 0, 2).To4()}},
+			0x132: {{Ports: []PortRange{{30041, 30041}}}},
+			0x141: {{Ports: []PortRange{{30042, 30042}}}},
+		},
+		IPv6: {
+			0x102: {tcp(30002, 30002)},
+			0x120: {{Ports: []PortRange{{30030, 30030}}, Destination: net.ParseIP("fd00::2")}},
+			0x103: {
+				tcp(30003, 30003),
+				{Protocol: syscall.IPPROTO_UDP, Ports: []PortRange{{30003, 30003}}},
+			},
+		},
+	}, res)
+}
+
+func TestParseRuleMessagesMalformed(t *testing.T) {
+	msg := ruleMessage(nfprotoIPv4, dportExprs(30000), markExprs(0x100))
+
+	// the expressions go past the (truncated) message
+	msg.Data = msg.Data[:len(msg.Data)-4]
+
+	_, err := parseRuleMessages([]syscall.NetlinkMessage{msg})
+	assert.Error(t, err)
+}
+
+// TestGetMappingsNftables loads a ruleset with `nft` in a
+// throwaway network namespace and retrieves the mappings from
+// it.
+func TestGetMappingsNftables(t *testing.T) {
+	if _, err := exec.LookPath("nft"); err != nil {
+		t.Skip("nft is not available")
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("creating network namespaces requires root")
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origin, err := netns.Get()
+	require.NoError(t, err)
+	defer origin.Close()
+
+	ns, err := netns.New()
+	require.NoError(t, err)
+	defer ns.Close()
+	defer netns.Set(origin)
+
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(`
+table ip ingress {
+	chain prerouting {
+		type filter hook prerouting priority mangle;
+		tcp dport 30000 meta mark set 0x100
+		udp dport 30010-30019 meta mark set 0x102
+		tcp dport 22 accept
+	}
+	chain output {
+		type filter hook output priority mangle;
+		tcp dport 30020 meta mark set 0x103
+	}
+}
+table inet web {
+	chain prerouting {
+		type filter hook prerouting priority mangle;
+		tcp dport 30001 meta mark set 0x101
+	}
+}
+`)
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	res, err := GetMappings()
+	require.NoError(t, err)
+
+	assert.Equal(t, map[Family]map[uint32][]Mapping{
+		IPv4: {
+			0x100: {{Protocol: syscall.IPPROTO_TCP, Ports: []PortRange{{30000, 30000}}}},
+			0x101: {{Protocol: syscall.IPPROTO_TCP, Ports: []PortRange{{30001, 30001}}}},
+			0x102: {{Protocol: syscall.IPPROTO_UDP, Ports: []PortRange{{30010, 30019}}}},
+		},
+		IPv6: {
+			0x101: {{Protocol: syscall.IPPROTO_TCP, Ports: []PortRange{{30001, 30001}}}},
+		},
+	}, res)
+}
@@ -0,0 +1,470 @@
+/**
+ * capture replaces the mangle table of the current network
+ * namespace (iptables and ip6tables) by one with the rules that
+ * docker swarm sets up for published ports (plus a couple of
+ * unrelated ones) and dumps what IPT_SO_GET_ENTRIES (and
+ * IP6T_SO_GET_ENTRIES) retrieves, preceded by the table info:
+ *
+ *	mangle_ipv4.bin, mangle_ipv6.bin
+ *
+ * Next to these, it writes what the C implementation of the
+ * mapper extracts from each of the PREROUTING rules of the dump
+ * that set a mark (see `_m_get_mark_mapping_from_matches`):
+ *
+ *	mangle_ipv4.golden, mangle_ipv6.golden
+ *
+ * Being destructive, it's meant to be run in a network namespace
+ * of its own:
+ *
+ *	gcc -o capture capture.c ../mapper.c ../mapper6.c \
+ *		-lip4tc -lip6tc -lxtables
+ *	unshare -n ./capture
+ */
+#include "../mapper.h"
+
+#include <arpa/inet.h>
+#include <libiptc/libip6tc.h>
+#include <libiptc/libiptc.h>
+#include <linux/netfilter/xt_connmark.h>
+#include <linux/netfilter/xt_multiport.h>
+#include <linux/netfilter/xt_sctp.h>
+#include <linux/netfilter/xt_tcpudp.h>
+
+#define BUF_SIZE 8192
+
+/**
+ * rule describes a rule of the PREROUTING chain: an optional
+ * destination address (fd00::a.b.c.d for ipv6), the protocol, the match (if
+ * any) with the destination ports that it restricts - `from`
+ * and `to` or, for multiport, 80, 443 and 8000-8080 - and the
+ * target: MARK with `--set-xmark mark/mask`, the one named by
+ * `target` (CONNMARK, setting `mark` on the connection) or, if
+ * both `mark` and `mask` are zero, ACCEPT.
+ *
+ * `invert` inverts the destination ports of tcp matches.
+ */
+struct rule {
+	__u8        destination[4];
+	__u16       protocol;
+	const char* match;
+	__u16       from;
+	__u16       to;
+	int         invert;
+	__u32       mark;
+	__u32       mask;
+	const char* target;
+};
+
+static const struct rule rules[] = {
+	{ { 0 }, IPPROTO_TCP, "tcp", 30000, 30000, 0, 0x100, ~0U },
+	{ { 0 }, IPPROTO_TCP, "tcp", 30001, 30001, 0, 0x101, ~0U },
+	{ { 10, 0, 0, 2 }, IPPROTO_TCP, NULL, 0, 0, 0, 0x102, ~0U },
+	{ { 0 }, IPPROTO_UDP, "udp", 53, 53, 0, 0, 0 },
+	{ { 0 }, IPPROTO_UDP, "udp", 30001, 30001, 0, 0x101, ~0U },
+	{ { 0 }, IPPROTO_SCTP, "sctp", 30002, 30002, 0, 0x103, ~0U },
+	{ { 0 }, IPPROTO_TCP, "tcp", 30010, 30019, 0, 0x104, ~0U },
+	{ { 0 }, IPPROTO_TCP, "multiport", 0, 0, 0, 0x105, ~0U },
+	{ { 0 }, IPPROTO_TCP, "tcp", 22, 22, 1, 0x106, ~0U },
+
+	// --set-xmark 0x107 followed by --or-mark 0x8
+	{ { 0 }, IPPROTO_TCP, "tcp", 30020, 30020, 0, 0x107, ~0U },
+	{ { 0 }, IPPROTO_TCP, "tcp", 30020, 30020, 0, 0x8, 0x8 },
+
+	// --set-mark 0x200/0xff00
+	{ { 0 }, IPPROTO_TCP, "tcp", 30021, 30021, 0, 0x200, 0xFF00 },
+
+	// --set-xmark 0x300 followed by --and-mark 0
+	{ { 0 }, IPPROTO_TCP, "tcp", 30022, 30022, 0, 0x300, ~0U },
+	{ { 0 }, IPPROTO_TCP, "tcp", 30022, 30022, 0, 0, ~0U },
+
+	{ { 0 }, IPPROTO_TCP, "tcp", 30023, 30023, 0, 0x400, 0, "CONNMARK" },
+};
+
+static size_t
+put_match(char* buf, const struct rule* r)
+{
+	struct xt_entry_match* match = (void*)buf;
+	size_t                 size  = 0;
+
+	strcpy(match->u.user.name, r->match);
+
+	if (!strcmp(r->match, "tcp")) {
+		struct xt_tcp* info = (void*)match->data;
+
+		size          = sizeof(*info);
+		info->spts[1] = 0xFFFF;
+		info->dpts[0] = r->from;
+		info->dpts[1] = r->to;
+		info->invflags = r->invert ? XT_TCP_INV_DSTPT : 0;
+	} else if (!strcmp(r->match, "udp")) {
+		struct xt_udp* info = (void*)match->data;
+
+		size          = sizeof(*info);
+		info->spts[1] = 0xFFFF;
+		info->dpts[0] = r->from;
+		info->dpts[1] = r->to;
+	} else if (!strcmp(r->match, "sctp")) {
+		struct xt_sctp_info* info = (void*)match->data;
+
+		size          = sizeof(*info);
+		info->spts[1] = 0xFFFF;
+		info->dpts[0] = r->from;
+		info->dpts[1] = r->to;
+		info->flags   = XT_SCTP_DEST_PORTS;
+	} else {
+		struct xt_multiport_v1* info = (void*)match->data;
+
+		size                  = sizeof(*info);
+		match->u.user.revision = 1;
+		info->flags           = XT_MULTIPORT_DESTINATION;
+		info->count           = 4;
+		info->ports[0]        = 80;
+		info->ports[1]        = 443;
+		info->ports[2]        = 8000;
+		info->ports[3]        = 8080;
+		info->pflags[2]       = 1;
+	}
+
+	size = XT_ALIGN(sizeof(*match)) + XT_ALIGN(size);
+	match->u.user.match_size = size;
+
+	return size;
+}
+
+static size_t
+put_target(char* buf, const struct rule* r)
+{
+	if (!r || (!r->mark && !r->mask && !r->target)) {
+		struct xt_standard_target* target = (void*)buf;
+
+		target->target.u.user.target_size = sizeof(*target);
+		target->verdict                   = -NF_ACCEPT - 1;
+		return sizeof(*target);
+	}
+
+	if (r->target) {
+		struct xt_entry_target*       target = (void*)buf;
+		struct xt_connmark_tginfo1*   info   = (void*)target->data;
+		size_t                        size =
+		  XT_ALIGN(sizeof(*target)) + XT_ALIGN(sizeof(*info));
+
+		target->u.user.target_size = size;
+		target->u.user.revision    = 1;
+		strcpy(target->u.user.name, r->target);
+		info->ctmark = r->mark;
+		info->ctmask = 0xFFFFFFFF;
+		info->nfmask = 0xFFFFFFFF;
+		info->mode   = XT_CONNMARK_SET;
+
+		return size;
+	}
+
+	struct xt_entry_target*  target = (void*)buf;
+	struct xt_mark_tginfo2*  info   = (void*)target->data;
+	size_t                   size =
+	  XT_ALIGN(sizeof(*target)) + XT_ALIGN(sizeof(*info));
+
+	target->u.user.target_size = size;
+	target->u.user.revision    = M_MARK_TARGET_REVISION;
+	strcpy(target->u.user.name, M_MARK_TARGET);
+	info->mark = r->mark;
+	info->mask = r->mask;
+
+	return size;
+}
+
+static size_t
+put_error(char* buf)
+{
+	struct xt_error_target* target = (void*)buf;
+
+	target->target.u.user.target_size = sizeof(*target);
+	strcpy(target->target.u.user.name, XT_ERROR_TARGET);
+	strcpy(target->errorname, XT_ERROR_TARGET);
+
+	return sizeof(*target);
+}
+
+static void
+write_file(const char* path, const void* data, size_t size)
+{
+	FILE* f = fopen(path, "w");
+	if (!f || fwrite(data, 1, size, f) != size) {
+		perror(path);
+		exit(1);
+	}
+
+	fclose(f);
+}
+
+/**
+ * write_golden writes the mapping that the C implementation
+ * extracts from a rule in the same format as `mapper/cmd`,
+ * plus the hash of its criteria.
+ */
+static void
+write_golden(FILE* golden, const m_mark_mapping_t* mapping)
+{
+	if (!mapping->is_mark_rule) {
+		return;
+	}
+
+	char destination[INET6_ADDRSTRLEN] = "";
+
+	if (mapping->destination_length) {
+		inet_ntop(mapping->destination_length == 4 ? AF_INET : AF_INET6,
+		          mapping->destination, destination,
+		          sizeof(destination));
+	}
+
+	fprintf(golden,
+	        "mark=%u,mask=%u,criteria=%llx,protocol=%u,destination=%s,ports=",
+	        mapping->firewall_mark, mapping->firewall_mark_mask,
+	        (unsigned long long)mapping->criteria, mapping->protocol,
+	        destination);
+
+	for (unsigned int i = 0; i < mapping->port_ranges_length; i++) {
+		fprintf(golden, i ? ",%u" : "%u", mapping->port_ranges[i].from);
+		if (mapping->port_ranges[i].to != mapping->port_ranges[i].from) {
+			fprintf(golden, "-%u", mapping->port_ranges[i].to);
+		}
+	}
+
+	fprintf(golden, "\n");
+}
+
+static void
+capture4()
+{
+	static char          buf[BUF_SIZE], entries_buf[BUF_SIZE];
+	struct ipt_getinfo   info    = { .name = M_TABLE };
+	socklen_t            len     = sizeof(info);
+	struct ipt_replace*  replace = (void*)buf;
+	size_t               offset  = 0;
+	int                  fd      = socket(AF_INET, SOCK_RAW, IPPROTO_RAW);
+
+	if (fd < 0 || getsockopt(fd, IPPROTO_IP, IPT_SO_GET_INFO, &info, &len)) {
+		perror("ipv4 info");
+		exit(1);
+	}
+
+	strcpy(replace->name, M_TABLE);
+	replace->valid_hooks  = info.valid_hooks;
+	replace->num_counters = info.num_entries;
+	replace->counters     = calloc(info.num_entries, sizeof(struct xt_counters));
+
+	for (unsigned int hook = 0; hook < NF_INET_NUMHOOKS; hook++) {
+		replace->hook_entry[hook] = offset;
+
+		for (unsigned int i = 0; hook == NF_INET_PRE_ROUTING &&
+		                         i < sizeof(rules) / sizeof(*rules);
+		     i++) {
+			struct ipt_entry* entry = (void*)replace->entries + offset;
+
+			entry->ip.proto = rules[i].protocol;
+			if (rules[i].destination[0]) {
+				memcpy(&entry->ip.dst, rules[i].destination, 4);
+				entry->ip.dmsk.s_addr = 0xFFFFFFFF;
+			}
+
+			entry->target_offset = sizeof(*entry);
+			if (rules[i].match) {
+				entry->target_offset +=
+				  put_match((char*)entry + sizeof(*entry), &rules[i]);
+			}
+			entry->next_offset =
+			  entry->target_offset +
+			  put_target((char*)entry + entry->target_offset, &rules[i]);
+
+			offset += entry->next_offset;
+			replace->num_entries++;
+		}
+
+		// policy
+		struct ipt_entry* entry  = (void*)replace->entries + offset;
+		replace->underflow[hook] = offset;
+		entry->target_offset     = sizeof(*entry);
+		entry->next_offset =
+		  entry->target_offset + put_target((char*)entry + sizeof(*entry), NULL);
+		offset += entry->next_offset;
+		replace->num_entries++;
+	}
+
+	struct ipt_entry* entry = (void*)replace->entries + offset;
+	entry->target_offset    = sizeof(*entry);
+	entry->next_offset =
+	  entry->target_offset + put_error((char*)entry + sizeof(*entry));
+	offset += entry->next_offset;
+	replace->num_entries++;
+	replace->size = offset;
+
+	if (setsockopt(fd, IPPROTO_IP, IPT_SO_SET_REPLACE, replace,
+	               sizeof(*replace) + offset)) {
+		perror("ipv4 replace");
+		exit(1);
+	}
+
+	len = sizeof(info);
+	if (getsockopt(fd, IPPROTO_IP, IPT_SO_GET_INFO, &info, &len)) {
+		perror("ipv4 info");
+		exit(1);
+	}
+
+	struct ipt_get_entries* entries = (void*)entries_buf;
+	strcpy(entries->name, M_TABLE);
+	entries->size = info.size;
+	len           = sizeof(*entries) + info.size;
+	if (getsockopt(fd, IPPROTO_IP, IPT_SO_GET_ENTRIES, entries, &len)) {
+		perror("ipv4 entries");
+		exit(1);
+	}
+
+	memcpy(buf, &info, sizeof(info));
+	memcpy(buf + sizeof(info), entries->entrytable, info.size);
+	write_file("mangle_ipv4.bin", buf, sizeof(info) + info.size);
+
+	FILE* golden = fopen("mangle_ipv4.golden", "w");
+	for (offset = info.hook_entry[NF_INET_PRE_ROUTING];
+	     offset < info.underflow[NF_INET_PRE_ROUTING];
+	     offset += entry->next_offset) {
+		m_mark_mapping_t mapping = { 0 };
+
+		entry = (void*)entries->entrytable + offset;
+		_m_get_mark_mapping_from_matches(entry, sizeof(*entry),
+		                                 sizeof(entry->ip),
+		                                 entry->ip.proto,
+		                                 entry->target_offset,
+		                                 ipt_get_target(entry), &mapping);
+		_m_set_destination(&mapping, &entry->ip.dst, &entry->ip.dmsk,
+		                   sizeof(entry->ip.dst),
+		                   entry->ip.invflags & IPT_INV_DSTIP);
+		write_golden(golden, &mapping);
+	}
+	fclose(golden);
+}
+
+static void
+capture6()
+{
+	static char          buf[BUF_SIZE], entries_buf[BUF_SIZE];
+	struct ip6t_getinfo  info    = { .name = M_TABLE };
+	socklen_t            len     = sizeof(info);
+	struct ip6t_replace* replace = (void*)buf;
+	size_t               offset  = 0;
+	int                  fd      = socket(AF_INET6, SOCK_RAW, IPPROTO_RAW);
+
+	if (fd < 0 ||
+	    getsockopt(fd, IPPROTO_IPV6, IP6T_SO_GET_INFO, &info, &len)) {
+		perror("ipv6 info");
+		exit(1);
+	}
+
+	strcpy(replace->name, M_TABLE);
+	replace->valid_hooks  = info.valid_hooks;
+	replace->num_counters = info.num_entries;
+	replace->counters     = calloc(info.num_entries, sizeof(struct xt_counters));
+
+	for (unsigned int hook = 0; hook < NF_INET_NUMHOOKS; hook++) {
+		replace->hook_entry[hook] = offset;
+
+		for (unsigned int i = 0; hook == NF_INET_PRE_ROUTING &&
+		                         i < sizeof(rules) / sizeof(*rules);
+		     i++) {
+			struct ip6t_entry* entry = (void*)replace->entries + offset;
+
+			// fd00::a.b.c.d stands for the ipv4 destination
+			if (rules[i].destination[0]) {
+				entry->ipv6.dst.s6_addr[0] = 0xFD;
+				memcpy(&entry->ipv6.dst.s6_addr[12],
+				       rules[i].destination, 4);
+				memset(&entry->ipv6.dmsk, 0xFF,
+				       sizeof(entry->ipv6.dmsk));
+			}
+
+			entry->ipv6.proto = rules[i].protocol;
+			entry->ipv6.flags = IP6T_F_PROTO;
+
+			entry->target_offset = sizeof(*entry);
+			if (rules[i].match) {
+				entry->target_offset +=
+				  put_match((char*)entry + sizeof(*entry), &rules[i]);
+			}
+			entry->next_offset =
+			  entry->target_offset +
+			  put_target((char*)entry + entry->target_offset, &rules[i]);
+
+			offset += entry->next_offset;
+			replace->num_entries++;
+		}
+
+		// policy
+		struct ip6t_entry* entry = (void*)replace->entries + offset;
+		replace->underflow[hook] = offset;
+		entry->target_offset     = sizeof(*entry);
+		entry->next_offset =
+		  entry->target_offset + put_target((char*)entry + sizeof(*entry), NULL);
+		offset += entry->next_offset;
+		replace->num_entries++;
+	}
+
+	struct ip6t_entry* entry = (void*)replace->entries + offset;
+	entry->target_offset     = sizeof(*entry);
+	entry->next_offset =
+	  entry->target_offset + put_error((char*)entry + sizeof(*entry));
+	offset += entry->next_offset;
+	replace->num_entries++;
+	replace->size = offset;
+
+	if (setsockopt(fd, IPPROTO_IPV6, IP6T_SO_SET_REPLACE, replace,
+	               sizeof(*replace) + offset)) {
+		perror("ipv6 replace");
+		exit(1);
+	}
+
+	len = sizeof(info);
+	if (getsockopt(fd, IPPROTO_IPV6, IP6T_SO_GET_INFO, &info, &len)) {
+		perror("ipv6 info");
+		exit(1);
+	}
+
+	struct ip6t_get_entries* entries = (void*)entries_buf;
+	strcpy(entries->name, M_TABLE);
+	entries->size = info.size;
+	len           = sizeof(*entries) + info.size;
+	if (getsockopt(fd, IPPROTO_IPV6, IP6T_SO_GET_ENTRIES, entries, &len)) {
+		perror("ipv6 entries");
+		exit(1);
+	}
+
+	memcpy(buf, &info, sizeof(info));
+	memcpy(buf + sizeof(info), entries->entrytable, info.size);
+	write_file("mangle_ipv6.bin", buf, sizeof(info) + info.size);
+
+	FILE* golden = fopen("mangle_ipv6.golden", "w");
+	for (offset = info.hook_entry[NF_INET_PRE_ROUTING];
+	     offset < info.underflow[NF_INET_PRE_ROUTING];
+	     offset += entry->next_offset) {
+		m_mark_mapping_t mapping = { 0 };
+
+		entry = (void*)entries->entrytable + offset;
+		_m_get_mark_mapping_from_matches(entry, sizeof(*entry),
+		                                 sizeof(entry->ipv6),
+		                                 entry->ipv6.proto,
+		                                 entry->target_offset,
+		                                 ip6t_get_target(entry), &mapping);
+		_m_set_destination(&mapping, &entry->ipv6.dst, &entry->ipv6.dmsk,
+		                   sizeof(entry->ipv6.dst),
+		                   entry->ipv6.invflags & IP6T_INV_DSTIP);
+		write_golden(golden, &mapping);
+	}
+	fclose(golden);
+}
+
+int
+main(void)
+{
+	capture4();
+	capture6();
+
+	return 0;
+}